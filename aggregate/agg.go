@@ -0,0 +1,155 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Aggregation functions of each time slot. Each is constant memory.
+const (
+	// arithmetic mean
+	AggAvg = "avg"
+	// geometric mean. For growth rates and ratios
+	AggGeomean = "geomean"
+	// harmonic mean. For rates like speeds
+	AggHarmean = "harmean"
+	AggMin     = "min"
+	AggMax     = "max"
+	AggSum     = "sum"
+	// number of records, regardless of the values
+	AggCount = "count"
+	// sample standard deviation, by Welford's online algorithm. NaN for a single record
+	AggStddev = "stddev"
+	// counts of the values in the bins of Options.HistogramMin to HistogramMax. Constant memory by the number of the bins
+	AggHistogram = "histogram"
+)
+
+// AggFuncs lists the aggregation functions in the order of the help.
+var AggFuncs = []string{AggAvg, AggGeomean, AggHarmean, AggMin, AggMax, AggSum, AggCount, AggStddev, AggHistogram}
+
+// ParsePercentile returns the quantile of the percentile aggregation function, e.g. 0.9 of `p90`.
+// The percentiles are estimated by the quantile sketch as Options.Quantile, so ok is false for the others.
+func ParsePercentile(agg string) (quantile float64, ok bool) {
+	p, found := strings.CutPrefix(agg, "p")
+	if !found {
+		return 0, false
+	}
+	percent, err := strconv.ParseFloat(p, 64)
+	if err != nil || !(percent >= 0 && percent <= 100) {
+		return 0, false
+	}
+	return percent / 100, true
+}
+
+// accumulator aggregates the values of a time slot.
+// The state is a single value and the count, so it's saved as is in the checkpoint.
+// Except the running mean of stddev and the histogram, which are not checkpointed.
+type accumulator struct {
+	agg string
+	// sum of the terms of the means and sum, the running min or max,
+	// or the sum of squared differences from the mean of stddev
+	value float64
+	count int
+	mean  float64
+	hist  *Histogram
+}
+
+// newAccumulator creates the empty accumulator of the aggregation function of the options.
+func newAccumulator(opts Options) accumulator {
+	a := accumulator{agg: opts.Agg}
+	if opts.Agg == AggHistogram {
+		a.hist = newHistogram(opts.HistogramMin, opts.HistogramMax, opts.HistogramBins)
+	}
+	return a
+}
+
+// Add adds the value to the time slot.
+func (a *accumulator) Add(value float64) error {
+	switch a.agg {
+	case AggMin:
+		if a.count == 0 || value < a.value {
+			a.value = value
+		}
+	case AggMax:
+		if a.count == 0 || value > a.value {
+			a.value = value
+		}
+	case AggCount:
+	case AggHistogram:
+		// the sum as well, so the result is the mean
+		a.hist.add(value)
+		a.value += value
+	case AggStddev:
+		// Welford's algorithm, stable unlike the sum of squares
+		delta := value - a.mean
+		a.mean += delta / float64(a.count+1)
+		a.value += delta * (value - a.mean)
+	default:
+		term, err := aggTerm(a.agg, value)
+		if err != nil {
+			return err
+		}
+		a.value += term
+	}
+	a.count++
+	return nil
+}
+
+// Result returns the aggregated value of the time slot.
+func (a *accumulator) Result() float64 {
+	switch a.agg {
+	case AggMin, AggMax, AggSum:
+		return a.value
+	case AggCount:
+		return float64(a.count)
+	case AggStddev:
+		if a.count < 2 {
+			return math.NaN()
+		}
+		return math.Sqrt(a.value / float64(a.count-1))
+	default:
+		return aggResult(a.agg, a.value, a.count)
+	}
+}
+
+// Reset empties the time slot.
+func (a *accumulator) Reset() {
+	a.value, a.count, a.mean = 0, 0, 0
+	if a.hist != nil {
+		a.hist.reset()
+	}
+}
+
+// aggTerm transforms the value into the term accumulated to the sum.
+func aggTerm(agg string, value float64) (float64, error) {
+	switch agg {
+	case AggGeomean:
+		if value < 0 {
+			return 0, fmt.Errorf("geometric mean is undefined for negative value: %v", value)
+		}
+		// sum of logs for stability, instead of the product.
+		// zero is allowed, which makes the mean zero as log(0) is -Inf
+		return math.Log(value), nil
+	case AggHarmean:
+		if value <= 0 {
+			return 0, fmt.Errorf("harmonic mean is undefined for non-positive value: %v", value)
+		}
+		return 1 / value, nil
+	default:
+		return value, nil
+	}
+}
+
+// aggResult computes the aggregated value from the sum of the terms.
+func aggResult(agg string, sum float64, count int) float64 {
+	switch agg {
+	case AggGeomean:
+		return math.Exp(sum / float64(count))
+	case AggHarmean:
+		return float64(count) / sum
+	default:
+		return sum / float64(count)
+	}
+}
@@ -0,0 +1,157 @@
+package aggregate
+
+import (
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestAggFuncs(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z 4\n2021-03-04T03:10:00Z -2\n2021-03-04T03:20:00Z 10\n2021-03-04T04:00:00Z 7\n"
+	tests := []struct {
+		agg  string
+		want string
+	}{
+		{agg: AggAvg, want: "2021-03-04T03:00:00Z   4.0000\n2021-03-04T04:00:00Z   7.0000\n"},
+		{agg: AggMin, want: "2021-03-04T03:00:00Z  -2.0000\n2021-03-04T04:00:00Z   7.0000\n"},
+		{agg: AggMax, want: "2021-03-04T03:00:00Z  10.0000\n2021-03-04T04:00:00Z   7.0000\n"},
+		{agg: AggSum, want: "2021-03-04T03:00:00Z  12.0000\n2021-03-04T04:00:00Z   7.0000\n"},
+		{agg: AggCount, want: "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   1.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.agg, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Agg = tt.agg
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePercentile(t *testing.T) {
+	for agg, want := range map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99, "p99.9": 0.999, "p0": 0, "p100": 1} {
+		if got, ok := ParsePercentile(agg); !ok || math.Abs(got-want) > 1e-12 {
+			t.Errorf("%s: got %v, %v, want %v", agg, got, ok, want)
+		}
+	}
+	for _, agg := range []string{AggAvg, "p", "p101", "p-1", "pNaN", "90"} {
+		if got, ok := ParsePercentile(agg); ok {
+			t.Errorf("%s: got %v, want not a percentile", agg, got)
+		}
+	}
+}
+
+func TestGeometricHarmonicMean(t *testing.T) {
+	tests := []struct {
+		agg    string
+		values []float64
+		want   float64
+	}{
+		// cube root of 1*2*4
+		{agg: AggGeomean, values: []float64{1, 2, 4}, want: 2},
+		{agg: AggGeomean, values: []float64{2, 8}, want: 4},
+		{agg: AggGeomean, values: []float64{0, 5}, want: 0},
+		// 60km/h there and 40km/h back
+		{agg: AggHarmean, values: []float64{40, 60}, want: 48},
+		{agg: AggHarmean, values: []float64{1, 2, 4}, want: 3 / 1.75},
+	}
+	for _, tt := range tests {
+		var sum float64
+		for _, v := range tt.values {
+			term, err := aggTerm(tt.agg, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum += term
+		}
+		if got := aggResult(tt.agg, sum, len(tt.values)); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s of %v = %v, want %v", tt.agg, tt.values, got, tt.want)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Agg = AggHarmean
+	if got := mustAggregate(t, opts, "2021-03-04T03:00:00Z 040.0000\n2021-03-04T03:10:00Z 060.0000\n"); got != "2021-03-04T03:00:00Z  48.0000\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestGeometricHarmonicMeanUndefined(t *testing.T) {
+	tests := []struct {
+		agg   string
+		value string
+		want  string
+	}{
+		{agg: AggGeomean, value: "-01.0000", want: "geometric mean is undefined for negative value: -1"},
+		{agg: AggHarmean, value: "000.0000", want: "harmonic mean is undefined for non-positive value: 0"},
+		{agg: AggHarmean, value: "-02.0000", want: "harmonic mean is undefined for non-positive value: -2"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Agg = tt.agg
+		_, err := runAggregate(opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z "+tt.value+"\n")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s of %s: got %v, want %q", tt.agg, tt.value, err, tt.want)
+		}
+	}
+}
+
+func TestStddevAgainstTwoPass(t *testing.T) {
+	twoPass := func(values []float64) float64 {
+		var mean float64
+		for _, v := range values {
+			mean += v
+		}
+		mean /= float64(len(values))
+		var m2 float64
+		for _, v := range values {
+			m2 += (v - mean) * (v - mean)
+		}
+		return math.Sqrt(m2 / float64(len(values)-1))
+	}
+
+	rng := rand.New(rand.NewPCG(7, 8))
+	random := make([]float64, 10_000)
+	for i := range random {
+		random[i] = rng.NormFloat64()*3 + 100
+	}
+	tests := []struct {
+		name   string
+		values []float64
+	}{
+		{name: "known", values: []float64{2, 4, 4, 4, 5, 5, 7, 9}},
+		// the sum of squares cancels out catastrophically around the large offset
+		{name: "large offset", values: []float64{1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16}},
+		{name: "negative", values: []float64{-1.5, 0, 2.25, -7}},
+		{name: "random", values: random},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := accumulator{agg: AggStddev}
+			for _, v := range tt.values {
+				if err := a.Add(v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, want := a.Result(), twoPass(tt.values)
+			if math.Abs(got-want) > 1e-9*want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	// exact even around the large offset, of the variance 30
+	a := accumulator{agg: AggStddev}
+	for _, v := range []float64{1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16} {
+		a.Add(v)
+	}
+	if got := a.Result(); got != math.Sqrt(30) {
+		t.Errorf("got %v, want √30", got)
+	}
+	a.Reset()
+	if a.Add(1); !math.IsNaN(a.Result()) {
+		t.Errorf("got %v, want NaN of a single record", a.Result())
+	}
+}
@@ -0,0 +1,591 @@
+// Package aggregate aggregates a stream of timestamped records into time slots.
+//
+// Each record is an RFC3339 timestamp followed by the value, e.g. `2021-03-04T03:00:00Z 113.1652`.
+// The stream is read once, with memory independent of its length.
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Precision of the high precision accumulator in bits. float64 has 53.
+	highPrecisionBits = 256
+	// Length of a record including the separator
+	// YYYY-MM-DDTHH:MM:SSZ 000.0000\n
+	recordLength = 30
+	// Number of records between the progress lines
+	progressInterval = 100_000
+)
+
+// Formats of the output
+const (
+	FormatText = "text"
+	// one JSON object per time slot
+	FormatJSONL = "jsonl"
+)
+
+// Formats of the numbers of the text output
+const (
+	// right aligned in 8 columns, e.g. `%8.4f`, as consumed by the legacy scripts
+	NumberFormatFixed = "fixed"
+	// with the precision, unpadded, e.g. `%.4f`
+	NumberFormatPlain = "plain"
+	// as few digits as represent the value exactly, regardless of the precision
+	NumberFormatRaw = "raw"
+)
+
+// Orders of Options.ExpectMonotonic
+const (
+	MonotonicIncreasing = "increasing"
+	MonotonicDecreasing = "decreasing"
+)
+
+// now returns the current time. Replaceable for testing.
+var now = time.Now
+
+// ErrTimeout is returned by Run when the context is done mid-stream.
+// The time slots read so far are written, the open one being partial.
+var ErrTimeout = errors.New("timeout reached. please extend the timeout")
+
+// ErrInterrupted is returned by Run when the context is canceled mid-stream, e.g. by a signal.
+// The time slots read so far are written the same as ErrTimeout.
+var ErrInterrupted = errors.New("interrupted")
+
+// Buffers of Run, reused across runs to reduce GC pressure (e.g. server mode)
+var (
+	readerPool = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+	writerPool = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}
+	runPool    = sync.Pool{New: func() any { return new(run) }}
+)
+
+// Aggregator aggregates a stream into the time slots, writing a line per time slot.
+type Aggregator struct {
+	w    io.Writer
+	opts Options
+}
+
+// NewAggregator creates the aggregator writing to w.
+func NewAggregator(w io.Writer, opts Options) *Aggregator {
+	return &Aggregator{w: w, opts: opts}
+}
+
+// Source is a named stream of RunSources.
+type Source struct {
+	// Prefix of the errors of the records, e.g. the file name. Empty means no prefix.
+	Name string
+	R    io.Reader
+}
+
+// Run reads the stream to the end and writes the time slots.
+// The records must be grouped by the time slots in ascending order, unless Options.Unordered.
+func (a *Aggregator) Run(ctx context.Context, stream io.Reader) error {
+	return a.RunSources(ctx, Source{R: stream})
+}
+
+// RunSources reads the sources in order as a single stream, except a record never spans two sources.
+// With Options.Unordered, a time slot found in several sources is aggregated as one, e.g. to merge files.
+func (a *Aggregator) RunSources(ctx context.Context, sources ...Source) (err error) {
+	var (
+		opts, w     = a.opts, a.w
+		stream      = sources[0].R
+		source      int
+		pending     *bytes.Buffer
+		lastRecord  []byte
+		streamEnded bool
+	)
+
+	if opts.TrimTrailingNewline {
+		// the output of the previous run ended with the held new line
+		w = &newlineTrimmer{w: w, held: opts.Resume}
+	}
+	out := w
+
+	// With checkpointing, hold the output until the next checkpoint,
+	// so that the output never gets ahead of the saved state.
+	if opts.CheckpointPath != "" {
+		pending = new(bytes.Buffer)
+		out = pending
+	}
+	writer := writerPool.Get().(*bufio.Writer)
+	writer.Reset(out)
+	defer func() {
+		// e.g. the disk is full, so the caller never takes the output as complete
+		if ferr := writer.Flush(); err == nil && ferr != nil {
+			err = fmt.Errorf("failed to write output: %w", ferr)
+		}
+		writer.Reset(nil)
+		writerPool.Put(writer)
+	}()
+
+	r := runPool.Get().(*run)
+	r.init(writer, opts)
+	r.w, r.pending = w, pending
+	defer func() {
+		for _, u := range r.rollups {
+			if ferr := u.writer.Flush(); err == nil && ferr != nil {
+				err = fmt.Errorf("failed to write output of %s: %w", u.opts.Granularity.Name, ferr)
+			}
+			u.writer.Reset(nil)
+			writerPool.Put(u.writer)
+		}
+		// nothing of the run is kept, e.g. the callbacks of the options, but the backing array of the slot writers
+		clear(r.all)
+		*r = run{all: r.all[:0]}
+		runPool.Put(r)
+	}()
+	if opts.Stats != nil {
+		defer func() {
+			*opts.Stats = r.counts.stats()
+		}()
+	}
+
+	if opts.Resume {
+		var cp checkpoint
+		if cp, err = loadCheckpoint(opts.CheckpointPath, opts); err != nil {
+			return
+		}
+		// skip the data already processed by the previous run
+		if _, err = io.CopyN(io.Discard, stream, cp.Position); err != nil {
+			err = fmt.Errorf("failed to skip to checkpoint position(%d): %w", cp.Position, err)
+			return
+		}
+		if err = r.restore(cp); err != nil {
+			return
+		}
+	}
+
+	for _, s := range r.all {
+		if err = writeHeader(s.w, s.opts); err != nil {
+			return
+		}
+	}
+
+	if r.resetMarker != nil {
+		// label the output by the segments, starting from 1
+		r.startSegment()
+	}
+
+	// frame the stream by records. created after the resume, as it reads ahead
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(stream)
+	defer func() {
+		reader.Reset(nil)
+		readerPool.Put(reader)
+	}()
+
+	if len(sources) > 1 || sources[0].Name != "" {
+		defer func() {
+			if err != nil && !streamEnded && sources[source].Name != "" {
+				err = fmt.Errorf("%s: %w", sources[source].Name, err)
+			}
+		}()
+	}
+	if opts.PartialOutputOnError {
+		defer func() {
+			if err == nil || streamEnded {
+				return
+			}
+			for i, s := range r.all {
+				if s.acc.count == 0 {
+					continue
+				}
+				// the completed time slots are flushed anyway, add the open one
+				s.tally(s.prevTimeSlot[:s.keyWidth], s.acc)
+				if i == 0 {
+					fmt.Fprintf(os.Stderr, "# partial result: the last time slot(%s) is incomplete due to error\n", s.prevTimeSlot[:s.keyWidth])
+				}
+			}
+		}()
+	}
+
+	for {
+		// make sure timeout is not reached, nor interrupted
+		if ctx.Err() != nil {
+			cause, marker := ErrTimeout, "# partial result: timeout"
+			if errors.Is(ctx.Err(), context.Canceled) {
+				cause, marker = ErrInterrupted, "# interrupted"
+			}
+			// output what is read so far. with checkpointing, the run resumes from the checkpoint instead
+			if opts.CheckpointPath == "" {
+				if err = r.closeSegment(); err != nil {
+					return
+				}
+				fmt.Fprintln(os.Stderr, marker)
+			}
+			err = fmt.Errorf("%w: %w", cause, ctx.Err())
+			return
+		}
+
+		// read a record from stream
+		buf, rerr := reader.ReadSlice(opts.RecordSeparator)
+		n := len(buf)
+		unterminated := rerr == io.EOF && n > 0
+		if unterminated {
+			// the stream ended cleanly, so the last record is just not terminated.
+			// terminate it, so that it's parsed the same as the others
+			lastRecord = append(append(lastRecord[:0], buf...), opts.RecordSeparator)
+			buf, rerr = lastRecord, nil
+		}
+		if rerr != nil {
+			switch {
+			case rerr == io.EOF && source < len(sources)-1:
+				// on to the next source. the header rows are of the first
+				source++
+				reader.Reset(sources[source].R)
+				r.line = 0
+				continue
+			case rerr == io.EOF:
+			case errors.Is(rerr, io.ErrUnexpectedEOF):
+				// e.g. the connection dropped before the end of the body
+				return fmt.Errorf("truncated stream, ended in the middle of a record: %s", buf)
+			case rerr == bufio.ErrBufferFull:
+				return fmt.Errorf("too long record. invalid data format: %s...", buf[:recordLength])
+			default:
+				return fmt.Errorf("read error: %w", rerr)
+			}
+			break
+		}
+
+		if err = r.record(buf, unterminated); err != nil {
+			return
+		}
+	}
+
+	streamEnded = true
+	return r.finish()
+}
+
+// counts is the numbers of the records of a run by what became of them, and of the time slots output.
+type counts struct {
+	Records int `json:"records"`
+	Skipped int `json:"skipped"`
+	// out of the range
+	Filtered    int `json:"filtered"`
+	Malformed   int `json:"malformed"`
+	Duplicates  int `json:"duplicates"`
+	OutOfBounds int `json:"out_of_bounds"`
+	SampledOut  int `json:"sampled_out"`
+	Slots       int `json:"slots"`
+	Warnings    int `json:"warnings"`
+}
+
+// stats returns the counts as reported by Options.Stats.
+func (c counts) stats() Stats {
+	return Stats{
+		Records:    c.Records,
+		Skipped:    c.Skipped,
+		Filtered:   c.Filtered + c.OutOfBounds + c.SampledOut,
+		Malformed:  c.Malformed,
+		Duplicates: c.Duplicates,
+		Slots:      c.Slots,
+		Warnings:   c.Warnings,
+	}
+}
+
+// run is the state of RunSources, processing the records one by one.
+type run struct {
+	opts Options
+	// the buffered output, and the destination of the output held until the checkpoint
+	writer  *bufio.Writer
+	w       io.Writer
+	pending *bytes.Buffer
+
+	parser recordParser
+	slots  slotWriter
+	// of Options.Rollups, fed the same records as slots
+	rollups []*rollup
+	// the slot writers of every granularity, slots first
+	all    []*slotWriter
+	counts counts
+	totals summary
+	// bytes read so far, and the 1-based line number of the last record within its source
+	position int64
+	line     int
+	// leading lines yet to be skipped
+	headerRows    int
+	commentPrefix []byte
+	resetMarker   []byte
+	segment       int
+	startedAt     time.Time
+}
+
+// init initializes the run afresh, as it may be reused.
+func (r *run) init(writer *bufio.Writer, opts Options) {
+	*r = run{
+		all:           r.all[:0],
+		opts:          opts,
+		writer:        writer,
+		headerRows:    opts.SkipHeaderRows,
+		commentPrefix: []byte(opts.Comment),
+		startedAt:     now(),
+	}
+	r.parser = newRecordParser(&r.opts, &r.counts)
+	r.slots = newSlotWriter(writer, &r.opts, &r.counts)
+	if opts.ResetMarker != "" {
+		r.resetMarker = []byte(opts.ResetMarker)
+	}
+	r.all = append(r.all, &r.slots)
+	for _, ro := range opts.Rollups {
+		u := newRollup(ro, opts)
+		r.rollups = append(r.rollups, u)
+		r.all = append(r.all, &u.slots)
+	}
+}
+
+// closeSegment tallies up the open time slots of every granularity.
+func (r *run) closeSegment() error {
+	for _, s := range r.all {
+		if err := s.closeSegment(); err != nil {
+			return err
+		}
+	}
+	// a later record of them starts a new time slot, so is no duplicate
+	r.parser.forgetStamps()
+	return nil
+}
+
+// startSegment labels every output by the next segment.
+func (r *run) startSegment() {
+	r.segment++
+	for _, s := range r.all {
+		fmt.Fprintf(s.w, "# segment: %d\n", r.segment)
+	}
+}
+
+// writeHeader writes the lines preceding the time slots of the output.
+// The resumed output continues the previous one, which already has them.
+func writeHeader(w *bufio.Writer, opts *Options) error {
+	if opts.Resume {
+		return nil
+	}
+	if opts.EmitSchema {
+		return writeSchema(w, *opts)
+	}
+	if opts.ValueUnit != "" && opts.Format != FormatJSONL {
+		// the schema carries the unit, otherwise annotate it alone. Each JSON line carries it too
+		fmt.Fprintf(w, "# unit: %s\n", opts.ValueUnit)
+	}
+	return nil
+}
+
+// record processes a record read from the stream, including the separator.
+// final tells the record is the unterminated last one.
+func (r *run) record(buf []byte, final bool) (err error) {
+	opts, n := &r.opts, len(buf)
+	r.position += int64(n)
+	r.line++
+
+	// skip leading header rows
+	if r.headerRows > 0 {
+		r.headerRows--
+		r.counts.Skipped++
+		return nil
+	}
+
+	// skip comment lines
+	if len(r.commentPrefix) > 0 && bytes.HasPrefix(buf, r.commentPrefix) {
+		r.counts.Skipped++
+		return nil
+	}
+
+	if r.resetMarker != nil && bytes.Equal(bytes.TrimSpace(buf), r.resetMarker) {
+		// a new segment, aggregated apart from the previous one
+		if err = r.closeSegment(); err != nil {
+			return
+		}
+		r.startSegment()
+		return nil
+	}
+
+	if layout := &r.parser.layout; opts.ValueColumnName != "" && layout.valueColumn < 0 {
+		// the first line is the header
+		layout.valueColumn, err = findColumn(buf[:n-1], opts.ValueColumnName)
+		return
+	}
+
+	r.counts.Records++
+	if opts.Progress && r.counts.Records%progressInterval == 0 {
+		// stderr, apart from the output
+		fmt.Fprintf(os.Stderr, "progress: %d records, time slot %s\n", r.counts.Records, opts.Granularity.label(r.slots.prevTimeSlot[:r.slots.keyWidth], opts.WindowOffset))
+	}
+	rec, ok, err := r.parser.parse(buf, r.line, final)
+	if err != nil || !ok {
+		return
+	}
+	r.totals.records++
+	r.totals.sum += rec.score
+
+	if opts.Passthrough {
+		// the record as is, including the separator
+		fmt.Fprintf(r.writer, "%s %s", opts.Granularity.label(rec.timeSlot, opts.WindowOffset), buf)
+		return nil
+	}
+
+	if err = r.slots.add(rec); err != nil {
+		return
+	}
+	for _, u := range r.rollups {
+		rec.timeSlot = rec.stamp[:u.slots.keyWidth]
+		if err = u.slots.add(rec); err != nil {
+			return fmt.Errorf("%s: %w", u.opts.Granularity.Name, err)
+		}
+	}
+
+	if opts.CheckpointPath != "" && r.counts.Records%checkpointInterval == 0 {
+		// release the output first, so the output is consistent with the checkpoint
+		if err = releasePending(r.writer, r.pending, r.w); err != nil {
+			return
+		}
+		var cp checkpoint
+		if cp, err = r.state(); err != nil {
+			return
+		}
+		return saveCheckpoint(opts.CheckpointPath, cp)
+	}
+	return nil
+}
+
+// finish tallies up the rest at the end of the stream, then writes the trailer and the reports.
+func (r *run) finish() (err error) {
+	opts, s := &r.opts, &r.slots
+	if r.totals.records == 0 && s.acc.count == 0 {
+		if opts.FailOnEmpty {
+			return fmt.Errorf("no records in the range")
+		}
+		// still a success with the empty output, but told apart from a silent failure
+		fmt.Fprintln(os.Stderr, "# no data")
+	}
+
+	// tally up the last time slot
+	if err = r.closeSegment(); err != nil {
+		return
+	}
+
+	for _, s := range r.all {
+		if g := s.opts.Granularity; s.nextFill != nil {
+			// the trailing gap, including the time slot of the end
+			s.fillUntil(g.next(g.key(opts.Ed)))
+		}
+		if s.checksum != nil {
+			fmt.Fprintf(s.w, "# sha256: %x\n", s.checksum.Sum(nil))
+		}
+	}
+
+	if opts.Graph {
+		fmt.Fprintln(os.Stderr, sparkline(s.graphValues, terminalWidth()))
+	}
+
+	if s.countDist != nil {
+		writeCountDistribution(os.Stderr, s.countDist)
+	}
+
+	if opts.ExpectMonotonic != "" {
+		fmt.Fprintf(os.Stderr, "Monotonic violations(%s): %d\n", opts.ExpectMonotonic, s.violations)
+		if s.violations > 0 {
+			r.counts.Warnings++
+		}
+	}
+
+	if r.counts.Filtered > 0 {
+		fmt.Fprintf(os.Stderr, "Out of range records: %d\n", r.counts.Filtered)
+		r.counts.Warnings++
+	}
+
+	if opts.Progress && r.counts.OutOfBounds > 0 {
+		fmt.Fprintf(os.Stderr, "Records out of the value bounds: %d\n", r.counts.OutOfBounds)
+	}
+
+	if opts.Progress && r.counts.SampledOut > 0 {
+		fmt.Fprintf(os.Stderr, "Records skipped by the sample rate: %d\n", r.counts.SampledOut)
+	}
+
+	if r.counts.Duplicates > 0 {
+		fmt.Fprintf(os.Stderr, "Duplicate records: %d\n", r.counts.Duplicates)
+	}
+
+	if r.counts.Malformed > 0 {
+		fmt.Fprintf(os.Stderr, "Malformed records: %d\n", r.counts.Malformed)
+		r.counts.Warnings++
+	}
+
+	if opts.Summary {
+		// stderr, so the output stays parseable
+		r.totals.slots = r.counts.Slots
+		if !opts.Deterministic {
+			r.totals.elapsed = now().Sub(r.startedAt)
+		}
+		r.totals.write(os.Stderr, opts.Format, s.precision)
+	}
+
+	if opts.MaxAge > 0 {
+		if err = checkFreshness(r.parser.newest, opts.MaxAge); err != nil {
+			return
+		}
+	}
+
+	// completed, so the checkpoint is no longer needed
+	if opts.CheckpointPath != "" {
+		if err = releasePending(r.writer, r.pending, r.w); err != nil {
+			return
+		}
+		if err = os.Remove(opts.CheckpointPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove checkpoint: %w", err)
+		}
+	}
+
+	if opts.FailOnWarnings && r.counts.Warnings > 0 {
+		return fmt.Errorf("%d warning(s) reported with --fail-on-warnings", r.counts.Warnings)
+	}
+	return nil
+}
+
+// slotLine formats the time slot into the line of the text output, including the new line.
+// result is the formatted result of the time slot, e.g. the average or the fill value.
+func slotLine(slot Slot, result string, precision int, opts Options) string {
+	line := slot.Time + " " + result
+	if slot.Rolling != nil {
+		line += " " + formatResult(*slot.Rolling, precision, opts)
+	}
+	if opts.WithCount {
+		line += fmt.Sprintf("  (n=%d)", slot.Count)
+	}
+	return opts.LinePrefix + line + opts.LineSuffix + "\n"
+}
+
+// formatResult formats the result of a time slot, NaN as Options.NaNAs if given.
+func formatResult(value float64, precision int, opts Options) string {
+	if math.IsNaN(value) && opts.NaNAs != "" {
+		return formatPlaceholder(opts.NaNAs, opts.NumberFormat)
+	}
+	return formatNumber(value, precision, opts.NumberFormat)
+}
+
+// formatNumber formats the value of the text output in the number format.
+func formatNumber(value float64, precision int, numberFormat string) string {
+	switch numberFormat {
+	case NumberFormatRaw:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case NumberFormatPlain:
+		return strconv.FormatFloat(value, 'f', precision, 64)
+	}
+	return fmt.Sprintf("%8.*f", precision, value)
+}
+
+// formatPlaceholder formats the text in place of a value, e.g. the fill value, aligned the same as the values.
+func formatPlaceholder(text string, numberFormat string) string {
+	if numberFormat != NumberFormatFixed {
+		return text
+	}
+	return fmt.Sprintf("%8s", text)
+}
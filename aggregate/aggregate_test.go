@@ -0,0 +1,1479 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// runAggregate aggregates the input with the options, returning the output and the error.
+func runAggregate(opts Options, input string) (string, error) {
+	return runAggregateStream(opts, strings.NewReader(input))
+}
+
+// runAggregateStream aggregates the stream with the options, returning the output and the error.
+func runAggregateStream(opts Options, stream io.Reader) (string, error) {
+	var out bytes.Buffer
+	err := NewAggregator(&out, opts).Run(context.Background(), stream)
+	return out.String(), err
+}
+
+// mustAggregate is runAggregate failing the test on the error.
+func mustAggregate(t *testing.T, opts Options, input string) string {
+	t.Helper()
+	out, err := runAggregate(opts, input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return out
+}
+
+// captureStderr returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+// fakeClock replaces now with a clock advancing by step on each call, until the test ends.
+func fakeClock(t *testing.T, start time.Time, step time.Duration) {
+	t.Helper()
+	orig := now
+	t.Cleanup(func() { now = orig })
+	now = func() time.Time {
+		start = start.Add(step)
+		return start
+	}
+}
+
+func TestMaxRecordsPerSlot(t *testing.T) {
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T03:20:00Z 003.0000\n2021-03-04T04:00:00Z 004.0000\n"
+	opts := DefaultOptions()
+	opts.MaxRecordsPerSlot = 3
+	if got := mustAggregate(t, opts, input); got != "2021-03-04T03:00:00Z   2.0000\n2021-03-04T04:00:00Z   4.0000\n" {
+		t.Errorf("got %q within the limit", got)
+	}
+
+	opts.MaxRecordsPerSlot = 2
+	_, err := runAggregate(opts, input)
+	if err == nil || !strings.Contains(err.Error(), "too many records in time slot 2021-03-04T03 (max 2)") {
+		t.Errorf("got %v, want the guard", err)
+	}
+}
+
+func TestRecordSeparator(t *testing.T) {
+	tests := []struct {
+		name  string
+		sep   byte
+		input string
+	}{
+		{name: "semicolon", sep: ';', input: "2021-03-04T03:00:00Z 001.0000;2021-03-04T03:10:00Z 002.0000;2021-03-04T04:00:00Z 004.0000;"},
+		{name: "null", sep: 0, input: "2021-03-04T03:00:00Z 001.0000\x002021-03-04T03:10:00Z 002.0000\x002021-03-04T04:00:00Z 004.0000\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.RecordSeparator = tt.sep
+			if got := mustAggregate(t, opts, tt.input); got != "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestExpectMonotonic(t *testing.T) {
+	tests := []struct {
+		name  string
+		order string
+		input string
+		want  string
+	}{
+		{name: "increasing", order: MonotonicIncreasing, input: "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T03:20:00Z 002.0000\n", want: "Monotonic violations(increasing): 0\n"},
+		{name: "counter reset", order: MonotonicIncreasing, input: "2021-03-04T03:00:00Z 005.0000\n2021-03-04T03:10:00Z 001.0000\n2021-03-04T03:20:00Z 002.0000\n2021-03-04T03:30:00Z 000.0000\n", want: "Monotonic violations(increasing): 2\n"},
+		{name: "decreasing", order: MonotonicDecreasing, input: "2021-03-04T03:00:00Z 003.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T03:20:00Z 001.0000\n", want: "Monotonic violations(decreasing): 0\n"},
+		{name: "not decreasing", order: MonotonicDecreasing, input: "2021-03-04T03:00:00Z 003.0000\n2021-03-04T03:10:00Z 004.0000\n", want: "Monotonic violations(decreasing): 1\n"},
+		// each time slot starts afresh
+		{name: "across slots", order: MonotonicIncreasing, input: "2021-03-04T03:00:00Z 005.0000\n2021-03-04T04:00:00Z 001.0000\n2021-03-04T04:10:00Z 002.0000\n", want: "Monotonic violations(increasing): 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ExpectMonotonic = tt.order
+			if got := captureStderr(t, func() { mustAggregate(t, opts, tt.input) }); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrailingChecksum(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TrailingChecksum = true
+	got := mustAggregate(t, opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n")
+
+	data, trailer, ok := strings.Cut(got, "# sha256: ")
+	if !ok {
+		t.Fatalf("got %q, want the checksum line", got)
+	}
+	if want := fmt.Sprintf("%x\n", sha256.Sum256([]byte(data))); trailer != want {
+		t.Errorf("got checksum %q, want %q of %q", trailer, want, data)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	fakeClock(t, time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC), 0)
+	opts := DefaultOptions()
+	opts.MaxAge = time.Hour
+
+	if _, err := runAggregate(opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T04:30:00Z 002.0000\n"); err != nil {
+		t.Errorf("got %v of the fresh data", err)
+	}
+	_, err := runAggregate(opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:50:00Z 002.0000\n")
+	if err == nil || !strings.Contains(err.Error(), "stale data: the newest record(2021-03-04T03:50:00Z) is 1h10m0s old") {
+		t.Errorf("got %v, want the stale data", err)
+	}
+	if _, err = runAggregate(opts, ""); err == nil || !strings.Contains(err.Error(), "no record found") {
+		t.Errorf("got %v, want the stale data of no record", err)
+	}
+}
+
+func TestComment(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		input  string
+	}{
+		{name: "hash", prefix: "#", input: "# header\n2021-03-04T03:00:00Z 001.0000\n# 2021-03-04T03:05:00Z 100.0000\n2021-03-04T03:10:00Z 002.0000\n#\n2021-03-04T04:00:00Z 004.0000\n"},
+		{name: "double slash", prefix: "//", input: "2021-03-04T03:00:00Z 001.0000\n// note\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n// trailer\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Comment, opts.Strict = tt.prefix, true
+			if got := mustAggregate(t, opts, tt.input); got != "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+
+	// without the prefix, the comment is a malformed record
+	opts := DefaultOptions()
+	opts.Strict = true
+	if _, err := runAggregate(opts, "# header\n2021-03-04T03:00:00Z 001.0000\n"); err == nil {
+		t.Error("want the error of the comment line")
+	}
+}
+
+func TestValueColumnName(t *testing.T) {
+	input := "time humidity temp\n2021-03-04T03:00:00Z 40 1\n2021-03-04T03:10:00Z 50 2\n2021-03-04T04:00:00Z 60 4\n"
+	opts := DefaultOptions()
+	opts.ValueColumnName = "temp"
+	if got := mustAggregate(t, opts, input); got != "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n" {
+		t.Errorf("got %q", got)
+	}
+	opts.ValueColumnName = "humidity"
+	if got := mustAggregate(t, opts, input); got != "2021-03-04T03:00:00Z  45.0000\n2021-03-04T04:00:00Z  60.0000\n" {
+		t.Errorf("got %q", got)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "absent", input: input, want: `value column "pressure" not found in the header: time humidity temp`},
+		{name: "timestamp", input: "pressure temp\n", want: `value column "pressure" is the timestamp column`},
+		{name: "missing field", input: "time pressure\n2021-03-04T03:00:00Z\n", want: "missing pressure column"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts.ValueColumnName = "pressure"
+			if _, err := runAggregate(opts, tt.input); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialOutputOnError(t *testing.T) {
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n2021-03-04T04:10:00Z 006.0000\n"
+	tests := []struct {
+		partial bool
+		want    string
+		stderr  string
+	}{
+		{partial: false, want: "2021-03-04T03:00:00Z   1.5000\n"},
+		{partial: true, want: "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   5.0000\n", stderr: "# partial result: the last time slot(2021-03-04T04) is incomplete due to error\n"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.PartialOutputOnError = tt.partial
+		var (
+			out bytes.Buffer
+			err error
+		)
+		// the connection resets after the data
+		stream := io.MultiReader(strings.NewReader(input), iotest.ErrReader(errors.New("connection reset by peer")))
+		stderr := captureStderr(t, func() { err = NewAggregator(&out, opts).Run(context.Background(), stream) })
+		if err == nil || !strings.Contains(err.Error(), "connection reset by peer") {
+			t.Errorf("partial %v: got %v, want the read error", tt.partial, err)
+		}
+		if out.String() != tt.want || stderr != tt.stderr {
+			t.Errorf("partial %v: got %q, %q, want %q, %q", tt.partial, out.String(), stderr, tt.want, tt.stderr)
+		}
+	}
+}
+
+// many small ranges in a row, e.g. server mode
+func BenchmarkRunSmallRanges(b *testing.B) {
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n"
+	opts := DefaultOptions()
+	b.ReportAllocs()
+	for range b.N {
+		if err := NewAggregator(io.Discard, opts).Run(context.Background(), strings.NewReader(input)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the read and write buffers of 4KB each are reused across the runs
+func TestRunReusesBuffers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("benchmark")
+	}
+	if got := testing.Benchmark(BenchmarkRunSmallRanges).AllocedBytesPerOp(); got >= 4096 {
+		t.Errorf("got %d bytes allocated per run, want the buffers pooled", got)
+	}
+}
+
+func TestHighPrecision(t *testing.T) {
+	// the ones are absorbed by 1e16 in float64, so the float64 mean is 0
+	input := "2021-03-04T03:00:00Z 10000000000000000\n2021-03-04T03:10:00Z 1\n2021-03-04T03:20:00Z 1\n2021-03-04T03:30:00Z -10000000000000000\n"
+	tests := []struct {
+		name string
+		opts func(*Options)
+		want string
+	}{
+		{name: "float64", want: "2021-03-04T03:00:00Z   0.0000\n"},
+		{name: "high precision", opts: func(o *Options) { o.HighPrecision = true }, want: "2021-03-04T03:00:00Z   0.5000\n"},
+		{name: "high precision plain", opts: func(o *Options) { o.HighPrecision, o.NumberFormat = true, NumberFormatPlain }, want: "2021-03-04T03:00:00Z 0.5000\n"},
+		{name: "high precision raw", opts: func(o *Options) { o.HighPrecision, o.NumberFormat = true, NumberFormatRaw }, want: "2021-03-04T03:00:00Z 0.5\n"},
+		{name: "high precision jsonl", opts: func(o *Options) { o.HighPrecision, o.Format = true, FormatJSONL }, want: `{"time":"2021-03-04T03:00:00Z","avg":0.5000,"count":4}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipHeaderRows(t *testing.T) {
+	records := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n"
+	tests := []struct {
+		name   string
+		rows   int
+		header string
+	}{
+		{name: "none", rows: 0},
+		{name: "one", rows: 1, header: "time value\n"},
+		{name: "multiple", rows: 3, header: "# exported by sensor-1\n# 2021-03-04\ntime value\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SkipHeaderRows = tt.rows
+			if got := mustAggregate(t, opts, tt.header+records); got != "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+
+	// skipped by the count, without looking at them
+	opts := DefaultOptions()
+	opts.SkipHeaderRows = 1
+	if got := mustAggregate(t, opts, records); got != "2021-03-04T03:00:00Z   2.0000\n2021-03-04T04:00:00Z   4.0000\n" {
+		t.Errorf("got %q, want the first record skipped as the header", got)
+	}
+}
+
+func TestPreBucket(t *testing.T) {
+	// a burst of 3 records in the first minute, then 1 record each of 2 minutes
+	input := "2021-03-04T03:00:00Z 010.0000\n2021-03-04T03:00:20Z 010.0000\n2021-03-04T03:00:40Z 010.0000\n2021-03-04T03:30:00Z 040.0000\n" +
+		"2021-03-04T04:00:00Z 001.0000\n2021-03-04T04:00:30Z 003.0000\n2021-03-04T04:01:00Z 008.0000\n"
+	tests := []struct {
+		name      string
+		preBucket Granularity
+		want      string
+	}{
+		{name: "single stage", want: "2021-03-04T03:00:00Z  17.5000\n2021-03-04T04:00:00Z   4.0000\n"},
+		// the mean of the minutely means, (10+40)/2 and (2+8)/2
+		{name: "two stage", preBucket: GranularityMinute, want: "2021-03-04T03:00:00Z  25.0000\n2021-03-04T04:00:00Z   5.0000\n"},
+		// every record in a second of its own, so the same as single stage
+		{name: "two stage by second", preBucket: GranularitySecond, want: "2021-03-04T03:00:00Z  17.5000\n2021-03-04T04:00:00Z   4.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.PreBucket = tt.preBucket
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstSlot(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "no record", input: "", want: ""},
+		{name: "single record", input: "2021-03-04T03:45:00Z 007.0000\n", want: "2021-03-04T03:00:00Z   7.0000\n"},
+		{name: "first of the next slot", input: "2021-03-04T03:59:59Z 001.0000\n2021-03-04T04:00:00Z 002.0000\n", want: "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   2.0000\n"},
+		{name: "zero value", input: "2021-03-04T03:00:00Z 000.0000\n2021-03-04T03:10:00Z 000.0000\n2021-03-04T04:00:00Z 003.0000\n", want: "2021-03-04T03:00:00Z   0.0000\n2021-03-04T04:00:00Z   3.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustAggregate(t, DefaultOptions(), tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailOnEmpty(t *testing.T) {
+	for _, input := range []string{"", "# header only\n"} {
+		opts := DefaultOptions()
+		opts.Comment = "#"
+		if got, err := runAggregate(opts, input); got != "" || err != nil {
+			t.Errorf("got %q, %v, want the empty output", got, err)
+		}
+
+		opts.FailOnEmpty = true
+		if _, err := runAggregate(opts, input); err == nil || err.Error() != "no records in the range" {
+			t.Errorf("got %v, want the error", err)
+		}
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:59:59Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n"
+	tests := []struct {
+		name        string
+		granularity Granularity
+		want        string
+	}{
+		{
+			name: "hour", granularity: GranularityHour,
+			want: "2021-03-04T03:00:00Z 2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:00:00Z 2021-03-04T03:59:59Z 002.0000\n2021-03-04T04:00:00Z 2021-03-04T04:00:00Z 004.0000\n",
+		},
+		{
+			name: "minute", granularity: GranularityMinute,
+			want: "2021-03-04T03:00:00Z 2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:59:00Z 2021-03-04T03:59:59Z 002.0000\n2021-03-04T04:00:00Z 2021-03-04T04:00:00Z 004.0000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Passthrough, opts.Granularity = true, tt.granularity
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNaNOutput(t *testing.T) {
+	// a NaN value makes the average NaN
+	input := "2021-03-04T03:00:00Z      NaN\n2021-03-04T03:10:00Z 001.0000\n2021-03-04T04:00:00Z 002.0000\n"
+	tests := []struct {
+		name string
+		opts func(*Options)
+		want string
+	}{
+		{name: "as is", want: "2021-03-04T03:00:00Z      NaN\n2021-03-04T04:00:00Z   2.0000\n"},
+		{name: "drop", opts: func(o *Options) { o.DropNaN = true }, want: "2021-03-04T04:00:00Z   2.0000\n"},
+		{name: "as null", opts: func(o *Options) { o.NaNAs = "null" }, want: "2021-03-04T03:00:00Z     null\n2021-03-04T04:00:00Z   2.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightColumn(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		// (1*1 + 4*3) / 4 and (2*0.5 + 6*1.5) / 2
+		{name: "weighted", input: "2021-03-04T03:00:00Z 1 1\n2021-03-04T03:10:00Z 4 3\n2021-03-04T04:00:00Z 2 0.5\n2021-03-04T04:10:00Z 6 1.5\n", want: "2021-03-04T03:00:00Z   3.2500\n2021-03-04T04:00:00Z   5.0000\n"},
+		{name: "unit weights", input: "2021-03-04T03:00:00Z 1 1\n2021-03-04T03:10:00Z 4 1\n", want: "2021-03-04T03:00:00Z   2.5000\n"},
+		{name: "zero weight", input: "2021-03-04T03:00:00Z 1 0\n2021-03-04T03:10:00Z 4 2\n", want: "2021-03-04T03:00:00Z   4.0000\n"},
+		{name: "all zero weights", input: "2021-03-04T03:00:00Z 1 0\n2021-03-04T03:10:00Z 4 0\n", want: "2021-03-04T03:00:00Z      NaN\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.WeightColumn = 2
+			if got := mustAggregate(t, opts, tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for input, want := range map[string]string{
+		"2021-03-04T03:00:00Z 1\n":    "missing weight column",
+		"2021-03-04T03:00:00Z 1 -1\n": "invalid weight: -1, must be a non-negative number",
+		"2021-03-04T03:00:00Z 1 x\n":  "invalid weight: x",
+	} {
+		opts := DefaultOptions()
+		opts.WeightColumn = 2
+		if _, err := runAggregate(opts, input); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", input, err, want)
+		}
+	}
+}
+
+func TestLineAffixes(t *testing.T) {
+	var slots []Slot
+	opts := DefaultOptions()
+	opts.LinePrefix, opts.LineSuffix = "temp,", " # sensor-1"
+	opts.OnSlot = func(s Slot) { slots = append(slots, s) }
+	got := mustAggregate(t, opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n")
+	if want := "temp,2021-03-04T03:00:00Z   1.5000 # sensor-1\ntemp,2021-03-04T04:00:00Z   4.0000 # sensor-1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// not applied to the slot events
+	if len(slots) != 2 || slots[0].Time != "2021-03-04T03:00:00Z" {
+		t.Errorf("got %+v", slots)
+	}
+}
+
+func TestThousandsSep(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ThousandsSep = ','
+	got := mustAggregate(t, opts, "2021-03-04T03:00:00Z 1,234.56\n2021-03-04T03:10:00Z 1,000.00\n2021-03-04T04:00:00Z -2,000.5\n2021-03-04T04:10:00Z   0.5000\n")
+	if want := "2021-03-04T03:00:00Z 1117.2800\n2021-03-04T04:00:00Z -1000.0000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	opts.ThousandsSep = 0
+	if _, err := runAggregate(opts, "2021-03-04T03:00:00Z 1,234.56\n"); err == nil {
+		t.Error("want the parse error without the separator")
+	}
+}
+
+func TestEnforceRange(t *testing.T) {
+	const input = "2021-03-04T02:59:50Z   1.0000\n2021-03-04T02:59:58Z   2.0000\n2021-03-04T03:00:00Z   3.0000\n2021-03-04T03:59:59Z   5.0000\n2021-03-04T04:00:02Z   8.0000\n2021-03-04T04:00:10Z  13.0000\n"
+	tests := []struct {
+		skew     time.Duration
+		want     string
+		filtered int
+	}{
+		{0, "2021-03-04T03:00:00Z   4.0000\n", 4},
+		// the records just outside the range, within the tolerance
+		{5 * time.Second, "2021-03-04T02:00:00Z   2.0000\n2021-03-04T03:00:00Z   4.0000\n2021-03-04T04:00:00Z   8.0000\n", 2},
+		{time.Minute, "2021-03-04T02:00:00Z   1.5000\n2021-03-04T03:00:00Z   4.0000\n2021-03-04T04:00:00Z  10.5000\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.skew.String(), func(t *testing.T) {
+			var stats Stats
+			opts := DefaultOptions()
+			opts.St = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+			opts.Ed = time.Date(2021, 3, 4, 3, 59, 59, 0, time.UTC)
+			opts.EnforceRange, opts.ClockSkew = true, tt.skew
+			opts.Stats = &stats
+			var got string
+			captureStderr(t, func() { got = mustAggregate(t, opts, input) })
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if stats.Filtered != tt.filtered {
+				t.Errorf("got %d filtered, want %d", stats.Filtered, tt.filtered)
+			}
+		})
+	}
+}
+
+func TestResetMarker(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ResetMarker = "---"
+	got := mustAggregate(t, opts, "2021-03-04T03:00:00Z   1.0000\n2021-03-04T03:10:00Z   2.0000\n---\n2021-03-04T03:20:00Z  10.0000\n2021-03-04T04:00:00Z  20.0000\n  ---  \n---\n2021-03-04T03:00:00Z   5.0000\n")
+	// the time slot split by the marker is output per segment, and a segment may restart from an earlier time slot
+	want := "# segment: 1\n2021-03-04T03:00:00Z   1.5000\n" +
+		"# segment: 2\n2021-03-04T03:00:00Z  10.0000\n2021-03-04T04:00:00Z  20.0000\n" +
+		"# segment: 3\n" +
+		"# segment: 4\n2021-03-04T03:00:00Z   5.0000\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEmitRate(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z   1.0000\n2021-03-04T03:00:30Z   1.0000\n2021-03-04T03:00:59Z   1.0000\n2021-03-04T03:01:00Z 100.0000\n2021-03-04T04:00:00Z   1.0000\n"
+	tests := []struct {
+		granularity Granularity
+		first       float64
+		want        string
+	}{
+		// 4 records over 3600 seconds, regardless of the values
+		{GranularityHour, 4.0 / 3600, "2021-03-04T03:00:00Z   0.0011\n2021-03-04T04:00:00Z   0.0003\n"},
+		{GranularityMinute, 3.0 / 60, "2021-03-04T03:00:00Z   0.0500\n2021-03-04T03:01:00Z   0.0167\n2021-03-04T04:00:00Z   0.0167\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granularity.Name, func(t *testing.T) {
+			var slots []Slot
+			opts := DefaultOptions()
+			opts.Granularity = tt.granularity
+			opts.EmitRate = true
+			opts.OnSlot = func(s Slot) { slots = append(slots, s) }
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if slots[0].Avg != tt.first {
+				t.Errorf("got %v, want %v", slots[0].Avg, tt.first)
+			}
+		})
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z   1.0000\n2021-03-04T03:10:00Z   2.0000"
+
+	// a clean EOF, the last record just not terminated
+	if got := mustAggregate(t, DefaultOptions(), input); got != "2021-03-04T03:00:00Z   1.5000\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// the connection dropped in the middle of the record
+	stream := io.MultiReader(strings.NewReader(input), iotest.ErrReader(io.ErrUnexpectedEOF))
+	out, err := runAggregateStream(DefaultOptions(), stream)
+	if err == nil || !strings.Contains(err.Error(), "truncated stream, ended in the middle of a record: 2021-03-04T03:10:00Z   2.0000") {
+		t.Errorf("got %v, want the truncation", err)
+	}
+	if out != "" {
+		t.Errorf("got %q, want the open time slot dropped", out)
+	}
+}
+
+func TestOutputUTC(t *testing.T) {
+	// the same hour in UTC, of the mixed offsets
+	const input = "2021-03-04T12:00:00+09:00   1.0000\n2021-03-04T03:30:00Z   3.0000\n2021-03-03T22:45:00-05:00   5.0000\n2021-03-04T04:10:00+00:00   7.0000\n"
+	tests := []struct {
+		name        string
+		passthrough bool
+		want        string
+	}{
+		{
+			name: "aggregate",
+			want: "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   7.0000\n",
+		},
+		{
+			name: "passthrough", passthrough: true,
+			want: "2021-03-04T03:00:00Z 2021-03-04T12:00:00+09:00   1.0000\n2021-03-04T03:00:00Z 2021-03-04T03:30:00Z   3.0000\n" +
+				"2021-03-04T03:00:00Z 2021-03-03T22:45:00-05:00   5.0000\n2021-03-04T04:00:00Z 2021-03-04T04:10:00+00:00   7.0000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.OutputUTC = true
+			opts.Passthrough = tt.passthrough
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowOffset(t *testing.T) {
+	const input = "2021-03-04T02:59:00Z   1.0000\n2021-03-04T03:29:59Z   3.0000\n2021-03-04T03:30:00Z  10.0000\n2021-03-04T04:29:59Z  20.0000\n2021-03-04T04:30:00Z   7.0000\n"
+	tests := []struct {
+		name string
+		opts func(*Options)
+		want string
+	}{
+		{
+			name: "hour",
+			want: "2021-03-04T02:30:00Z   2.0000\n2021-03-04T03:30:00Z  15.0000\n2021-03-04T04:30:00Z   7.0000\n",
+		},
+		{
+			name: "day", opts: func(o *Options) { o.Granularity = GranularityDay },
+			want: "2021-03-04T00:30:00Z   8.2000\n",
+		},
+		{
+			// 03:29:59 and 04:29:59 round into the next windows
+			name: "round to", opts: func(o *Options) { o.RoundTo = time.Minute },
+			want: "2021-03-04T02:30:00Z   1.0000\n2021-03-04T03:30:00Z   6.5000\n2021-03-04T04:30:00Z  13.5000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.WindowOffset = 30 * time.Minute
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// chunkedReader reads the data in the chunks of the sizes, cycling through them.
+type chunkedReader struct {
+	data  []byte
+	sizes []int
+	n     int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	size := min(r.sizes[r.n%len(r.sizes)], len(p), len(r.data))
+	r.n++
+	copy(p, r.data[:size])
+	r.data = r.data[size:]
+	return size, nil
+}
+
+// a Read may return fewer bytes than asked, e.g. over the HTTP body, so a record spans several reads
+func TestRunFragmentedReads(t *testing.T) {
+	input := "2021-03-04T00:00:00Z 113.1652\n2021-03-04T00:10:00Z 107.4177\n2021-03-04T01:00:00Z  -3.5000\n" +
+		"2021-03-04T01:30:00Z   0.2500\n2021-03-04T02:00:00Z 1234.567\n2021-03-04T02:50:00Z   1.0000\n"
+	want := "2021-03-04T00:00:00Z 110.2914\n2021-03-04T01:00:00Z  -1.6250\n2021-03-04T02:00:00Z 617.7835\n"
+
+	stream := &chunkedReader{data: []byte(input), sizes: []int{1, 2, 3, 4, 5, 6, 7}}
+	got, err := runAggregateStream(DefaultOptions(), stream)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVariableWidthValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "narrow",
+			input: "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z -3.2\n",
+			want:  "2021-03-04T03:00:00Z  -1.1000\n",
+		},
+		{
+			name:  "high magnitude",
+			input: "2021-03-04T03:45:14Z 123456789.123\n",
+			want:  "2021-03-04T03:00:00Z 123456789.1230\n",
+		},
+		{
+			name:  "padded",
+			input: "2021-03-04T03:00:00Z   113.1652\n2021-03-04T03:10:00Z\t12.5\n",
+			want:  "2021-03-04T03:00:00Z  62.8326\n",
+		},
+		{
+			name:  "trailing spaces",
+			input: "2021-03-04T03:00:00Z 1.5   \n2021-03-04T03:10:00Z -2.5\t\n",
+			want:  "2021-03-04T03:00:00Z  -0.5000\n",
+		},
+		{
+			name:  "integers",
+			input: "2021-03-04T03:00:00Z 7\n2021-03-04T03:10:00Z -12\n2021-03-04T03:20:00Z 100000\n",
+			want:  "2021-03-04T03:00:00Z 33331.6667\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustAggregate(t, DefaultOptions(), tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnordered(t *testing.T) {
+	const input = "2021-03-04T04:10:00Z 4\n2021-03-04T03:00:00Z 1\n2021-03-04T05:00:00Z 5\n2021-03-04T03:20:00Z 2\n2021-03-04T04:00:00Z 6\n"
+
+	// an earlier time slot after a later one is an error, as it's been output already
+	if _, err := runAggregate(DefaultOptions(), input); err == nil || !strings.HasSuffix(err.Error(), "non-monotonic input: time slot 2021-03-04T03 after 2021-03-04T04. use --unordered for unsorted input") {
+		t.Errorf("got %v, want the non-monotonic input", err)
+	}
+
+	// buffered by the time slots, then output in order
+	var stats Stats
+	opts := DefaultOptions()
+	opts.Unordered, opts.Stats = true, &stats
+	got := mustAggregate(t, opts, input)
+	if want := "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   5.0000\n2021-03-04T05:00:00Z   5.0000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if stats.Slots != 3 || stats.Records != 5 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestFailOnWarnings(t *testing.T) {
+	const want = "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n"
+	tests := []struct {
+		name  string
+		opts  func(*Options)
+		input string
+		err   string
+	}{
+		{
+			name:  "none",
+			input: "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T04:00:00Z 4\n",
+		},
+		{
+			name: "out of range",
+			opts: func(o *Options) {
+				o.St, o.Ed = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 4, 59, 59, 0, time.UTC)
+				o.EnforceRange = true
+			},
+			input: "2021-03-04T02:00:00Z 9\n2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T04:00:00Z 4\n",
+			err:   "1 warning(s) reported with --fail-on-warnings",
+		},
+		{
+			name: "out of range and monotonic violation",
+			opts: func(o *Options) {
+				o.St, o.Ed = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 4, 59, 59, 0, time.UTC)
+				o.EnforceRange, o.ExpectMonotonic = true, MonotonicDecreasing
+			},
+			input: "2021-03-04T02:00:00Z 9\n2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T04:00:00Z 4\n",
+			err:   "2 warning(s) reported with --fail-on-warnings",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.FailOnWarnings = true
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			var (
+				got string
+				err error
+			)
+			captureStderr(t, func() { got, err = runAggregate(opts, tt.input) })
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+			// still output all, as the warnings are counted up at the end
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFill(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		value string
+		want  string
+	}{
+		{
+			name:  "leading",
+			input: "2021-03-04T02:00:00Z 2\n2021-03-04T03:00:00Z 3\n",
+			want:  "2021-03-04T00:00:00Z      NaN\n2021-03-04T01:00:00Z      NaN\n2021-03-04T02:00:00Z   2.0000\n2021-03-04T03:00:00Z   3.0000\n",
+		},
+		{
+			name:  "trailing",
+			input: "2021-03-04T00:00:00Z 0\n2021-03-04T01:00:00Z 1\n",
+			want:  "2021-03-04T00:00:00Z   0.0000\n2021-03-04T01:00:00Z   1.0000\n2021-03-04T02:00:00Z      NaN\n2021-03-04T03:00:00Z      NaN\n",
+		},
+		{
+			name:  "interior",
+			input: "2021-03-04T00:00:00Z 0\n2021-03-04T03:00:00Z 3\n",
+			value: "null",
+			want:  "2021-03-04T00:00:00Z   0.0000\n2021-03-04T01:00:00Z     null\n2021-03-04T02:00:00Z     null\n2021-03-04T03:00:00Z   3.0000\n",
+		},
+		{
+			name: "empty",
+			want: "2021-03-04T00:00:00Z      NaN\n2021-03-04T01:00:00Z      NaN\n2021-03-04T02:00:00Z      NaN\n2021-03-04T03:00:00Z      NaN\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.St = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+			opts.Ed = time.Date(2021, 3, 4, 3, 59, 59, 0, time.UTC)
+			opts.Fill = true
+			if tt.value != "" {
+				opts.FillValue = tt.value
+			}
+			if got := mustAggregate(t, opts, tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// the output is the same however the stream is chunked, including the unterminated last record
+func TestRunChunkingMatrix(t *testing.T) {
+	input := []byte("2021-03-04T00:00:00Z 113.1652\n2021-03-04T00:10:00Z\t-7\n# comment\n" +
+		"2021-03-04T01:00:00Z   0.25\n2021-03-04T01:59:59Z 12345.6789\n2021-03-04T02:00:00Z 3")
+	opts := DefaultOptions()
+	opts.Comment = "#"
+	want := mustAggregate(t, opts, string(input))
+
+	run := func(sizes []int) string {
+		got, err := runAggregateStream(opts, &chunkedReader{data: input, sizes: sizes})
+		if err != nil {
+			t.Fatalf("chunks of %v: unexpected error: %v", sizes, err)
+		}
+		return got
+	}
+	for size := 1; size <= 69; size++ {
+		if got := run([]int{size}); got != want {
+			t.Errorf("chunks of %d: got %q, want %q", size, got, want)
+		}
+	}
+	// split once at every position
+	for i := 1; i < len(input); i++ {
+		if got := run([]int{i, len(input)}); got != want {
+			t.Errorf("split at %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+// stallingReader blocks until the context is done, then reads r, e.g. a stream stalled past the deadline.
+type stallingReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (s stallingReader) Read(p []byte) (int, error) {
+	<-s.ctx.Done()
+	return s.r.Read(p)
+}
+
+func TestRunTimeoutPartial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stream := io.MultiReader(
+		strings.NewReader("2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n2021-03-04T04:00:00Z 4\n"),
+		// the first record read along with the stall, before the deadline is noticed
+		stallingReader{ctx, strings.NewReader("2021-03-04T04:30:00Z 6\n2021-03-04T05:00:00Z 9\n")},
+	)
+
+	var (
+		out bytes.Buffer
+		err error
+	)
+	stderr := captureStderr(t, func() { err = NewAggregator(&out, DefaultOptions()).Run(ctx, stream) })
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the timeout", err)
+	}
+	// the hours computed so far, including the open one
+	if want := "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   5.0000\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if stderr != "# partial result: timeout\n" {
+		t.Errorf("got %q, want the partial result marked", stderr)
+	}
+}
+
+func TestWithCount(t *testing.T) {
+	var input strings.Builder
+	begin := time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+	// 60, 1 and 17 records of the hours
+	for i, n := range []int{60, 1, 17} {
+		for j := range n {
+			fmt.Fprintf(&input, "%s %d\n", begin.Add(time.Duration(i)*time.Hour+time.Duration(j)*time.Minute).Format(time.RFC3339), j)
+		}
+	}
+	tests := []struct {
+		name string
+		opts func(*Options)
+		want string
+	}{
+		{
+			name: "avg",
+			want: "2021-03-04T03:00:00Z  29.5000  (n=60)\n2021-03-04T04:00:00Z   0.0000  (n=1)\n2021-03-04T05:00:00Z   8.0000  (n=17)\n",
+		},
+		{
+			name: "max", opts: func(o *Options) { o.Agg = AggMax },
+			want: "2021-03-04T03:00:00Z  59.0000  (n=60)\n2021-03-04T04:00:00Z   0.0000  (n=1)\n2021-03-04T05:00:00Z  16.0000  (n=17)\n",
+		},
+		{
+			// already a field
+			name: "jsonl", opts: func(o *Options) { o.Format = FormatJSONL },
+			want: `{"time":"2021-03-04T03:00:00Z","avg":29.5000,"count":60}` + "\n" + `{"time":"2021-03-04T04:00:00Z","avg":0.0000,"count":1}` + "\n" + `{"time":"2021-03-04T05:00:00Z","avg":8.0000,"count":17}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.WithCount = true
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := mustAggregate(t, opts, input.String()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrict(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z 1\n2021-03-04T03:1\n2021-03-04T03:20:00Z2\n2021-13-04T03:30:00Z 3\n2021-03-04T03:40:00Z 5\n"
+
+	// skipped and counted
+	var stats Stats
+	opts := DefaultOptions()
+	opts.Stats = &stats
+	var got string
+	stderr := captureStderr(t, func() { got = mustAggregate(t, opts, input) })
+	if got != "2021-03-04T03:00:00Z   3.0000\n" || stats.Malformed != 3 || stderr != "Malformed records: 3\n" {
+		t.Errorf("got %q, %d malformed, %q", got, stats.Malformed, stderr)
+	}
+
+	// the first one aborts, with the line
+	opts.Strict = true
+	if _, err := runAggregate(opts, input); err == nil || !strings.Contains(err.Error(), "line 2: too short record(15 bytes). invalid data format: 2021-03-04T03:1") {
+		t.Errorf("got %v, want the error of line 2", err)
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z 1.123456789\n2021-03-04T03:10:00Z 2.5\n2021-03-04T04:00:00Z 1234567.5\n"
+	tests := []struct {
+		precision    int
+		format       string
+		numberFormat string
+		want         string
+	}{
+		{precision: 0, format: FormatText, want: "2021-03-04T03:00:00Z        2\n2021-03-04T04:00:00Z  1234568\n"},
+		{precision: 8, format: FormatText, want: "2021-03-04T03:00:00Z 1.81172839\n2021-03-04T04:00:00Z 1234567.50000000\n"},
+		// unpadded, as few columns as the precision needs
+		{precision: 0, format: FormatText, numberFormat: NumberFormatPlain, want: "2021-03-04T03:00:00Z 2\n2021-03-04T04:00:00Z 1234568\n"},
+		{precision: 8, format: FormatText, numberFormat: NumberFormatPlain, want: "2021-03-04T03:00:00Z 1.81172839\n2021-03-04T04:00:00Z 1234567.50000000\n"},
+		{precision: 0, format: FormatJSONL, want: `{"time":"2021-03-04T03:00:00Z","avg":2,"count":2}` + "\n" + `{"time":"2021-03-04T04:00:00Z","avg":1234568,"count":1}` + "\n"},
+		{precision: 8, format: FormatJSONL, want: `{"time":"2021-03-04T03:00:00Z","avg":1.81172839,"count":2}` + "\n" + `{"time":"2021-03-04T04:00:00Z","avg":1234567.50000000,"count":1}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s %d", tt.format, tt.numberFormat, tt.precision), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Precision, opts.Format = tt.precision, tt.format
+			if tt.numberFormat != "" {
+				opts.NumberFormat = tt.numberFormat
+			}
+			got := mustAggregate(t, opts, input)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// the printed values parse back to the averages rounded to the precision
+			scale := math.Pow(10, float64(tt.precision))
+			for i, want := range []float64{(1.123456789 + 2.5) / 2, 1234567.5} {
+				var value float64
+				if tt.format == FormatJSONL {
+					var slot Slot
+					if err := json.Unmarshal([]byte(strings.Split(got, "\n")[i]), &slot); err != nil {
+						t.Fatal(err)
+					}
+					value = slot.Avg
+				} else if _, err := fmt.Sscanf(strings.Split(got, "\n")[i][21:], "%g", &value); err != nil {
+					t.Fatal(err)
+				}
+				if value != math.Round(want*scale)/scale {
+					t.Errorf("got %v, want %v rounded to %d decimals", value, want, tt.precision)
+				}
+			}
+		})
+	}
+}
+
+func TestMixedOffsets(t *testing.T) {
+	// +09:00 records interleaved with Z ones, of which the local hours differ from the UTC ones
+	const input = "2021-03-04T03:00:00Z 1\n2021-03-04T12:20:00+09:00 3\n2021-03-04T03:40:00Z 5\n" +
+		"2021-03-04T13:00:00+09:00 2\n2021-03-04T04:30:00Z 4\n2021-03-04T14:05:00+09:00 9\n"
+	tests := []struct {
+		name string
+		opts func(*Options)
+		want string
+	}{
+		{name: "hour", want: "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   3.0000\n2021-03-04T05:00:00Z   9.0000\n"},
+		{name: "count", opts: func(o *Options) { o.Agg = AggCount }, want: "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   2.0000\n2021-03-04T05:00:00Z   1.0000\n"},
+		{name: "day", opts: func(o *Options) { o.Granularity = GranularityDay }, want: "2021-03-04T00:00:00Z   4.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// 08:30 at +09:00 is still the previous day in UTC
+	opts := DefaultOptions()
+	opts.Granularity = GranularityDay
+	got := mustAggregate(t, opts, "2021-03-03T23:30:00Z 1\n2021-03-04T08:30:00+09:00 3\n2021-03-04T09:00:00+09:00 10\n")
+	if want := "2021-03-03T00:00:00Z   2.0000\n2021-03-04T00:00:00Z  10.0000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       func(*Options)
+		input      string
+		want       string
+		duplicates int
+	}{
+		{
+			name: "count", opts: func(o *Options) { o.Agg = AggCount },
+			input:      "2021-03-04T03:00:00Z 1\n2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T03:10:00Z 2\n2021-03-04T03:10:00Z 2\n2021-03-04T04:00:00Z 4\n",
+			want:       "2021-03-04T03:00:00Z   2.0000\n2021-03-04T04:00:00Z   1.0000\n",
+			duplicates: 3,
+		},
+		{
+			name: "sum", opts: func(o *Options) { o.Agg = AggSum },
+			input:      "2021-03-04T03:00:00Z 1\n2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T04:00:00Z 4\n2021-03-04T04:00:00Z 4\n",
+			want:       "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   4.0000\n",
+			duplicates: 2,
+		},
+		// the first of the timestamp wins, even of another value
+		{
+			name:       "avg",
+			input:      "2021-03-04T03:00:00Z 1\n2021-03-04T03:00:00Z 9\n2021-03-04T03:10:00Z 3\n",
+			want:       "2021-03-04T03:00:00Z   2.0000\n",
+			duplicates: 1,
+		},
+		{
+			name: "unordered", opts: func(o *Options) { o.Agg, o.Unordered = AggSum, true },
+			input:      "2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 4\n2021-03-04T03:10:00Z 2\n2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 4\n2021-03-04T03:10:00Z 2\n",
+			want:       "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   4.0000\n",
+			duplicates: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats Stats
+			opts := DefaultOptions()
+			opts.Dedup = true
+			opts.Stats = &stats
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := mustAggregate(t, opts, tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if stats.Duplicates != tt.duplicates {
+				t.Errorf("got %d duplicates, want %d", stats.Duplicates, tt.duplicates)
+			}
+		})
+	}
+
+	// counted as is without Dedup
+	opts := DefaultOptions()
+	opts.Agg = AggCount
+	if got, want := mustAggregate(t, opts, "2021-03-04T03:00:00Z 1\n2021-03-04T03:00:00Z 1\n"), "2021-03-04T03:00:00Z   2.0000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  func(*Options)
+		input string
+	}{
+		{name: "empty reader"},
+		{name: "jsonl", opts: func(o *Options) { o.Format = FormatJSONL }},
+		{name: "with count", opts: func(o *Options) { o.WithCount = true }},
+		{
+			name: "out of the range",
+			opts: func(o *Options) {
+				o.EnforceRange = true
+				o.St = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+				o.Ed = time.Date(2021, 3, 4, 3, 59, 59, 0, time.UTC)
+			},
+			input: "2021-03-05T03:00:00Z 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			var got string
+			stderr := captureStderr(t, func() { got = mustAggregate(t, opts, tt.input) })
+			if got != "" || !strings.Contains(stderr, "# no data\n") {
+				t.Errorf("got %q, %q, want no line, but the note", got, stderr)
+			}
+		})
+	}
+
+	opts := DefaultOptions()
+	opts.FailOnEmpty = true
+	// the record out of the range is not aggregated either
+	opts.EnforceRange = true
+	opts.St = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	opts.Ed = time.Date(2021, 3, 4, 3, 59, 59, 0, time.UTC)
+	for _, input := range []string{"", "2021-03-05T03:00:00Z 1\n"} {
+		if _, err := runAggregate(opts, input); err == nil || err.Error() != "no records in the range" {
+			t.Errorf("%q: got %v, want the empty input failed", input, err)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	// a record a second from 2021-03-04T00:00:00Z, past 2 intervals
+	var (
+		input strings.Builder
+		begin = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	)
+	for i := range 2*progressInterval + 10 {
+		input.WriteString(begin.Add(time.Duration(i) * time.Second).Format(time.RFC3339))
+		input.WriteString(" 1\n")
+	}
+
+	var quiet, got string
+	stderr := captureStderr(t, func() { quiet = mustAggregate(t, DefaultOptions(), input.String()) })
+	if strings.Contains(stderr, "progress") {
+		t.Errorf("got %q, want no progress by default", stderr)
+	}
+
+	opts := DefaultOptions()
+	opts.Progress = true
+	stderr = captureStderr(t, func() { got = mustAggregate(t, opts, input.String()) })
+	// the time slot open when the 100000th and 200000th records are read
+	if want := "progress: 100000 records, time slot 2021-03-05T03:00:00Z\nprogress: 200000 records, time slot 2021-03-06T07:00:00Z\n"; stderr != want {
+		t.Errorf("got %q, want %q", stderr, want)
+	}
+	if got != quiet {
+		t.Error("got the output changed by the progress")
+	}
+}
+
+func TestValueBounds(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T03:20:00Z 3\n2021-03-04T03:30:00Z 4\n2021-03-04T04:00:00Z 5\n"
+	inf := math.Inf(1)
+	tests := []struct {
+		name     string
+		min, max float64
+		want     string
+		filtered int
+	}{
+		// the bounds themselves are in
+		{name: "lower", min: 2, max: inf, want: "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   1.0000\n", filtered: 1},
+		{name: "upper", min: -inf, max: 3, want: "2021-03-04T03:00:00Z   3.0000\n", filtered: 2},
+		{name: "both", min: 2, max: 4, want: "2021-03-04T03:00:00Z   3.0000\n", filtered: 2},
+		{name: "single value", min: 4, max: 4, want: "2021-03-04T03:00:00Z   1.0000\n", filtered: 4},
+		{name: "none", min: -inf, max: inf, want: "2021-03-04T03:00:00Z   4.0000\n2021-03-04T04:00:00Z   1.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// counted, so the skipped records are apparent
+			var stats Stats
+			opts := DefaultOptions()
+			opts.Agg = AggCount
+			opts.MinValue, opts.MaxValue = tt.min, tt.max
+			opts.Stats = &stats
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if stats.Filtered != tt.filtered {
+				t.Errorf("got %d filtered, want %d", stats.Filtered, tt.filtered)
+			}
+		})
+	}
+
+	// the count of the skipped is reported with Progress
+	opts := DefaultOptions()
+	opts.MinValue, opts.Progress = 3, true
+	var got string
+	stderr := captureStderr(t, func() { got = mustAggregate(t, opts, input) })
+	if got != "2021-03-04T03:00:00Z   3.5000\n2021-03-04T04:00:00Z   5.0000\n" || !strings.Contains(stderr, "Records out of the value bounds: 2\n") {
+		t.Errorf("got %q, %q", got, stderr)
+	}
+}
+
+func TestOnMalformed(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z x\n2021-03-04T03:20:00Z 3\n2021-03-04T0\n"
+	var (
+		stats    Stats
+		reported []string
+	)
+	opts := DefaultOptions()
+	opts.Stats = &stats
+	opts.OnMalformed = func(err error) { reported = append(reported, err.Error()) }
+	var got string
+	captureStderr(t, func() { got = mustAggregate(t, opts, input) })
+	if got != "2021-03-04T03:00:00Z   2.0000\n" {
+		t.Errorf("got %q", got)
+	}
+	want := []string{
+		"line 2: invalid value. invalid data format: 2021-03-04T03:10:00Z x",
+		"line 4: too short record(12 bytes). invalid data format: 2021-03-04T0",
+	}
+	if fmt.Sprint(reported) != fmt.Sprint(want) || stats.Malformed != 2 {
+		t.Errorf("got %q, %d malformed, want %q", reported, stats.Malformed, want)
+	}
+
+	// fails at the first, if strict
+	opts.Strict = true
+	if _, err := runAggregate(opts, input); err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Errorf("got %v, want the parse error", err)
+	}
+}
+
+func TestRunSources(t *testing.T) {
+	// the hour 04 in both, and the first without the trailing newline
+	sources := func() []Source {
+		return []Source{
+			{Name: "a.txt", R: strings.NewReader("2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 2\n2021-03-04T04:10:00Z 4")},
+			{Name: "b.txt", R: strings.NewReader("2021-03-04T04:20:00Z 6\n2021-03-04T04:30:00Z 8\n2021-03-04T05:00:00Z 3\n")},
+		}
+	}
+	tests := []struct {
+		agg  string
+		want string
+	}{
+		{agg: AggSum, want: "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z  20.0000\n2021-03-04T05:00:00Z   3.0000\n"},
+		{agg: AggCount, want: "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   4.0000\n2021-03-04T05:00:00Z   1.0000\n"},
+		{agg: AggAvg, want: "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   5.0000\n2021-03-04T05:00:00Z   3.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.agg, func(t *testing.T) {
+			var out bytes.Buffer
+			opts := DefaultOptions()
+			opts.Agg, opts.Unordered = tt.agg, true
+			if err := NewAggregator(&out, opts).RunSources(context.Background(), sources()...); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+
+	// the error tells the source
+	opts := DefaultOptions()
+	opts.Unordered = true
+	err := NewAggregator(io.Discard, opts).RunSources(context.Background(),
+		Source{Name: "a.txt", R: strings.NewReader("2021-03-04T03:00:00Z 1\n")},
+		Source{Name: "b.txt", R: strings.NewReader("2021-03-04T04:00:00Z x\n")},
+	)
+	if err == nil || !strings.HasPrefix(err.Error(), "b.txt: parse error") {
+		t.Errorf("got %v, want the error of b.txt", err)
+	}
+}
+
+func TestFinalRecordWithoutNewline(t *testing.T) {
+	const head = "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n"
+	tests := []struct {
+		name  string
+		opts  func(*Options)
+		final string
+		want  string
+		err   string
+	}{
+		{name: "complete", final: "2021-03-04T04:00:00Z 4", want: "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n"},
+		{name: "complete fixed width", opts: func(o *Options) { o.FixedWidth = true }, final: "2021-03-04T04:00:00Z 004.0000", want: "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n"},
+		// never skipped as malformed, unlike the same in the middle
+		{name: "cut in the timestamp", final: "2021-03-04T04:0", err: "truncated final record at line 3: 2021-03-04T04:0"},
+		{name: "cut before the value", final: "2021-03-04T04:00:00Z ", err: "truncated final record at line 3: 2021-03-04T04:00:00Z "},
+		{name: "cut fixed width", opts: func(o *Options) { o.FixedWidth = true }, final: "2021-03-04T04:00:00Z 004.0", err: "truncated final record: 2021-03-04T04:00:00Z 004.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			input := head + tt.final
+			if opts.FixedWidth {
+				input = "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n" + tt.final
+			}
+			// a byte at a time as well, so no stale bytes of the buffer are parsed
+			for _, r := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+				var out bytes.Buffer
+				err := NewAggregator(&out, opts).Run(context.Background(), r)
+				if tt.err != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.err) {
+						t.Errorf("got %v, want %q", err, tt.err)
+					}
+					continue
+				}
+				if err != nil || out.String() != tt.want {
+					t.Errorf("got %q, %v, want %q", out.String(), err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	// 0-9 in the hour 03 and 0-4 in 04, a minute apart
+	var input strings.Builder
+	for i := range 10 {
+		fmt.Fprintf(&input, "2021-03-04T03:%02d:00Z %d\n", i, i)
+	}
+	for i := range 5 {
+		fmt.Fprintf(&input, "2021-03-04T04:%02d:00Z %d\n", i, i)
+	}
+
+	opts := DefaultOptions()
+	opts.WithCount = true
+	full := mustAggregate(t, opts, input.String())
+	opts.SampleRate = 1
+	if got := mustAggregate(t, opts, input.String()); got != full {
+		t.Errorf("got %q, want the same as without sampling %q", got, full)
+	}
+
+	// from the first of each time slot, 0, 3, 6, 9 and 0, 3
+	var stats Stats
+	opts.SampleRate, opts.Progress, opts.Stats = 3, true, &stats
+	var got string
+	stderr := captureStderr(t, func() { got = mustAggregate(t, opts, input.String()) })
+	if want := "2021-03-04T03:00:00Z   4.5000  (n=4)\n2021-03-04T04:00:00Z   1.5000  (n=2)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if stats.Filtered != 9 || !strings.Contains(stderr, "Records skipped by the sample rate: 9\n") {
+		t.Errorf("got %d filtered, %q, want 9 skipped", stats.Filtered, stderr)
+	}
+	opts.Progress = false
+	if again := mustAggregate(t, opts, input.String()); again != got {
+		t.Errorf("got %q, then %q, want deterministic", got, again)
+	}
+}
+
+func TestRunInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	stream := io.MultiReader(
+		strings.NewReader("2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n2021-03-04T04:00:00Z 4\n"),
+		// the first record read along with the stall, before the cancellation is noticed
+		stallingReader{ctx, strings.NewReader("2021-03-04T04:30:00Z 6\n2021-03-04T05:00:00Z 9\n")},
+	)
+
+	var (
+		out bytes.Buffer
+		err error
+	)
+	stderr := captureStderr(t, func() { err = NewAggregator(&out, DefaultOptions()).Run(ctx, stream) })
+	if !errors.Is(err, ErrInterrupted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want interrupted", err)
+	}
+	// flushed as the timeout, but marked apart from it
+	if want := "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   5.0000\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if stderr != "# interrupted\n" {
+		t.Errorf("got %q, want the interruption marked", stderr)
+	}
+}
+
+// failingWriter fails every write, e.g. the disk is full.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("no space left on device") }
+
+func TestRunReportsFlushError(t *testing.T) {
+	// smaller than the buffer, so the only write is the flush at the end
+	err := NewAggregator(failingWriter{}, DefaultOptions()).Run(context.Background(), strings.NewReader("2021-03-04T03:00:00Z 1\n"))
+	if err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Errorf("got %v, want the write error", err)
+	}
+}
+
+func TestRunRollups(t *testing.T) {
+	const input = "2021-03-04T00:00:00Z 1\n2021-03-04T00:00:30Z 3\ngarbage\n2021-03-04T01:10:00Z 5\n2021-03-05T23:59:00Z 8\n"
+	tests := []struct {
+		name string
+		opts func(*Options)
+	}{
+		{name: "default"},
+		{name: "fill and checksum", opts: func(o *Options) {
+			o.Fill, o.TrailingChecksum, o.ValueUnit = true, true, "celsius"
+			o.St, o.Ed = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 5, 23, 59, 59, 0, time.UTC)
+		}},
+		{name: "unordered", opts: func(o *Options) { o.Unordered = true }},
+		{name: "jsonl", opts: func(o *Options) { o.Format, o.EmitSchema = FormatJSONL, true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var malformed int
+			opts := DefaultOptions()
+			opts.OnMalformed = func(error) { malformed++ }
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			// the same as each granularity alone
+			want := make(map[string]string)
+			for _, g := range []Granularity{GranularityMinute, GranularityHour, GranularityDay} {
+				o := opts
+				o.Granularity = g
+				want[g.Name] = mustAggregate(t, o, input)
+			}
+
+			malformed = 0
+			var minute, day bytes.Buffer
+			opts.Rollups = []Rollup{{Granularity: GranularityMinute, W: &minute}, {Granularity: GranularityDay, W: &day}}
+			got := map[string]string{"hour": mustAggregate(t, opts, input), "minute": minute.String(), "day": day.String()}
+			for name, w := range want {
+				if got[name] != w {
+					t.Errorf("%s: got %q, want %q", name, got[name], w)
+				}
+			}
+			if malformed != 1 {
+				t.Errorf("got %d malformed records reported, want parsed once", malformed)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Number of records between checkpoints
+const checkpointInterval = 100_000
+
+// checkpoint is the in-progress state of a run.
+// Resuming requires the stream to be replayable, as the first
+// `Position` bytes are skipped. Re-fetching the same past range satisfies this.
+type checkpoint struct {
+	Begin    time.Time `json:"begin"`
+	End      time.Time `json:"end"`
+	TimeSlot string    `json:"time_slot"`
+	Sum      float64   `json:"sum"`
+	Count    int       `json:"count"`
+	Position int64     `json:"position"`
+	// Hash state of the output so far, if trailing checksum is enabled
+	ChecksumState []byte `json:"checksum_state,omitempty"`
+	// Index of the value column found in the header, if value column name is set
+	ValueColumn int `json:"value_column,omitempty"`
+	// Previous value within the time slot and the violations so far, if monotonic order is expected
+	PrevScore  float64 `json:"prev_score,omitempty"`
+	Violations int     `json:"violations,omitempty"`
+	// Counts of the run so far, and the totals of the summary
+	Counts       counts  `json:"counts"`
+	TotalRecords int     `json:"total_records,omitempty"`
+	TotalSum     float64 `json:"total_sum,omitempty"`
+	// Last timestamp seen, if dedup is enabled
+	LastStamp string `json:"last_stamp,omitempty"`
+	// Decimals of the output, widened so far if the precision is detected
+	Precision int `json:"precision"`
+	// Results of the last time slots in the window, the oldest first, if the rolling mean is enabled
+	Rolling []float64 `json:"rolling,omitempty"`
+	// Time slot and the number of its records so far, if sampled
+	SampleSlot string `json:"sample_slot,omitempty"`
+	SampleSeq  int    `json:"sample_seq,omitempty"`
+}
+
+// saveCheckpoint writes the checkpoint atomically,
+// so that a crash while writing never leaves a broken checkpoint.
+func saveCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// loadCheckpoint reads the checkpoint and makes sure it belongs to the same range.
+func loadCheckpoint(path string, opts Options) (cp checkpoint, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("failed to read checkpoint: %w", err)
+		return
+	}
+
+	if err = json.Unmarshal(data, &cp); err != nil {
+		err = fmt.Errorf("failed to decode checkpoint: %w", err)
+		return
+	}
+
+	if !cp.Begin.Equal(opts.St) || !cp.End.Equal(opts.Ed) {
+		err = fmt.Errorf("checkpoint range(%s - %s) doesn't match the requested range", cp.Begin.Format(time.RFC3339), cp.End.Format(time.RFC3339))
+		return
+	}
+
+	if len(cp.TimeSlot) != opts.Granularity.KeyWidth {
+		err = fmt.Errorf("checkpoint time slot(%s) doesn't match the %s granularity", cp.TimeSlot, opts.Granularity.Name)
+		return
+	}
+	return
+}
+
+// releasePending writes the output held since the last checkpoint to w.
+func releasePending(writer *bufio.Writer, pending *bytes.Buffer, w io.Writer) error {
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush output: %w", err)
+	}
+	if _, err := pending.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// state returns the checkpoint of the run at the current position.
+func (r *run) state() (cp checkpoint, err error) {
+	s := &r.slots
+	cp = checkpoint{
+		Begin:        r.opts.St,
+		End:          r.opts.Ed,
+		TimeSlot:     string(s.prevTimeSlot[:s.keyWidth]),
+		Sum:          s.acc.value,
+		Count:        s.acc.count,
+		Position:     r.position,
+		ValueColumn:  r.parser.layout.valueColumn,
+		PrevScore:    s.prevScore,
+		Violations:   s.violations,
+		Counts:       r.counts,
+		TotalRecords: r.totals.records,
+		TotalSum:     r.totals.sum,
+		LastStamp:    string(r.parser.lastStamp),
+		Precision:    s.precision,
+		SampleSlot:   string(r.parser.sampleSlot),
+		SampleSeq:    r.parser.sampleSeq,
+	}
+	if s.window != nil {
+		cp.Rolling = s.window.recent()
+	}
+	if s.checksum != nil {
+		if cp.ChecksumState, err = s.checksum.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+			err = fmt.Errorf("failed to save checksum to checkpoint: %w", err)
+			return
+		}
+	}
+	return
+}
+
+// restore restores the state of the run from the checkpoint, the stream being skipped to its position.
+func (r *run) restore(cp checkpoint) error {
+	s := &r.slots
+	copy(s.prevTimeSlot[:], cp.TimeSlot)
+	s.acc.value, s.acc.count, r.position = cp.Sum, cp.Count, cp.Position
+	s.prevScore, s.violations = cp.PrevScore, cp.Violations
+	r.counts, r.totals.records, r.totals.sum = cp.Counts, cp.TotalRecords, cp.TotalSum
+	r.parser.lastStamp = append(r.parser.lastStamp[:0], cp.LastStamp...)
+	r.parser.sampleSlot, r.parser.sampleSeq = append(r.parser.sampleSlot[:0], cp.SampleSlot...), cp.SampleSeq
+	if r.opts.DetectPrecision {
+		s.precision = cp.Precision
+	}
+	if s.window != nil {
+		for _, v := range cp.Rolling {
+			s.window.push(v)
+		}
+	}
+	if r.opts.ValueColumnName != "" {
+		// the header has been skipped
+		r.parser.layout.valueColumn = cp.ValueColumn
+	}
+	r.headerRows = 0
+	if s.checksum != nil {
+		// continue hashing the output of the previous run
+		if err := s.checksum.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.ChecksumState); err != nil {
+			return fmt.Errorf("failed to restore checksum from checkpoint: %w", err)
+		}
+	}
+	return nil
+}
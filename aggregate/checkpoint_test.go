@@ -0,0 +1,175 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cancelingReader cancels the context once more than after bytes are read.
+type cancelingReader struct {
+	r      io.Reader
+	after  int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.after -= n; r.after < 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+// checkpointInput returns more than two checkpoints of records, one per second.
+// The values vary within and across the time slots, so any state lost on resume changes the output.
+func checkpointInput() []byte {
+	var (
+		input bytes.Buffer
+		begin = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	)
+	for i := range 2*checkpointInterval + 5000 {
+		stamp := begin.Add(time.Duration(i) * time.Second).Format(time.RFC3339)
+		switch {
+		case i == 10:
+			// the only decimals, before the first checkpoint
+			fmt.Fprintf(&input, "%s %d.25\n", stamp, i%97)
+		case i%2 == 0:
+			// duplicated, so a duplicate follows the record of the first checkpoint
+			fmt.Fprintf(&input, "%s %d\n%s %d\n", stamp, i%97, stamp, i%97)
+		default:
+			fmt.Fprintf(&input, "%s %d\n", stamp, i%97)
+		}
+	}
+	return input.Bytes()
+}
+
+// runResumed runs the aggregation interrupted between the first and the second checkpoint, then resumes it.
+// Returns the output of both runs, the stderr and the stats of the resumed one.
+func runResumed(t *testing.T, opts Options, input []byte) (out, stderr string, stats Stats) {
+	t.Helper()
+	opts.CheckpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var buf bytes.Buffer
+	stream := &cancelingReader{r: bytes.NewReader(input), after: len(input) * 2 / 3, cancel: cancel}
+	if err := NewAggregator(&buf, opts).Run(ctx, stream); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("got %v, want interrupted", err)
+	}
+	if _, err := os.Stat(opts.CheckpointPath); err != nil {
+		t.Fatalf("want the checkpoint: %v", err)
+	}
+
+	opts.Resume, opts.Stats = true, &stats
+	stderr = captureStderr(t, func() {
+		if err := NewAggregator(&buf, opts).Run(context.Background(), bytes.NewReader(input)); err != nil {
+			t.Fatalf("failed to resume: %v", err)
+		}
+	})
+	if _, err := os.Stat(opts.CheckpointPath); !os.IsNotExist(err) {
+		t.Errorf("want the checkpoint removed on completion, got %v", err)
+	}
+	return buf.String(), stderr, stats
+}
+
+func TestCheckpointResume(t *testing.T) {
+	input := checkpointInput()
+	tests := []struct {
+		name string
+		opts func(*Options)
+	}{
+		{name: "checksum", opts: func(o *Options) { o.TrailingChecksum = true }},
+		{name: "expect monotonic", opts: func(o *Options) { o.ExpectMonotonic = MonotonicIncreasing }},
+		{name: "summary", opts: func(o *Options) { o.Summary, o.Deterministic = true, true }},
+		{name: "dedup", opts: func(o *Options) { o.Dedup = true }},
+		{name: "detect precision", opts: func(o *Options) { o.DetectPrecision = true }},
+		{name: "rolling", opts: func(o *Options) { o.Rolling = 3 }},
+		{name: "sample rate", opts: func(o *Options) { o.SampleRate = 7 }},
+		{name: "rolling placeholder", opts: func(o *Options) { o.Rolling, o.RollingWarmup = 40, RollingWarmupPlaceholder }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.St, opts.Ed = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 7, 0, 0, 0, 0, time.UTC)
+			tt.opts(&opts)
+
+			var (
+				want      string
+				wantStats Stats
+			)
+			opts.Stats = &wantStats
+			wantStderr := captureStderr(t, func() { want = mustAggregate(t, opts, string(input)) })
+			opts.Stats = nil
+
+			out, stderr, stats := runResumed(t, opts, input)
+			if out != want {
+				t.Errorf("resumed output differs from the uninterrupted one:\ngot:\n%s\nwant:\n%s", out, want)
+			}
+			if stderr != wantStderr {
+				t.Errorf("got stderr %q, want %q", stderr, wantStderr)
+			}
+			if stats != wantStats {
+				t.Errorf("got %+v, want %+v", stats, wantStats)
+			}
+		})
+	}
+}
+
+func TestLoadCheckpointMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	begin := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	if err := saveCheckpoint(path, checkpoint{Begin: begin, End: begin.Add(time.Hour), TimeSlot: "2021-03-04T00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.St, opts.Ed = begin, begin.Add(time.Hour)
+	if _, err := loadCheckpoint(path, opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	opts.Ed = begin.Add(2 * time.Hour)
+	if _, err := loadCheckpoint(path, opts); err == nil {
+		t.Error("want the error of the other range")
+	}
+	opts.Ed, opts.Granularity = begin.Add(time.Hour), GranularityDay
+	if _, err := loadCheckpoint(path, opts); err == nil {
+		t.Error("want the error of the other granularity")
+	}
+}
+
+func TestRunStateRestore(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TrailingChecksum = true
+	var out bytes.Buffer
+	writer := bufio.NewWriter(&out)
+	var r run
+	r.init(writer, opts)
+	for _, record := range []string{"2021-03-04T03:00:00Z 1\n", "2021-03-04T04:00:00Z 2\n", "2021-03-04T04:10:00Z 4\n"} {
+		if err := r.record([]byte(record), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp, err := r.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.TimeSlot != "2021-03-04T04" || cp.Sum != 6 || cp.Count != 2 || cp.Position != 69 {
+		t.Errorf("got %+v", cp)
+	}
+
+	var resumed run
+	resumed.init(writer, opts)
+	if err = resumed.restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resumed.state(); err != nil || got.TimeSlot != cp.TimeSlot || got.Sum != cp.Sum || got.Count != cp.Count || got.Position != cp.Position || !bytes.Equal(got.ChecksumState, cp.ChecksumState) {
+		t.Errorf("got %+v, %v, want %+v", got, err, cp)
+	}
+}
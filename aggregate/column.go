@@ -0,0 +1,63 @@
+package aggregate
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column locates a column of the records of a custom layout,
+// either the byte range [Start, End) or the whitespace separated field of Field.
+type Column struct {
+	Start, End int
+	// 0-based index of the field, used when End is 0
+	Field int
+}
+
+// ParseColumn parses the column of `start:end`, the byte range, or `n`, the 0-based field index.
+func ParseColumn(s string) (Column, error) {
+	if start, end, ok := strings.Cut(s, ":"); ok {
+		c := Column{}
+		var err1, err2 error
+		c.Start, err1 = strconv.Atoi(start)
+		c.End, err2 = strconv.Atoi(end)
+		if err1 != nil || err2 != nil || c.Start < 0 || c.End <= c.Start {
+			return Column{}, fmt.Errorf("invalid column: %v, must be start:end of 0 <= start < end", s)
+		}
+		return c, nil
+	}
+	field, err := strconv.Atoi(s)
+	if err != nil || field < 0 {
+		return Column{}, fmt.Errorf("invalid column: %v, must be start:end or a non-negative field index", s)
+	}
+	return Column{Field: field}, nil
+}
+
+// extract returns the column of the record, trimmed of the spaces, or nil if absent.
+// The byte range is cut short by the end of the record.
+func (c Column) extract(record []byte) []byte {
+	if c.End == 0 {
+		return nthField(record, c.Field)
+	}
+	if c.Start >= len(record) {
+		return nil
+	}
+	return bytes.TrimSpace(record[c.Start:min(c.End, len(record))])
+}
+
+// validateColumns validates the timestamp and the value extracted from the record of a custom layout.
+// line is the 1-based line number of the record, for the error.
+func validateColumns(stamp, value, record []byte, line int) error {
+	switch {
+	case len(stamp) == 0:
+		return fmt.Errorf("line %d: missing timestamp column. invalid data format: %s", line, record)
+	case len(value) == 0:
+		return fmt.Errorf("line %d: missing value column. invalid data format: %s", line, record)
+	}
+	if _, err := time.Parse(time.RFC3339, string(stamp)); err != nil {
+		return fmt.Errorf("line %d: invalid timestamp. invalid data format: %s", line, record)
+	}
+	return nil
+}
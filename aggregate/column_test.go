@@ -0,0 +1,92 @@
+package aggregate
+
+import "testing"
+
+func TestParseColumn(t *testing.T) {
+	for s, want := range map[string]Column{"5:25": {Start: 5, End: 25}, "0:20": {End: 20}, "0": {}, "2": {Field: 2}} {
+		if got, err := ParseColumn(s); err != nil || got != want {
+			t.Errorf("%s: got %+v, %v, want %+v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "x", "5:5", "5:3", "-1:3", "1:x", "1:2:3"} {
+		if got, err := ParseColumn(s); err == nil {
+			t.Errorf("%s: got %+v, want the error", s, got)
+		}
+	}
+}
+
+func TestColumnExtract(t *testing.T) {
+	const record = "0042 2021-03-04T03:00:00Z   1.5"
+	tests := []struct {
+		column Column
+		want   string
+	}{
+		{column: Column{Start: 5, End: 25}, want: "2021-03-04T03:00:00Z"},
+		// trimmed, and cut short by the end of the record
+		{column: Column{Start: 25, End: 40}, want: "1.5"},
+		{column: Column{Start: 40, End: 50}, want: ""},
+		{column: Column{Field: 2}, want: "1.5"},
+		{column: Column{Field: 3}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := string(tt.column.extract([]byte(record))); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.column, got, tt.want)
+		}
+	}
+}
+
+func TestCustomLayouts(t *testing.T) {
+	const want = "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n"
+	tests := []struct {
+		name         string
+		stamp, value Column
+		input        string
+	}{
+		{
+			name: "id prefixed byte ranges", stamp: Column{Start: 5, End: 25}, value: Column{Start: 26, End: 40},
+			input: "0001 2021-03-04T03:00:00Z 1\n0002 2021-03-04T03:30:00Z 2\n0003 2021-03-04T04:00:00Z 4\n",
+		},
+		{
+			name: "id prefixed fields", stamp: Column{Field: 1}, value: Column{Field: 2},
+			input: "sensor-a 2021-03-04T03:00:00Z 1\nsensor-b 2021-03-04T03:30:00Z 2\nsensor-a 2021-03-04T04:00:00Z 4\n",
+		},
+		{
+			name: "tab delimited", stamp: Column{Field: 0}, value: Column{Field: 1},
+			input: "2021-03-04T03:00:00Z\t1\n2021-03-04T03:30:00Z\t2\n2021-03-04T04:00:00Z\t4\n",
+		},
+		{
+			name: "tab delimited with id", stamp: Column{Field: 1}, value: Column{Field: 2},
+			input: "1\t2021-03-04T03:00:00Z\t1\n2\t2021-03-04T03:30:00Z\t2\n3\t2021-03-04T04:00:00Z\t4\n",
+		},
+		{
+			name: "value first", stamp: Column{Field: 1}, value: Column{Field: 0},
+			input: "1 2021-03-04T03:00:00Z\n2 2021-03-04T03:30:00Z\n4 2021-03-04T04:00:00Z\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.TimestampColumn, opts.ValueColumn = &tt.stamp, &tt.value
+			if got := mustAggregate(t, opts, tt.input); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+
+	// the malformed are skipped as usual
+	var (
+		stats    Stats
+		reported []string
+	)
+	opts := DefaultOptions()
+	opts.TimestampColumn, opts.ValueColumn = &Column{Field: 1}, &Column{Field: 2}
+	opts.Stats = &stats
+	opts.OnMalformed = func(err error) { reported = append(reported, err.Error()) }
+	got := mustAggregate(t, opts, "1 2021-03-04T03:00:00Z 1\n2 2021-03-04T03:30:00Z\n3 yesterday 2\n4 2021-03-04T03:40:00Z 2\n")
+	if got != "2021-03-04T03:00:00Z   1.5000\n" || stats.Malformed != 2 {
+		t.Errorf("got %q, %d malformed", got, stats.Malformed)
+	}
+	if len(reported) != 2 || reported[0] != "line 2: missing value column. invalid data format: 2 2021-03-04T03:30:00Z" || reported[1] != "line 3: invalid timestamp. invalid data format: 3 yesterday 2" {
+		t.Errorf("got %q", reported)
+	}
+}
@@ -0,0 +1,22 @@
+package aggregate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// writeCountDistribution writes how many time slots had each number of samples, in ascending order of the number.
+// e.g. most slots had 60 samples, some had 59.
+func writeCountDistribution(w io.Writer, dist map[int]int) {
+	counts := make([]int, 0, len(dist))
+	for count := range dist {
+		counts = append(counts, count)
+	}
+	sort.Ints(counts)
+
+	fmt.Fprintln(w, "Count distribution(samples: slots):")
+	for _, count := range counts {
+		fmt.Fprintf(w, "%8d: %d\n", count, dist[count])
+	}
+}
@@ -0,0 +1,20 @@
+package aggregate
+
+import (
+	"testing"
+)
+
+func TestCountDistribution(t *testing.T) {
+	// 2 slots of 2 samples, 1 of 1 and 1 of 3
+	input := "2021-03-04T00:00:00Z 001.0000\n2021-03-04T00:10:00Z 001.0000\n" +
+		"2021-03-04T01:00:00Z 001.0000\n" +
+		"2021-03-04T02:00:00Z 001.0000\n2021-03-04T02:10:00Z 001.0000\n2021-03-04T02:20:00Z 001.0000\n" +
+		"2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 001.0000\n"
+	opts := DefaultOptions()
+	opts.CountDistribution = true
+	got := captureStderr(t, func() { mustAggregate(t, opts, input) })
+	want := "Count distribution(samples: slots):\n       1: 1\n       2: 2\n       3: 1\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package aggregate
+
+import (
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// The fixed number format is consumed by the legacy scripts, so the column widths are pinned byte for byte
+func TestNumberFormatFixedGolden(t *testing.T) {
+	input, err := os.ReadFile(filepath.Join("testdata", "records.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.St = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	opts.Ed = time.Date(2021, 3, 4, 4, 0, 0, 0, time.UTC)
+	opts.Fill = true
+	got := mustAggregate(t, opts, string(input))
+
+	golden := filepath.Join("testdata", "fixed.golden")
+	if *update {
+		if err = os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestNumberFormatRaw(t *testing.T) {
+	opts := DefaultOptions()
+	opts.NumberFormat = NumberFormatRaw
+	got := mustAggregate(t, opts, "2021-03-04T00:00:00Z 107.4177\n2021-03-04T01:00:00Z 3\n2021-03-04T01:10:00Z 4\n")
+	if want := "2021-03-04T00:00:00Z 107.4177\n2021-03-04T01:00:00Z 3.5\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSlotLine(t *testing.T) {
+	mean, nan := 2.5, math.NaN()
+	tests := []struct {
+		name   string
+		opts   func(*Options)
+		slot   Slot
+		result string
+		want   string
+	}{
+		{name: "plain", slot: Slot{Time: "2021-03-04T03:00:00Z"}, result: "  1.5000", want: "2021-03-04T03:00:00Z   1.5000\n"},
+		{name: "rolling", slot: Slot{Time: "2021-03-04T03:00:00Z", Rolling: &mean}, result: "  1.5000", want: "2021-03-04T03:00:00Z   1.5000   2.5000\n"},
+		{
+			name: "rolling nan as", opts: func(o *Options) { o.NaNAs = "null" },
+			slot: Slot{Time: "2021-03-04T03:00:00Z", Rolling: &nan}, result: "  1.5000", want: "2021-03-04T03:00:00Z   1.5000     null\n",
+		},
+		{
+			name: "raw rolling", opts: func(o *Options) { o.NumberFormat = NumberFormatRaw },
+			slot: Slot{Time: "2021-03-04T03:00:00Z", Rolling: &mean}, result: "1.5", want: "2021-03-04T03:00:00Z 1.5 2.5\n",
+		},
+		{
+			name: "with count", opts: func(o *Options) { o.WithCount = true },
+			slot: Slot{Time: "2021-03-04T03:00:00Z", Count: 6}, result: "  1.5000", want: "2021-03-04T03:00:00Z   1.5000  (n=6)\n",
+		},
+		{
+			name: "prefix and suffix", opts: func(o *Options) { o.LinePrefix, o.LineSuffix, o.WithCount = "> ", " <", true },
+			slot: Slot{Time: "2021-03-04T03:00:00Z", Count: 6}, result: "  1.5000", want: "> 2021-03-04T03:00:00Z   1.5000  (n=6) <\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			if got := slotLine(tt.slot, tt.result, opts.Precision, opts); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatResult(t *testing.T) {
+	opts := DefaultOptions()
+	if got := formatResult(math.NaN(), 4, opts); got != "     NaN" {
+		t.Errorf("got %q, want NaN right aligned", got)
+	}
+	opts.NaNAs = "null"
+	if got := formatResult(math.NaN(), 4, opts); got != "    null" {
+		t.Errorf("got %q, want null right aligned", got)
+	}
+	if got := formatResult(-3.25, 2, opts); got != "   -3.25" {
+		t.Errorf("got %q, want the value of the precision", got)
+	}
+	opts.NumberFormat = NumberFormatPlain
+	if got := formatResult(math.NaN(), 4, opts); got != "null" {
+		t.Errorf("got %q, want null unpadded", got)
+	}
+	if got := formatResult(-3.25, 2, opts); got != "-3.25" {
+		t.Errorf("got %q, want the value of the precision unpadded", got)
+	}
+}
@@ -0,0 +1,90 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Granularity is the size of the time slots.
+// A time slot is keyed by the leading part of the RFC3339 timestamp,
+// so no time parsing is required to find the slot of a record.
+type Granularity struct {
+	Name     string
+	Duration time.Duration
+	// width of the timestamp prefix forming the slot key
+	// e.g. `YYYY-MM-DDTHH` for hour
+	KeyWidth int
+	// completes the slot key into RFC3339
+	suffix string
+}
+
+var (
+	GranularitySecond = Granularity{Name: "second", Duration: time.Second, KeyWidth: 19, suffix: "Z"}
+	GranularityMinute = Granularity{Name: "minute", Duration: time.Minute, KeyWidth: 16, suffix: ":00Z"}
+	GranularityHour   = Granularity{Name: "hour", Duration: time.Hour, KeyWidth: 13, suffix: ":00:00Z"}
+	GranularityDay    = Granularity{Name: "day", Duration: 24 * time.Hour, KeyWidth: 10, suffix: "T00:00:00Z"}
+
+	standardGranularities = []Granularity{GranularityMinute, GranularityHour, GranularityDay}
+)
+
+// label returns the RFC3339 start of the time slot of the key, shifted by the window offset.
+func (g Granularity) label(key []byte, offset time.Duration) string {
+	if offset == 0 {
+		return string(key) + g.suffix
+	}
+	start, err := time.Parse(time.RFC3339, string(key)+g.suffix)
+	if err != nil {
+		// unreachable, as the key is from a parsed timestamp
+		return string(key) + g.suffix
+	}
+	return start.Add(offset).Format(time.RFC3339)
+}
+
+// key returns the key of the time slot containing t.
+func (g Granularity) key(t time.Time) []byte {
+	return []byte(t.UTC().Format(time.RFC3339)[:g.KeyWidth])
+}
+
+// next returns the key of the time slot following the key.
+func (g Granularity) next(key []byte) []byte {
+	start, err := time.Parse(time.RFC3339, string(key)+g.suffix)
+	if err != nil {
+		// unreachable, as the key is from a parsed timestamp
+		return key
+	}
+	return g.key(start.Add(g.Duration))
+}
+
+// ParseGranularity returns the standard granularity of the name.
+func ParseGranularity(name string) (Granularity, error) {
+	for _, g := range standardGranularities {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return Granularity{}, fmt.Errorf("invalid granularity: %v, must be one of minute, hour or day", name)
+}
+
+// BucketCount returns the number of time slots covering [st, ed].
+func (g Granularity) BucketCount(st, ed time.Time) int64 {
+	return int64(ed.Truncate(g.Duration).Sub(st.Truncate(g.Duration))/g.Duration) + 1
+}
+
+// SelectGranularity picks the standard granularity yielding the closest number of time slots to the target.
+// Closeness is measured by ratio, so that 50 and 200 are equally far from 100.
+func SelectGranularity(st, ed time.Time, target int) (selected Granularity, err error) {
+	if target <= 0 {
+		err = fmt.Errorf("invalid target buckets: %d, must be a positive integer", target)
+		return
+	}
+
+	minDistance := math.Inf(1)
+	for _, g := range standardGranularities {
+		distance := math.Abs(math.Log(float64(g.BucketCount(st, ed)) / float64(target)))
+		if distance < minDistance {
+			selected, minDistance = g, distance
+		}
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectGranularity(t *testing.T) {
+	begin := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		span   time.Duration
+		target int
+		want   string
+	}{
+		{name: "2 hours by 100", span: 2 * time.Hour, target: 100, want: "minute"},
+		{name: "2 days by 50", span: 48 * time.Hour, target: 50, want: "hour"},
+		{name: "2 days by 2", span: 48 * time.Hour, target: 2, want: "day"},
+		{name: "a year by 100", span: 365 * 24 * time.Hour, target: 100, want: "day"},
+		{name: "a week by 1000", span: 7 * 24 * time.Hour, target: 1000, want: "hour"},
+		// 1 hour and 1 day, so the finer wins the tie
+		{name: "59 minutes by 1", span: 59 * time.Minute, target: 1, want: "hour"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SelectGranularity(begin, begin.Add(tt.span), tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("got %s of %d buckets, want %s", got.Name, got.BucketCount(begin, begin.Add(tt.span)), tt.want)
+			}
+		})
+	}
+
+	if _, err := SelectGranularity(begin, begin.Add(time.Hour), 0); err == nil {
+		t.Error("want the error of the non-positive target")
+	}
+}
+
+func TestParseGranularity(t *testing.T) {
+	for _, name := range []string{"minute", "hour", "day"} {
+		if g, err := ParseGranularity(name); err != nil || g.Name != name {
+			t.Errorf("ParseGranularity(%q) = %v, %v", name, g.Name, err)
+		}
+	}
+	if _, err := ParseGranularity("week"); err == nil {
+		t.Error("want the error of the unknown granularity")
+	}
+}
+
+func TestRunGranularities(t *testing.T) {
+	const input = "2021-03-04T23:59:10Z 1\n2021-03-04T23:59:50Z 3\n2021-03-05T00:00:00Z 10\n2021-03-05T00:00:59Z 20\n2021-03-05T00:01:00Z 30\n2021-03-05T01:30:00Z 40\n"
+	tests := []struct {
+		granularity Granularity
+		want        string
+	}{
+		{GranularitySecond, "2021-03-04T23:59:10Z   1.0000\n2021-03-04T23:59:50Z   3.0000\n2021-03-05T00:00:00Z  10.0000\n2021-03-05T00:00:59Z  20.0000\n2021-03-05T00:01:00Z  30.0000\n2021-03-05T01:30:00Z  40.0000\n"},
+		{GranularityMinute, "2021-03-04T23:59:00Z   2.0000\n2021-03-05T00:00:00Z  15.0000\n2021-03-05T00:01:00Z  30.0000\n2021-03-05T01:30:00Z  40.0000\n"},
+		{GranularityHour, "2021-03-04T23:00:00Z   2.0000\n2021-03-05T00:00:00Z  20.0000\n2021-03-05T01:00:00Z  40.0000\n"},
+		{GranularityDay, "2021-03-04T00:00:00Z   2.0000\n2021-03-05T00:00:00Z  25.0000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granularity.Name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Granularity = tt.granularity
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package aggregate
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Default width of the graph, when the terminal width is unknown
+const defaultTerminalWidth = 80
+
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// terminalWidth returns the width of the terminal from $COLUMNS.
+func terminalWidth() int {
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		return width
+	}
+	return defaultTerminalWidth
+}
+
+// sparkline renders the values as a unicode sparkline of at most width points.
+// When there are more values than the width, consecutive values are averaged into a point.
+func sparkline(values []float64, width int) string {
+	if len(values) == 0 || width <= 0 {
+		return ""
+	}
+
+	points := values
+	if len(values) > width {
+		points = make([]float64, width)
+		for i := range points {
+			// values[from:to] are averaged into the i-th point
+			from, to := i*len(values)/width, (i+1)*len(values)/width
+			sum := 0.0
+			for _, v := range values[from:to] {
+				sum += v
+			}
+			points[i] = sum / float64(to-from)
+		}
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		if !math.IsNaN(p) && !math.IsInf(p, 0) {
+			lo, hi = math.Min(lo, p), math.Max(hi, p)
+		}
+	}
+
+	var b strings.Builder
+	for _, p := range points {
+		switch {
+		case math.IsNaN(p) || math.IsInf(p, 0):
+			// no height to scale
+			b.WriteRune(' ')
+		case hi == lo:
+			// flat line
+			b.WriteRune(sparkBars[len(sparkBars)/2])
+		default:
+			b.WriteRune(sparkBars[int((p-lo)/(hi-lo)*float64(len(sparkBars)-1)+0.5)])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,58 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		width  int
+		want   string
+	}{
+		{name: "empty", values: nil, width: 10, want: ""},
+		{name: "scaled", values: []float64{0, 1, 2, 3, 4, 5, 6, 7}, width: 10, want: "▁▂▃▄▅▆▇█"},
+		{name: "flat", values: []float64{3, 3, 3}, width: 10, want: "▅▅▅"},
+		{name: "averaged into the width", values: []float64{0, 0, 7, 7}, width: 2, want: "▁█"},
+		{name: "nan", values: []float64{0, math.NaN(), 7}, width: 10, want: "▁ █"},
+		{name: "inf", values: []float64{1, math.Inf(1), 2, math.Inf(-1)}, width: 10, want: "▁ █ "},
+		{name: "all inf", values: []float64{math.Inf(1), math.Inf(-1)}, width: 10, want: "  "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sparkline(tt.values, tt.width); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// a point per time slot, up to the width of the terminal
+func TestGraph(t *testing.T) {
+	var input strings.Builder
+	for hour := range 24 {
+		fmt.Fprintf(&input, "2021-03-04T%02d:00:00Z %8.4f\n", hour, float64(hour))
+	}
+	tests := []struct {
+		columns string
+		want    int
+	}{
+		{columns: "", want: 24},
+		{columns: "12", want: 12},
+		{columns: "200", want: 24},
+	}
+	for _, tt := range tests {
+		t.Setenv("COLUMNS", tt.columns)
+		opts := DefaultOptions()
+		opts.Graph = true
+		stderr := captureStderr(t, func() { mustAggregate(t, opts, input.String()) })
+		if got := utf8.RuneCountInString(strings.TrimSuffix(stderr, "\n")); got != tt.want {
+			t.Errorf("COLUMNS=%s: got %d points of %q, want %d", tt.columns, got, stderr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package aggregate
+
+import (
+	"strconv"
+)
+
+// Histogram is the counts of the values of a time slot in the fixed width bins of [min, max].
+type Histogram struct {
+	Bins []int `json:"bins"`
+	// Number of values below min and above max
+	Under int `json:"under"`
+	Over  int `json:"over"`
+
+	min   float64
+	width float64
+}
+
+func newHistogram(min, max float64, bins int) *Histogram {
+	return &Histogram{Bins: make([]int, bins), min: min, width: (max - min) / float64(bins)}
+}
+
+func (h *Histogram) add(value float64) {
+	max := h.min + h.width*float64(len(h.Bins))
+	switch {
+	case value < h.min:
+		h.Under++
+	case !(value <= max):
+		h.Over++
+	default:
+		// max itself falls in the last bin, as the range is inclusive
+		h.Bins[min(int((value-h.min)/h.width), len(h.Bins)-1)]++
+	}
+}
+
+func (h *Histogram) reset() {
+	clear(h.Bins)
+	h.Under, h.Over = 0, 0
+}
+
+// appendText appends the counts in a line, the bins bracketed between the under and over.
+//
+//	0 [3 2 1 0] 1
+func (h *Histogram) appendText(dst []byte) []byte {
+	dst = strconv.AppendInt(dst, int64(h.Under), 10)
+	dst = append(dst, " ["...)
+	for i, n := range h.Bins {
+		if i > 0 {
+			dst = append(dst, ' ')
+		}
+		dst = strconv.AppendInt(dst, int64(n), 10)
+	}
+	dst = append(dst, "] "...)
+	return strconv.AppendInt(dst, int64(h.Over), 10)
+}
+
+// appendJSON appends the counts as a JSON object.
+//
+//	{"bins":[3,2,1,0],"under":0,"over":1}
+func (h *Histogram) appendJSON(dst []byte) []byte {
+	dst = append(dst, `{"bins":[`...)
+	for i, n := range h.Bins {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendInt(dst, int64(n), 10)
+	}
+	dst = append(dst, `],"under":`...)
+	dst = strconv.AppendInt(dst, int64(h.Under), 10)
+	dst = append(dst, `,"over":`...)
+	dst = strconv.AppendInt(dst, int64(h.Over), 10)
+	return append(dst, '}')
+}
@@ -0,0 +1,52 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	// bins of the width 2 over [0, 10]
+	h := newHistogram(0, 10, 5)
+	for _, v := range []float64{-0.01, 0, 1.99, 2, 5, 9.99, 10, 10.01, math.Inf(1), math.NaN()} {
+		h.add(v)
+	}
+	// the max falls in the last bin, but NaN is over
+	if got, want := string(h.appendText(nil)), "1 [2 1 1 0 2] 3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := string(h.appendJSON(nil)), `{"bins":[2,1,1,0,2],"under":1,"over":3}`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	h.reset()
+	if got, want := string(h.appendText(nil)), "0 [0 0 0 0 0] 0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHistogramAgg(t *testing.T) {
+	const input = "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 3\n2021-03-04T03:20:00Z 3.5\n2021-03-04T03:30:00Z -2\n2021-03-04T04:00:00Z 4\n2021-03-04T04:10:00Z 7\n"
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{name: "text", format: FormatText, want: "2021-03-04T03:00:00Z 1 [1 2] 0\n2021-03-04T04:00:00Z 0 [0 1] 1\n"},
+		{
+			name: "jsonl", format: FormatJSONL,
+			want: `{"time":"2021-03-04T03:00:00Z","avg":1.3750,"count":4,"histogram":{"bins":[1,2],"under":1,"over":0}}` + "\n" +
+				`{"time":"2021-03-04T04:00:00Z","avg":5.5000,"count":2,"histogram":{"bins":[0,1],"under":0,"over":1}}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Agg, opts.Format = AggHistogram, tt.format
+			opts.HistogramMin, opts.HistogramMax, opts.HistogramBins = 0, 4, 2
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
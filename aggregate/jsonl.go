@@ -0,0 +1,64 @@
+package aggregate
+
+import (
+	"math"
+	"strconv"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// appendSlotJSON appends the slot as a JSON Lines record, terminated by a new line.
+// The value is rounded to the decimals as the text output, and NaN or Inf is null as JSON has no such numbers.
+//
+//	{"time":"2021-01-01T05:00:00Z","avg":3.1416,"count":60}
+func appendSlotJSON(dst []byte, s Slot, decimals int) []byte {
+	dst = append(dst, `{"time":`...)
+	dst = appendJSONString(dst, s.Time)
+	dst = append(dst, `,"avg":`...)
+	dst = appendJSONFloat(dst, s.Avg, decimals)
+	dst = append(dst, `,"count":`...)
+	dst = strconv.AppendInt(dst, int64(s.Count), 10)
+	if s.Mean != nil && s.Stddev != nil {
+		dst = append(dst, `,"mean":`...)
+		dst = appendJSONFloat(dst, *s.Mean, decimals)
+		dst = append(dst, `,"stddev":`...)
+		dst = appendJSONFloat(dst, *s.Stddev, decimals)
+	}
+	if s.Rolling != nil {
+		dst = append(dst, `,"rolling":`...)
+		dst = appendJSONFloat(dst, *s.Rolling, decimals)
+	}
+	if s.Histogram != nil {
+		dst = append(dst, `,"histogram":`...)
+		dst = s.Histogram.appendJSON(dst)
+	}
+	if s.Unit != "" {
+		dst = append(dst, `,"unit":`...)
+		dst = appendJSONString(dst, s.Unit)
+	}
+	return append(dst, "}\n"...)
+}
+
+// appendJSONFloat appends the number rounded to the decimals, or null for NaN or Inf.
+func appendJSONFloat(dst []byte, f float64, decimals int) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(dst, "null"...)
+	}
+	return strconv.AppendFloat(dst, f, 'f', decimals, 64)
+}
+
+// appendJSONString appends the string quoted, escaping the quote, the backslash and the control characters.
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
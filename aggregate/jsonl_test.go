@@ -0,0 +1,94 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestJSONL(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = FormatJSONL
+	got := mustAggregate(t, opts, "2021-01-01T05:00:00Z 3.14159\n2021-01-01T05:30:00Z 3.14161\n2021-01-01T06:00:00Z -1\n")
+	want := `{"time":"2021-01-01T05:00:00Z","avg":3.1416,"count":2}` + "\n" + `{"time":"2021-01-01T06:00:00Z","avg":-1.0000,"count":1}` + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, line := range strings.SplitAfter(got, "\n")[:2] {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("got the invalid JSON %q", line)
+		}
+	}
+}
+
+func TestAppendJSONFloat(t *testing.T) {
+	tests := []struct {
+		f        float64
+		decimals int
+		want     string
+	}{
+		{f: 3.14159, decimals: 4, want: "3.1416"},
+		{f: 3.14159, decimals: 0, want: "3"},
+		{f: -0.5, decimals: 2, want: "-0.50"},
+		{f: math.NaN(), decimals: 4, want: "null"},
+		{f: math.Inf(-1), decimals: 4, want: "null"},
+	}
+	for _, tt := range tests {
+		if got := string(appendJSONFloat(nil, tt.f, tt.decimals)); got != tt.want {
+			t.Errorf("%v of %d decimals: got %s, want %s", tt.f, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestAppendSlotJSON(t *testing.T) {
+	tests := []struct {
+		s    Slot
+		want string
+	}{
+		{s: Slot{Time: "2021-03-04T03:00:00Z", Avg: -0.5, Count: 3}, want: `{"time":"2021-03-04T03:00:00Z","avg":-0.5000,"count":3}` + "\n"},
+		{s: Slot{Time: "2021-03-04T03:00:00Z", Avg: math.NaN(), Count: 1, Unit: "celsius"}, want: `{"time":"2021-03-04T03:00:00Z","avg":null,"count":1,"unit":"celsius"}` + "\n"},
+		{s: Slot{Time: "2021-03-04T03:00:00Z", Avg: math.Inf(-1), Count: 1}, want: `{"time":"2021-03-04T03:00:00Z","avg":null,"count":1}` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := string(appendSlotJSON(nil, tt.s, 4)); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestAppendJSONString(t *testing.T) {
+	for _, s := range []string{"celsius", `say "hi"`, `C:\temp`, "tab\tnew line\n\x00", "µs"} {
+		got := appendJSONString(nil, s)
+		var decoded string
+		if err := json.Unmarshal(got, &decoded); err != nil || decoded != s {
+			t.Errorf("%q: got %s, decoded as %q, %v", s, got, decoded, err)
+		}
+	}
+}
+
+func TestValueUnit(t *testing.T) {
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T04:00:00Z 004.0000\n"
+	opts := DefaultOptions()
+	opts.ValueUnit = "celsius"
+
+	// text annotates the unit once
+	if got := mustAggregate(t, opts, input); got != "# unit: celsius\n2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   4.0000\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// each slot event carries it
+	var units []string
+	opts.OnSlot = func(s Slot) { units = append(units, s.Unit) }
+	mustAggregate(t, opts, input)
+	if strings.Join(units, " ") != "celsius celsius" {
+		t.Errorf("got units %q of the slots", units)
+	}
+	opts.OnSlot = nil
+
+	// also in the schema
+	opts.EmitSchema = true
+	if got := mustAggregate(t, opts, input); !strings.Contains(got, `"unit":"celsius"`) || strings.Contains(got, "# unit:") {
+		t.Errorf("got %q, want the unit in the schema only", got)
+	}
+}
@@ -0,0 +1,211 @@
+package aggregate
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// Options configures the aggregation.
+type Options struct {
+	// Range of the stream, e.g. for EnforceRange and Fill
+	St time.Time
+	Ed time.Time
+
+	// Max number of records a single time slot may hold. 0 means unlimited.
+	// Guards against a timestamp parsing bug collapsing everything into one slot.
+	MaxRecordsPerSlot int
+	// The byte terminating each record. Defaults to new line.
+	RecordSeparator byte
+	// Path to periodically save the in-progress state. Empty means disabled.
+	CheckpointPath string
+	// Restart from the checkpoint saved at CheckpointPath.
+	Resume bool
+	// Expected order of the values within a time slot. Empty means no check.
+	ExpectMonotonic string
+	// Print the schema of the output before the data.
+	EmitSchema bool
+	// Append a line with the hash of all preceding data lines.
+	TrailingChecksum bool
+	// Size of the time slots
+	Granularity Granularity
+	// Max age of the newest record relative to now. 0 means no check.
+	MaxAge time.Duration
+	// Lines beginning with this prefix are skipped. Empty means disabled.
+	Comment string
+	// Omit the new line of the last output line.
+	TrimTrailingNewline bool
+	// Called with each finalized time slot, in addition to the output. Set by server mode.
+	OnSlot func(Slot)
+	// Name of the value column, for labeled multi column input with a header row.
+	// Empty means the fixed format.
+	ValueColumnName string
+	// Aggregation function of each time slot
+	Agg string
+	// On a mid-stream error, also emit the open time slot computed before the error.
+	PartialOutputOnError bool
+	// Round each timestamp to the nearest multiple of this before bucketing. 0 means disabled.
+	// So a jittery `00:59:59.8` lands in the next hour with 1s.
+	// Note a large value moves records across slot boundaries, e.g. `00:45:00` lands in the next hour with 1h.
+	RoundTo time.Duration
+	// Accumulate the sum and average with math/big instead of float64. Slow.
+	HighPrecision bool
+	// Number of leading lines to ignore, e.g. a descriptive first line.
+	SkipHeaderRows int
+	// Render a sparkline of the time slots to stderr after the run.
+	Graph bool
+	// Finer granularity the records are averaged in, before aggregated into the time slots.
+	// Reduces the weight of bursty periods. Zero value means disabled.
+	PreBucket Granularity
+	// Print how many time slots had each number of samples to stderr after the run.
+	CountDistribution bool
+	// Unit of the values, e.g. celsius. Metadata only, carried into the output so it's self-describing.
+	ValueUnit string
+	// Counters of the run, filled when non nil
+	Stats *Stats
+	// Fail when no record is aggregated, e.g. the response is empty. Otherwise, empty output.
+	FailOnEmpty bool
+	// Assert the records are in the fixed width format, and parse the values with the zero allocation fast path.
+	FixedWidth bool
+	// Print each record prefixed by its time slot instead of aggregating, to verify the bucketing.
+	Passthrough bool
+	// Omit the time slots of which the result is NaN
+	DropNaN bool
+	// Print NaN results as this instead, e.g. `null`. Empty means as is.
+	NaNAs string
+	// Index of the whitespace separated field holding the weight of each record, 0 being the timestamp.
+	// The time slots are the weighted average. 0 means unweighted.
+	WeightColumn int
+	// Affixes of each time slot line of the text output, e.g. a metric name. Not applied to the slot events.
+	LinePrefix string
+	LineSuffix string
+	// Thousands separator of the values stripped before parsing, e.g. `,` for `1,234.56`. 0 means disabled.
+	ThousandsSep byte
+	// Format of the output, one of text or jsonl. Others are written by the caller via OnSlot, e.g. parquet
+	Format string
+	// Drop the records out of the range [St, Ed], widened by the clock skew on both ends
+	EnforceRange bool
+	ClockSkew    time.Duration
+	// Lines of this separate the segments of the stream, each aggregated afresh. Empty means disabled.
+	ResetMarker string
+	// Output the number of records per second of each time slot, instead of the aggregated values
+	EmitRate bool
+	// Normalize every timestamp into UTC, e.g. with fractional seconds, so the time slots are labeled consistently.
+	// The ones of an offset, e.g. `+09:00`, are normalized regardless.
+	OutputUTC bool
+	// Shift the boundaries of the time slots by this, e.g. 30m for hours starting at :30. 0 means aligned.
+	WindowOffset time.Duration
+	// Output this quantile of each time slot, weighted by the weight column if any. NaN means disabled.
+	Quantile float64
+	// Output the values with as many decimals as the most precise input value of the first time slot, instead of Precision.
+	// Fixed from then on, so every line has the same decimals.
+	DetectPrecision bool
+	// Accept the records in any order of the time slots, buffering every slot until the end of the stream
+	Unordered bool
+	// Fail after the whole output is written if any warning is reported
+	FailOnWarnings bool
+	// Output every time slot of the range, with the fill value for the ones without records.
+	// A NaN fill value follows DropNaN and NaNAs as the NaN results do.
+	Fill      bool
+	FillValue string
+	// Append the number of records of each time slot to the text output, e.g. `(n=60)`.
+	// The other formats have the count anyway.
+	WithCount bool
+	// Fail on a malformed record of the fixed format. Otherwise, it's skipped and counted as a warning.
+	Strict bool
+	// Number of decimals of the output values
+	Precision int
+	// Format of the numbers of the text output, one of fixed, plain or raw. Raw ignores Precision.
+	NumberFormat string
+	// Drop the records of a timestamp already seen, e.g. replayed by the feed.
+	// Only the adjacent ones are caught unless Unordered, as the records are sorted.
+	// With Unordered, the timestamps of each time slot are held until it's tallied up.
+	Dedup bool
+	// Print the number of records read and the current time slot to stderr periodically
+	Progress bool
+	// Bounds of the values aggregated, inclusive. The records out of them are skipped. Infinite means unbounded.
+	MinValue float64
+	MaxValue float64
+	// Range and the number of the bins of AggHistogram. The range is inclusive, divided into the bins of equal width.
+	HistogramMin  float64
+	HistogramMax  float64
+	HistogramBins int
+	// Called with the error of each malformed record skipped, e.g. to report them.
+	// Set, the records of an invalid number are skipped as malformed as well, unless Strict.
+	OnMalformed func(error)
+	// Print the total number of records and time slots, the average of all the records and the elapsed time to stderr after the run
+	Summary bool
+	// Zero the timing dependent fields, e.g. the elapsed time of the summary, so the runs are byte comparable
+	Deterministic bool
+	// Also output the mean of the results of the last this many time slots. 0 means disabled.
+	Rolling int
+	// Output of the rolling mean until the window is full, one of partial or placeholder
+	RollingWarmup string
+	// Columns of the timestamp and the value of a custom layout, e.g. after an id column.
+	// nil means the one of the fixed format, the first and the second field.
+	TimestampColumn *Column
+	ValueColumn     *Column
+	// Aggregate only every this many records of each time slot, trading the accuracy for the speed. 1 means all.
+	SampleRate int
+	// Also tally the records in these granularities, each written to its own writer, with a single parse of the stream.
+	// Each output has the headers, time slot lines and trailer of its own. Not with Passthrough, SampleRate or CheckpointPath.
+	Rollups []Rollup
+}
+
+// Rollup is a granularity of Options.Rollups, and the writer of its output.
+type Rollup struct {
+	Granularity Granularity
+	W           io.Writer
+}
+
+// DefaultOptions returns the options of the hourly average of the fixed format.
+func DefaultOptions() Options {
+	return Options{
+		RecordSeparator: '\n',
+		Granularity:     GranularityHour,
+		Agg:             AggAvg,
+		Format:          FormatText,
+		Quantile:        math.NaN(),
+		FillValue:       "NaN",
+		Precision:       4,
+		NumberFormat:    NumberFormatFixed,
+		MinValue:        math.Inf(-1),
+		MaxValue:        math.Inf(1),
+		HistogramBins:   10,
+		RollingWarmup:   RollingWarmupPartial,
+		SampleRate:      1,
+	}
+}
+
+// Slot is a finalized time slot.
+type Slot struct {
+	Time  string  `json:"time"`
+	Avg   float64 `json:"avg"`
+	Count int     `json:"count"`
+	Unit  string  `json:"unit,omitempty"`
+	// Mean and standard deviation of the time slot, only with AggStddev
+	Mean   *float64 `json:"mean,omitempty"`
+	Stddev *float64 `json:"stddev,omitempty"`
+	// Counts of the bins of the time slot, only with AggHistogram
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Rolling mean up to the time slot, only with Options.Rolling
+	Rolling *float64 `json:"rolling,omitempty"`
+}
+
+// Stats is the counters of a run.
+type Stats struct {
+	// Number of records read, including the filtered
+	Records int `json:"records"`
+	// Number of lines skipped, e.g. header rows and comments
+	Skipped int `json:"skipped"`
+	// Number of records dropped, e.g. out of the range or the value bounds, or by the sample rate
+	Filtered int `json:"filtered"`
+	// Number of malformed records skipped
+	Malformed int `json:"malformed"`
+	// Number of duplicate records dropped by Dedup
+	Duplicates int `json:"duplicates"`
+	// Number of time slots output
+	Slots int `json:"slots"`
+	// Number of warnings reported, e.g. out of range records, malformed records and monotonic violations
+	Warnings int `json:"warnings"`
+}
@@ -0,0 +1,78 @@
+package aggregate
+
+import (
+	"bytes"
+)
+
+// Max number of digits parseFixedDecimal accepts, so that the mantissa is exact in float64
+const maxFixedDecimalDigits = 15
+
+var pow10 = [...]float64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15}
+
+// parseFixedDecimal parses a plain decimal such as ` 12.3400` without allocation.
+// Leading spaces and a sign are allowed, but exponents, special values and other forms are not,
+// in which case ok is false and the caller falls back to strconv.
+// The result is the same as strconv.ParseFloat of 64 bits, as both the mantissa and the power of 10 are exact.
+func parseFixedDecimal(b []byte) (v float64, ok bool) {
+	i := 0
+	for i < len(b) && b[i] == ' ' {
+		i++
+	}
+
+	neg := false
+	if i < len(b) && (b[i] == '-' || b[i] == '+') {
+		neg = b[i] == '-'
+		i++
+	}
+
+	var (
+		mantissa uint64
+		digits   int
+		frac     = -1
+	)
+	for ; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c >= '0' && c <= '9':
+			mantissa = mantissa*10 + uint64(c-'0')
+			digits++
+			if frac >= 0 {
+				frac++
+			}
+		case c == '.' && frac < 0:
+			frac = 0
+		default:
+			return 0, false
+		}
+	}
+	if digits == 0 || digits > maxFixedDecimalDigits {
+		return 0, false
+	}
+
+	// both are exact, so the division is correctly rounded
+	v = float64(mantissa)
+	if frac > 0 {
+		v /= pow10[frac]
+	}
+	if neg {
+		v = -v
+	}
+	return v, true
+}
+
+// fractionDigits returns the number of digits after the decimal point, e.g. 2 for ` 12.30`.
+// The exponent, if any, is not taken into account.
+func fractionDigits(b []byte) int {
+	i := bytes.IndexByte(b, '.')
+	if i < 0 {
+		return 0
+	}
+	n := 0
+	for _, c := range b[i+1:] {
+		if c < '0' || c > '9' {
+			break
+		}
+		n++
+	}
+	return n
+}
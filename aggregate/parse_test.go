@@ -0,0 +1,132 @@
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseFixedDecimal(t *testing.T) {
+	for _, s := range []string{"113.1652", " 12.3400", "-0.5", "+7", "123456789.123", "0.0001", "999999999999999"} {
+		want, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if got, ok := parseFixedDecimal([]byte(s)); !ok || got != want {
+			t.Errorf("parseFixedDecimal(%q) = %v, %v, want %v", s, got, ok, want)
+		}
+	}
+	for _, s := range []string{"", "1e3", "NaN", "1.2.3", "1,234", "1234567890123456"} {
+		if _, ok := parseFixedDecimal([]byte(s)); ok {
+			t.Errorf("parseFixedDecimal(%q) ok, want fallback", s)
+		}
+	}
+}
+
+// fixedRecords returns n records of the fixed format, one per second.
+func fixedRecords(n int) string {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "2021-03-04T%02d:%02d:%02dZ %8.4f\n", i/3600%24, i/60%60, i%60, float64(i%1000)/7-50)
+	}
+	return b.String()
+}
+
+// the fast path agrees with the flexible parser over the fixed format
+func TestFixedWidthMatchesFlexible(t *testing.T) {
+	input := fixedRecords(10000)
+	opts := DefaultOptions()
+	opts.Precision = 8
+	want := mustAggregate(t, opts, input)
+	opts.FixedWidth = true
+	if got := mustAggregate(t, opts, input); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, err := runAggregate(opts, "2021-03-04T03:00:00Z 1.5\n")
+	if err == nil || !strings.Contains(err.Error(), "unexpected record length(25)") {
+		t.Errorf("got %v, want the error of the variable width", err)
+	}
+}
+
+func BenchmarkParseValue(b *testing.B) {
+	value := []byte("113.1652")
+	b.Run("fixed", func(b *testing.B) {
+		for range b.N {
+			if _, ok := parseFixedDecimal(value); !ok {
+				b.Fatal("not parsed")
+			}
+		}
+	})
+	b.Run("flexible", func(b *testing.B) {
+		for range b.N {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRunFixedWidth(b *testing.B) {
+	input := fixedRecords(10000)
+	for _, fixed := range []bool{true, false} {
+		b.Run(fmt.Sprintf("fixed=%v", fixed), func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.FixedWidth = fixed
+			b.SetBytes(int64(len(input)))
+			for range b.N {
+				if err := NewAggregator(io.Discard, opts).Run(context.Background(), strings.NewReader(input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFractionDigits(t *testing.T) {
+	for input, want := range map[string]int{"1": 0, "1.": 0, "1.25": 2, "-0.123456": 6, "3.10 ": 2, "2.5e3": 1} {
+		if got := fractionDigits([]byte(input)); got != want {
+			t.Errorf("%q: got %d, want %d", input, got, want)
+		}
+	}
+}
+
+func TestDetectPrecision(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "2 decimals",
+			input: "2021-03-04T03:00:00Z 1.25\n2021-03-04T03:10:00Z 2.5\n",
+			want:  "2021-03-04T03:00:00Z     1.88\n",
+		},
+		{
+			name:  "6 decimals",
+			input: "2021-03-04T03:00:00Z 1.000001\n2021-03-04T03:10:00Z 2\n",
+			want:  "2021-03-04T03:00:00Z 1.500001\n",
+		},
+		{
+			// fixed by the first time slot, not widened by the first record of the next tallying it up
+			name:  "fixed",
+			input: "2021-03-04T03:00:00Z 1.25\n2021-03-04T04:00:00Z 2.123456\n2021-03-04T05:00:00Z 3\n",
+			want:  "2021-03-04T03:00:00Z     1.25\n2021-03-04T04:00:00Z     2.12\n2021-03-04T05:00:00Z     3.00\n",
+		},
+		{
+			// the whole first time slot is the window
+			name:  "first time slot",
+			input: "2021-03-04T03:00:00Z 1.5\n2021-03-04T03:10:00Z 2.124\n2021-03-04T04:00:00Z 3\n",
+			want:  "2021-03-04T03:00:00Z    1.812\n2021-03-04T04:00:00Z    3.000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.DetectPrecision = true
+			if got := mustAggregate(t, opts, tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
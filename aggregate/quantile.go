@@ -0,0 +1,92 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+)
+
+// Max number of points a quantile sketch holds before compressed. Exact up to this many records per time slot.
+const quantileSketchLimit = 4096
+
+type weightedPoint struct {
+	value  float64
+	weight float64
+}
+
+// quantileSketch estimates the weighted quantiles of a stream in bounded memory.
+// The points are kept as is until the limit, then merged into centroids of about equal weight.
+type quantileSketch struct {
+	points []weightedPoint
+}
+
+func (s *quantileSketch) add(value, weight float64) {
+	if weight == 0 {
+		return
+	}
+	s.points = append(s.points, weightedPoint{value, weight})
+	if len(s.points) >= quantileSketchLimit {
+		s.compress()
+	}
+}
+
+func (s *quantileSketch) reset() {
+	s.points = s.points[:0]
+}
+
+// compress merges adjacent points into half the limit of centroids, each the weighted mean of the merged.
+func (s *quantileSketch) compress() {
+	s.sort()
+
+	var total float64
+	for _, p := range s.points {
+		total += p.weight
+	}
+
+	var (
+		bins     = quantileSketchLimit / 2
+		binWidth = total / float64(bins)
+		merged   = s.points[:0]
+		cur      weightedPoint
+		sum      float64
+	)
+	for _, p := range s.points {
+		cur.weight += p.weight
+		sum += p.value * p.weight
+		if cur.weight >= binWidth {
+			cur.value = sum / cur.weight
+			merged = append(merged, cur)
+			cur, sum = weightedPoint{}, 0
+		}
+	}
+	if cur.weight > 0 {
+		cur.value = sum / cur.weight
+		merged = append(merged, cur)
+	}
+	s.points = merged
+}
+
+func (s *quantileSketch) sort() {
+	sort.Slice(s.points, func(i, j int) bool { return s.points[i].value < s.points[j].value })
+}
+
+// quantile returns the smallest value of which the cumulative weight reaches q of the total.
+// NaN if the total weight is zero.
+func (s *quantileSketch) quantile(q float64) float64 {
+	s.sort()
+
+	var total float64
+	for _, p := range s.points {
+		total += p.weight
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+
+	var cum float64
+	for _, p := range s.points {
+		if cum += p.weight; cum >= q*total {
+			return p.value
+		}
+	}
+	return s.points[len(s.points)-1].value
+}
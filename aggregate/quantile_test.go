@@ -0,0 +1,115 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuantileSketchExact(t *testing.T) {
+	// the weights skew the quantiles toward the heavier values
+	var s quantileSketch
+	for v := 1; v <= 4; v++ {
+		s.add(float64(v), float64(v))
+	}
+	s.add(100, 0)
+	for q, want := range map[float64]float64{0: 1, 0.1: 1, 0.3: 2, 0.5: 3, 0.6: 3, 0.61: 4, 1: 4} {
+		if got := s.quantile(q); got != want {
+			t.Errorf("q=%v: got %v, want %v", q, got, want)
+		}
+	}
+
+	s.reset()
+	if got := s.quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("got %v, want NaN of no weight", got)
+	}
+}
+
+func TestQuantileSketchWeighted(t *testing.T) {
+	// uniform values weighted by themselves, of which the CDF is v², so the quantile q is √q
+	var (
+		s   quantileSketch
+		rng = rand.New(rand.NewPCG(1, 2))
+	)
+	for range 100_000 {
+		v := rng.Float64()
+		s.add(v, v)
+	}
+	if len(s.points) >= quantileSketchLimit {
+		t.Fatalf("got %d points, want bounded by the limit", len(s.points))
+	}
+	for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.9, 0.99} {
+		if got, want := s.quantile(q), math.Sqrt(q); math.Abs(got-want) > 0.01 {
+			t.Errorf("q=%v: got %v, want %v within 0.01", q, got, want)
+		}
+	}
+}
+
+func TestWeightedQuantile(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Quantile = 0.5
+	opts.WeightColumn = 2
+	got := mustAggregate(t, opts, "2021-03-04T03:00:00Z 1 1\n2021-03-04T03:10:00Z 2 1\n2021-03-04T03:20:00Z 3 8\n2021-03-04T04:00:00Z 5 0\n2021-03-04T04:10:00Z 7 1\n")
+	if want := "2021-03-04T03:00:00Z   3.0000\n2021-03-04T04:00:00Z   7.0000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestQuantileSketchAgainstSort(t *testing.T) {
+	// exact while within the limit, then within 1% of the rank once compressed
+	for _, n := range []int{3000, 20_000} {
+		var (
+			s      quantileSketch
+			rng    = rand.New(rand.NewPCG(3, 4))
+			values = make([]float64, n)
+		)
+		for i := range values {
+			values[i] = rng.NormFloat64()*10 + 50
+			s.add(values[i], 1)
+		}
+		slices.Sort(values)
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			got := s.quantile(q)
+			rank := int(math.Ceil(q*float64(n))) - 1
+			if n < quantileSketchLimit {
+				if got != values[rank] {
+					t.Errorf("n=%d q=%v: got %v, want %v exactly", n, q, got, values[rank])
+				}
+				continue
+			}
+			tolerance := n / 100
+			if lo, hi := values[max(rank-tolerance, 0)], values[min(rank+tolerance, n-1)]; got < lo || got > hi {
+				t.Errorf("n=%d q=%v: got %v, want within %v - %v", n, q, got, lo, hi)
+			}
+		}
+	}
+}
+
+func TestPercentileAgg(t *testing.T) {
+	// 3000 records a second apart in the hour 03, and one in 04
+	var (
+		input  strings.Builder
+		rng    = rand.New(rand.NewPCG(5, 6))
+		values = make([]float64, 3000)
+		begin  = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+	)
+	for i := range values {
+		values[i] = math.Round(rng.ExpFloat64()*1000) / 100
+		fmt.Fprintf(&input, "%s %.2f\n", begin.Add(time.Duration(i)*time.Second).Format(time.RFC3339), values[i])
+	}
+	input.WriteString("2021-03-04T04:00:00Z 1.5\n")
+	slices.Sort(values)
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		opts := DefaultOptions()
+		opts.Quantile = q
+		want := fmt.Sprintf("2021-03-04T03:00:00Z %8.4f\n2021-03-04T04:00:00Z   1.5000\n", values[int(math.Ceil(q*3000))-1])
+		if got := mustAggregate(t, opts, input.String()); got != want {
+			t.Errorf("q=%v: got %q, want %q", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package aggregate
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordLayout locates the timestamp and the value within the records, as configured by the options.
+type recordLayout struct {
+	opts Options
+	// columns of the custom layout, the fixed format by default
+	custom             bool
+	stampCol, valueCol Column
+	// index of the field of Options.ValueColumnName, negative until the header is read
+	valueColumn int
+}
+
+func newRecordLayout(opts Options) recordLayout {
+	l := recordLayout{
+		opts:        opts,
+		custom:      opts.TimestampColumn != nil || opts.ValueColumn != nil,
+		stampCol:    Column{Field: 0},
+		valueCol:    Column{Field: 1},
+		valueColumn: -1,
+	}
+	if opts.TimestampColumn != nil {
+		l.stampCol = *opts.TimestampColumn
+	}
+	if opts.ValueColumn != nil {
+		l.valueCol = *opts.ValueColumn
+	}
+	return l
+}
+
+// split splits the record, including the separator, into the timestamp and the value.
+// The timestamp is as is, to be normalized into `YYYY-MM-DDTHH:MM:SSZ` if normalize.
+// line is the 1-based line number of the record, and final tells the record is the unterminated last one, for the error.
+// The error of a malformed record is skippable, unless Options.Strict.
+func (l *recordLayout) split(record []byte, line int, final bool) (stamp, value []byte, normalize, skippable bool, err error) {
+	n, opts := len(record), &l.opts
+	// a timestamp of an offset other than Z, e.g. `+09:00`, is normalized into UTC anyway
+	normalize = opts.RoundTo > 0 || opts.OutputUTC || (n > 20 && (record[19] == '+' || record[19] == '-'))
+	if l.custom {
+		// anything other than `YYYY-MM-DDTHH:MM:SSZ` at the timestamp column is normalized
+		stamp = l.stampCol.extract(record[:n-1])
+		normalize = opts.RoundTo > 0 || opts.OutputUTC || len(stamp) != 20 || stamp[19] != 'Z'
+	}
+	if opts.ValueColumnName != "" {
+		// labeled multi column input. The timestamp is the first column
+		// YYYY-MM-DDTHH:MM:SSZ 000.0000 000.0000 ...\n
+		if value = nthField(record[:n-1], l.valueColumn); n < 20 || value == nil {
+			err = fmt.Errorf("missing %s column. invalid data format: %s", opts.ValueColumnName, record)
+			return
+		}
+	} else if !l.custom && (normalize || opts.WeightColumn > 0) {
+		// the timestamp may have fractional seconds or an offset, or the weight follows, so the length varies
+		// YYYY-MM-DDTHH:MM:SS.sssZ 000.0000 [weight]\n
+		if value = nthField(record[:n-1], 1); value == nil {
+			err = fmt.Errorf("missing value. invalid data format: %s", record)
+			return
+		}
+	} else if opts.FixedWidth {
+		// asserted to be fixed width. To confirm this, just check the length.
+		// YYYY-MM-DDTHH:MM:SSZ 000.0000\n
+		if n != recordLength {
+			err = fmt.Errorf("unexpected record length(%d). invalid data format: %s", n, record)
+			if final {
+				err = fmt.Errorf("truncated final record: %s", record[:n-1])
+			}
+			return
+		}
+		value = record[21:29]
+	} else {
+		// the value follows the timestamp after whitespace, in any width, unless the columns are given
+		// YYYY-MM-DDTHH:MM:SSZ -3.2\n
+		if l.custom {
+			value = l.valueCol.extract(record[:n-1])
+			err = validateColumns(stamp, value, record[:n-1], line)
+		} else if err = validateRecord(record[:n-1], line); err == nil {
+			value = bytes.TrimSpace(record[20 : n-1])
+		}
+		if err != nil {
+			skippable = true
+			if final {
+				// likely cut off rather than malformed, so never skipped
+				err, skippable = fmt.Errorf("truncated final record at line %d: %s", line, record[:n-1]), false
+			}
+			return
+		}
+	}
+
+	// the timestamp `YYYY-MM-DDTHH:MM:SSZ`, unless normalized
+	switch {
+	case l.custom:
+	case normalize:
+		stamp = nthField(record[:n-1], 0)
+	default:
+		stamp = record[:20]
+	}
+	return
+}
+
+// recordParser parses the records into the timestamps and the values, skipping the records the options exclude.
+// The parsed record refers to the scratch buffers, so it's valid until the next record.
+type recordParser struct {
+	opts   *Options
+	layout recordLayout
+	counts *counts
+	// bounds of Options.EnforceRange, nil if not enforced
+	rangeFrom, rangeTo []byte
+	// the last timestamp of Options.Dedup, or the timestamps seen of each open time slot if unordered,
+	// by the rest of the timestamp after the slot key
+	lastStamp  []byte
+	seenStamps map[string]map[string]struct{}
+	// the time slot of Options.SampleRate and the number of its records so far
+	sampleSlot []byte
+	sampleSeq  int
+	// the newest timestamp, of Options.MaxAge
+	newest [20]byte
+	// scratch of the normalized timestamps, the stripped value and the exact value
+	roundedStamp, shiftedStamp, stripped []byte
+	bigScore                             *big.Float
+}
+
+// parsedRecord is a record parsed by recordParser.
+type parsedRecord struct {
+	// the record as is, including the separator
+	record []byte
+	// the timestamp in UTC, shifted by Options.WindowOffset, and its time slot key
+	stamp, timeSlot []byte
+	score, weight   float64
+	// the exact score of Options.HighPrecision, nil otherwise
+	bigScore *big.Float
+	// digits after the decimal point of the value as written
+	decimals int
+}
+
+func newRecordParser(opts *Options, c *counts) recordParser {
+	p := recordParser{
+		opts:         opts,
+		layout:       newRecordLayout(*opts),
+		counts:       c,
+		roundedStamp: make([]byte, 0, len(time.RFC3339)),
+		shiftedStamp: make([]byte, 0, len(time.RFC3339)),
+	}
+	if opts.EnforceRange {
+		// compared with the timestamps as is, as RFC3339 in UTC is ordered lexicographically
+		p.rangeFrom = []byte(opts.St.Add(-opts.ClockSkew).UTC().Format(time.RFC3339))
+		p.rangeTo = []byte(opts.Ed.Add(opts.ClockSkew).UTC().Format(time.RFC3339))
+	}
+	if opts.Unordered && opts.Dedup {
+		// the duplicates are not adjacent
+		p.seenStamps = make(map[string]map[string]struct{})
+	}
+	if opts.HighPrecision {
+		p.bigScore = new(big.Float).SetPrec(highPrecisionBits)
+	}
+	return p
+}
+
+// parse parses the record, including the separator. line is the 1-based line number of the record,
+// and final tells the record is the unterminated last one, for the error.
+// ok is false if the record is skipped, counted by the reason.
+func (p *recordParser) parse(record []byte, line int, final bool) (rec parsedRecord, ok bool, err error) {
+	opts, n := p.opts, len(record)
+	stamp, value, normalize, skippable, err := p.layout.split(record, line, final)
+	if err != nil {
+		if !skippable || opts.Strict {
+			return
+		}
+		if opts.OnMalformed != nil {
+			opts.OnMalformed(err)
+		}
+		p.counts.Malformed++
+		return rec, false, nil
+	}
+	if normalize {
+		// normalized into UTC, even without the rounding
+		if stamp, err = roundTimestamp(p.roundedStamp[:0], stamp, opts.RoundTo); err != nil {
+			return
+		}
+	}
+
+	// extract the slot key part. e.g. `YYYY-MM-DDTHH` for hour
+	keyWidth := opts.Granularity.KeyWidth
+	timeSlot := stamp[:keyWidth]
+	if p.rangeFrom != nil && (bytes.Compare(stamp, p.rangeFrom) < 0 || bytes.Compare(stamp, p.rangeTo) > 0) {
+		// out of the range, even with the clock skew
+		p.counts.Filtered++
+		return
+	}
+	if opts.Dedup && p.duplicate(stamp) {
+		p.counts.Duplicates++
+		return
+	}
+	// RFC3339 timestamps in UTC are ordered lexicographically
+	if opts.MaxAge > 0 && bytes.Compare(stamp, p.newest[:]) > 0 {
+		copy(p.newest[:], stamp)
+	}
+	if opts.WindowOffset > 0 {
+		// shift back by the offset, so that the slot key is the prefix as usual. labeled by shifting forth
+		if stamp, err = shiftTimestamp(p.shiftedStamp[:0], stamp, -opts.WindowOffset); err != nil {
+			return
+		}
+		timeSlot = stamp[:keyWidth]
+	}
+	if opts.SampleRate > 1 && !p.sample(timeSlot) {
+		p.counts.SampledOut++
+		return
+	}
+	if opts.ThousandsSep != 0 && bytes.IndexByte(value, opts.ThousandsSep) >= 0 {
+		// strip into the scratch, as the buffer is the record itself
+		p.stripped = p.stripped[:0]
+		for _, c := range value {
+			if c != opts.ThousandsSep {
+				p.stripped = append(p.stripped, c)
+			}
+		}
+		value = p.stripped
+	}
+
+	// extract the number
+	rec = parsedRecord{record: record, stamp: stamp, timeSlot: timeSlot, weight: 1}
+	var parsed bool
+	if opts.FixedWidth {
+		rec.score, parsed = parseFixedDecimal(value)
+	}
+	if !parsed {
+		if rec.score, err = strconv.ParseFloat(strings.TrimSpace(string(value)), 64); err != nil {
+			if opts.OnMalformed != nil && !opts.Strict {
+				// reported as malformed rather than failing the run
+				opts.OnMalformed(fmt.Errorf("line %d: invalid value. invalid data format: %s", line, record[:n-1]))
+				p.counts.Malformed++
+				return parsedRecord{}, false, nil
+			}
+			err = fmt.Errorf("parse error: %w", err)
+			return
+		}
+	}
+	if opts.DetectPrecision {
+		rec.decimals = fractionDigits(value)
+	}
+	if opts.WeightColumn > 0 {
+		field := nthField(record[:n-1], opts.WeightColumn)
+		if field == nil {
+			err = fmt.Errorf("missing weight column. invalid data format: %s", record)
+			return
+		}
+		if rec.weight, err = strconv.ParseFloat(string(field), 64); err != nil || rec.weight < 0 {
+			err = fmt.Errorf("invalid weight: %s, must be a non-negative number", field)
+			return
+		}
+	}
+	if p.bigScore != nil {
+		// parse again, as the float above has lost the precision
+		if _, valid := p.bigScore.SetString(strings.TrimSpace(string(value))); !valid {
+			err = fmt.Errorf("parse error: invalid number: %s", value)
+			return
+		}
+		rec.bigScore = p.bigScore
+	}
+
+	if rec.score < opts.MinValue || rec.score > opts.MaxValue {
+		// excluded as if absent, so not counted in the time slot
+		p.counts.OutOfBounds++
+		return parsedRecord{}, false, nil
+	}
+	return rec, true, nil
+}
+
+// duplicate tells whether the timestamp is a duplicate of Options.Dedup.
+// The timestamp implies the time slot, so the same timestamp is a duplicate within the time slot.
+func (p *recordParser) duplicate(stamp []byte) bool {
+	if p.seenStamps != nil {
+		width := p.opts.Granularity.KeyWidth
+		seen := p.seenStamps[string(stamp[:width])]
+		if seen == nil {
+			seen = make(map[string]struct{})
+			p.seenStamps[string(stamp[:width])] = seen
+		}
+		if _, ok := seen[string(stamp[width:])]; ok {
+			return true
+		}
+		seen[string(stamp[width:])] = struct{}{}
+		return false
+	}
+	if bytes.Equal(stamp, p.lastStamp) {
+		return true
+	}
+	p.lastStamp = append(p.lastStamp[:0], stamp...)
+	return false
+}
+
+// forgetStamps forgets the timestamps seen of the unordered time slots, as they are tallied up.
+func (p *recordParser) forgetStamps() {
+	clear(p.seenStamps)
+}
+
+// sample tells whether the record of the time slot is kept by Options.SampleRate.
+// Every Nth record of each time slot from its first, so no time slot is lost. Skipped before parsing the value.
+func (p *recordParser) sample(timeSlot []byte) bool {
+	if !bytes.Equal(timeSlot, p.sampleSlot) {
+		p.sampleSlot = append(p.sampleSlot[:0], timeSlot...)
+		p.sampleSeq = 0
+	}
+	p.sampleSeq++
+	return (p.sampleSeq-1)%p.opts.SampleRate == 0
+}
+
+// roundTimestamp rounds the RFC3339 timestamp to the nearest multiple of d, unless d is 0,
+// then appends it to dst in UTC without fractional seconds. i.e. `YYYY-MM-DDTHH:MM:SSZ`
+func roundTimestamp(dst, timestamp []byte, d time.Duration) ([]byte, error) {
+	ts, err := time.Parse(time.RFC3339, string(timestamp))
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s, err: %w", timestamp, err)
+	}
+	return ts.Round(d).UTC().AppendFormat(dst, time.RFC3339), nil
+}
+
+// shiftTimestamp shifts the RFC3339 timestamp by d, then appends it to dst in UTC. i.e. `YYYY-MM-DDTHH:MM:SSZ`
+func shiftTimestamp(dst, timestamp []byte, d time.Duration) ([]byte, error) {
+	ts, err := time.Parse(time.RFC3339, string(timestamp))
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s, err: %w", timestamp, err)
+	}
+	return ts.Add(d).UTC().AppendFormat(dst, time.RFC3339), nil
+}
+
+// validateRecord validates the record of the fixed format, excluding the separator.
+// line is the 1-based line number of the record, for the error.
+//
+//	YYYY-MM-DDTHH:MM:SSZ <value>
+func validateRecord(record []byte, line int) error {
+	switch {
+	case len(record) < 22:
+		return fmt.Errorf("line %d: too short record(%d bytes). invalid data format: %s", line, len(record), record)
+	case record[20] != ' ' && record[20] != '\t':
+		return fmt.Errorf("line %d: missing separator after the timestamp. invalid data format: %s", line, record)
+	case len(bytes.TrimSpace(record[20:])) == 0:
+		return fmt.Errorf("line %d: missing value after the timestamp. invalid data format: %s", line, record)
+	}
+	if _, err := time.Parse(time.RFC3339, string(record[:20])); err != nil {
+		return fmt.Errorf("line %d: invalid timestamp. invalid data format: %s", line, record)
+	}
+	return nil
+}
+
+// findColumn returns the index of the named column in the whitespace separated header.
+func findColumn(header []byte, name string) (int, error) {
+	for i, field := range bytes.Fields(header) {
+		if string(field) != name {
+			continue
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("value column %q is the timestamp column", name)
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("value column %q not found in the header: %s", name, header)
+}
+
+// nthField returns the n-th(0-based) whitespace separated field of the record, or nil if absent.
+// Unlike bytes.Fields, doesn't allocate.
+func nthField(record []byte, n int) []byte {
+	isSpace := func(b byte) bool { return b == ' ' || b == '\t' || b == '\r' }
+	for i := 0; ; n-- {
+		// skip leading spaces
+		for i < len(record) && isSpace(record[i]) {
+			i++
+		}
+		if i == len(record) {
+			return nil
+		}
+
+		j := i
+		for j < len(record) && !isSpace(record[j]) {
+			j++
+		}
+		if n == 0 {
+			return record[i:j]
+		}
+		i = j
+	}
+}
+
+// checkFreshness makes sure the newest record is no older than maxAge relative to now.
+func checkFreshness(newest [20]byte, maxAge time.Duration) error {
+	if newest == [20]byte{} {
+		return fmt.Errorf("stale data: no record found")
+	}
+
+	ts, err := time.Parse(time.RFC3339, string(newest[:]))
+	if err != nil {
+		return fmt.Errorf("failed to parse the newest timestamp: %w", err)
+	}
+
+	if age := now().Sub(ts); age > maxAge {
+		return fmt.Errorf("stale data: the newest record(%s) is %s old, exceeds max age %s", newest, age.Truncate(time.Second), maxAge)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package aggregate
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordLayoutSplit(t *testing.T) {
+	column := func(s string) *Column {
+		c, err := ParseColumn(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &c
+	}
+	tests := []struct {
+		name      string
+		opts      func(*Options)
+		record    string
+		final     bool
+		stamp     string
+		value     string
+		normalize bool
+		err       string
+		skippable bool
+	}{
+		{name: "fixed", record: "2021-03-04T03:00:00Z 113.1652\n", stamp: "2021-03-04T03:00:00Z", value: "113.1652"},
+		{name: "variable width", record: "2021-03-04T03:00:00Z\t-3.2 \n", stamp: "2021-03-04T03:00:00Z", value: "-3.2"},
+		{name: "offset", record: "2021-03-04T12:00:00+09:00 1.5\n", stamp: "2021-03-04T12:00:00+09:00", value: "1.5", normalize: true},
+		{name: "output utc", opts: func(o *Options) { o.OutputUTC = true }, record: "2021-03-04T03:00:00Z 1.5\n", stamp: "2021-03-04T03:00:00Z", value: "1.5", normalize: true},
+		{name: "weight", opts: func(o *Options) { o.WeightColumn = 2 }, record: "2021-03-04T03:00:00Z 1.5 2\n", stamp: "2021-03-04T03:00:00Z", value: "1.5"},
+		{name: "fixed width", opts: func(o *Options) { o.FixedWidth = true }, record: "2021-03-04T03:00:00Z 113.1652\n", stamp: "2021-03-04T03:00:00Z", value: "113.1652"},
+		{name: "fixed width of wrong length", opts: func(o *Options) { o.FixedWidth = true }, record: "2021-03-04T03:00:00Z 1.5\n", err: "unexpected record length(25)"},
+		{name: "fixed width truncated", opts: func(o *Options) { o.FixedWidth = true }, record: "2021-03-04T03:00:00Z 1.5\n", final: true, err: "truncated final record: "},
+		{name: "custom columns", opts: func(o *Options) { o.TimestampColumn, o.ValueColumn = column("2"), column("0") }, record: "1.5 host 2021-03-04T03:00:00Z\n", stamp: "2021-03-04T03:00:00Z", value: "1.5"},
+		{name: "custom byte range", opts: func(o *Options) { o.ValueColumn = column("21:25") }, record: "2021-03-04T03:00:00Z 1.5 9\n", stamp: "2021-03-04T03:00:00Z", value: "1.5"},
+		{name: "custom fractional seconds", opts: func(o *Options) { o.TimestampColumn = column("0") }, record: "2021-03-04T03:00:00.5Z 1.5\n", stamp: "2021-03-04T03:00:00.5Z", value: "1.5", normalize: true},
+		{name: "custom missing value", opts: func(o *Options) { o.ValueColumn = column("3") }, record: "2021-03-04T03:00:00Z 1.5\n", err: "line 7: missing value column", skippable: true},
+		{name: "malformed", record: "garbage\n", err: "line 7: too short record", skippable: true},
+		{name: "invalid timestamp", record: "2021-13-04T03:00:00Z 1.5\n", err: "line 7: invalid timestamp", skippable: true},
+		{name: "truncated", record: "2021-03-04T03:00\n", final: true, err: "truncated final record at line 7: 2021-03-04T03:00"},
+		{name: "missing value", opts: func(o *Options) { o.RoundTo = time.Minute }, record: "2021-03-04T03:00:00Z\n", err: "missing value. invalid data format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			layout := newRecordLayout(opts)
+			stamp, value, normalize, skippable, err := layout.split([]byte(tt.record), 7, tt.final)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				if skippable != tt.skippable {
+					t.Errorf("got skippable %v, want %v", skippable, tt.skippable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(stamp) != tt.stamp || string(value) != tt.value || normalize != tt.normalize {
+				t.Errorf("got %q, %q, %v, want %q, %q, %v", stamp, value, normalize, tt.stamp, tt.value, tt.normalize)
+			}
+		})
+	}
+}
+
+func TestRecordLayoutSplitValueColumnName(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueColumnName = "temp"
+	layout := newRecordLayout(opts)
+	layout.valueColumn = 2
+
+	_, value, _, _, err := layout.split([]byte("2021-03-04T03:00:00Z 1.5 20.25\n"), 2, false)
+	if err != nil || string(value) != "20.25" {
+		t.Errorf("got %q, %v, want 20.25", value, err)
+	}
+	if _, _, _, _, err = layout.split([]byte("2021-03-04T03:00:00Z 1.5\n"), 3, false); err == nil || !strings.Contains(err.Error(), "missing temp column") {
+		t.Errorf("got error %v, want the missing column", err)
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	// jittered around the boundary of 04:00
+	input := "2021-03-04T03:00:00Z 1\n2021-03-04T03:59:59.8Z 2\n2021-03-04T04:00:00.3Z 4\n2021-03-04T04:10:00Z 6\n"
+	tests := []struct {
+		roundTo time.Duration
+		want    string
+	}{
+		{roundTo: time.Second, want: "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   4.0000\n"},
+		// 03:00 and 04:00 both within the half of 10 minutes
+		{roundTo: 10 * time.Minute, want: "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   4.0000\n"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.RoundTo = tt.roundTo
+		if got := mustAggregate(t, opts, input); got != tt.want {
+			t.Errorf("round to %s: got %q, want %q", tt.roundTo, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTimestamp(t *testing.T) {
+	tests := []struct {
+		stamp string
+		d     time.Duration
+		want  string
+	}{
+		{stamp: "2021-03-04T00:59:59.8Z", d: time.Second, want: "2021-03-04T01:00:00Z"},
+		{stamp: "2021-03-04T00:59:59.2Z", d: time.Second, want: "2021-03-04T00:59:59Z"},
+		{stamp: "2021-03-04T00:59:59.8Z", d: 0, want: "2021-03-04T00:59:59Z"},
+		{stamp: "2021-03-04T09:59:59.8+09:00", d: time.Second, want: "2021-03-04T01:00:00Z"},
+		{stamp: "2021-03-04T00:44:59Z", d: time.Hour, want: "2021-03-04T01:00:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := roundTimestamp(nil, []byte(tt.stamp), tt.d)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("roundTimestamp(%s, %s) = %s, %v, want %s", tt.stamp, tt.d, got, err, tt.want)
+		}
+	}
+	if _, err := roundTimestamp(nil, []byte("2021-03-04 00:59"), time.Second); err == nil {
+		t.Error("want the error of the invalid timestamp")
+	}
+}
+
+func TestValidateRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		err    string
+	}{
+		{record: "2021-03-04T03:00:00Z 113.1652"},
+		{record: "2021-03-04T03:00:00Z\t1"},
+		{record: "2021-03-04T03:00", err: "line 3: too short record(16 bytes). invalid data format: 2021-03-04T03:00"},
+		{record: "", err: "line 3: too short record(0 bytes)"},
+		{record: "2021-03-04T03:00:00Z113.1652", err: "line 3: missing separator after the timestamp. invalid data format: 2021-03-04T03:00:00Z113.1652"},
+		{record: "2021-03-04T03:00:00Z    ", err: "line 3: missing value after the timestamp"},
+		{record: "2021-03-04 03:00:00Z 113.1652", err: "line 3: invalid timestamp"},
+		{record: "2021-02-30T03:00:00Z 113.1652", err: "line 3: invalid timestamp. invalid data format: 2021-02-30T03:00:00Z 113.1652"},
+		{record: "2021-03-04T03:00:00+0 113.1652", err: "line 3: missing separator after the timestamp"},
+		{record: "2021-03-04T25:00:00Z 113.1652", err: "line 3: invalid timestamp"},
+	}
+	for _, tt := range tests {
+		err := validateRecord([]byte(tt.record), 3)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%q: got %v, want %q", tt.record, err, tt.err)
+		}
+	}
+}
+
+func TestRecordParser(t *testing.T) {
+	begin := time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		opts   func(*Options)
+		record string
+		// the time slot and the score, empty if skipped
+		timeSlot string
+		score    float64
+		counts   counts
+		err      string
+	}{
+		{name: "fixed", record: "2021-03-04T03:10:00Z 113.1652\n", timeSlot: "2021-03-04T03", score: 113.1652},
+		{name: "offset", record: "2021-03-04T12:10:00+09:00 1.5\n", timeSlot: "2021-03-04T03", score: 1.5},
+		{name: "window offset", opts: func(o *Options) { o.WindowOffset = 15 * time.Minute }, record: "2021-03-04T03:10:00Z 1.5\n", timeSlot: "2021-03-04T02", score: 1.5},
+		{name: "thousands sep", opts: func(o *Options) { o.ThousandsSep = ',' }, record: "2021-03-04T03:10:00Z 1,234.5\n", timeSlot: "2021-03-04T03", score: 1234.5},
+		{name: "out of range", opts: func(o *Options) { o.EnforceRange = true }, record: "2021-03-04T05:10:00Z 1.5\n", counts: counts{Filtered: 1}},
+		{name: "out of bounds", opts: func(o *Options) { o.MaxValue = 1 }, record: "2021-03-04T03:10:00Z 1.5\n", counts: counts{OutOfBounds: 1}},
+		{name: "malformed", record: "garbage\n", counts: counts{Malformed: 1}},
+		{name: "malformed strict", opts: func(o *Options) { o.Strict = true }, record: "garbage\n", err: "line 7: too short record"},
+		{name: "invalid value", record: "2021-03-04T03:10:00Z one\n", err: "parse error"},
+		{name: "invalid value reported", opts: func(o *Options) { o.OnMalformed = func(error) {} }, record: "2021-03-04T03:10:00Z one\n", counts: counts{Malformed: 1}},
+		{name: "invalid weight", opts: func(o *Options) { o.WeightColumn = 2 }, record: "2021-03-04T03:10:00Z 1.5 -1\n", err: "invalid weight: -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.St, opts.Ed = begin, begin.Add(time.Hour)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			var c counts
+			p := newRecordParser(&opts, &c)
+			rec, ok, err := p.parse([]byte(tt.record), 7, false)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != (tt.timeSlot != "") || string(rec.timeSlot) != tt.timeSlot || rec.score != tt.score || c != tt.counts {
+				t.Errorf("got %v, %q, %v, %+v, want %q, %v, %+v", ok, rec.timeSlot, rec.score, c, tt.timeSlot, tt.score, tt.counts)
+			}
+		})
+	}
+}
+
+func TestRecordParserDedupAndSample(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dedup, opts.SampleRate = true, 2
+	var c counts
+	p := newRecordParser(&opts, &c)
+	var kept []string
+	for _, record := range []string{
+		"2021-03-04T03:00:00Z 1\n",
+		"2021-03-04T03:00:00Z 1\n",
+		"2021-03-04T03:10:00Z 2\n",
+		"2021-03-04T03:20:00Z 3\n",
+		// the sequence starts over in the next time slot
+		"2021-03-04T04:00:00Z 4\n",
+		"2021-03-04T04:10:00Z 5\n",
+	} {
+		rec, ok, err := p.parse([]byte(record), 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			kept = append(kept, string(rec.stamp))
+		}
+	}
+	if want := []string{"2021-03-04T03:00:00Z", "2021-03-04T03:20:00Z", "2021-03-04T04:00:00Z"}; strings.Join(kept, ",") != strings.Join(want, ",") || c.Duplicates != 1 || c.SampledOut != 2 {
+		t.Errorf("got %v, %+v, want %v", kept, c, want)
+	}
+}
+
+func TestRecordParserDedupUnordered(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dedup, opts.Unordered = true, true
+	var c counts
+	p := newRecordParser(&opts, &c)
+	parse := func(records ...string) {
+		t.Helper()
+		for _, record := range records {
+			if _, _, err := p.parse([]byte(record), 1, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	parse("2021-03-04T03:00:00Z 1\n", "2021-03-04T04:00:00Z 4\n", "2021-03-04T03:10:00Z 2\n", "2021-03-04T03:00:00Z 1\n")
+	if c.Duplicates != 1 || len(p.seenStamps) != 2 || len(p.seenStamps["2021-03-04T03"]) != 2 {
+		t.Errorf("got %d duplicates, %v, want 1 and the 2 time slots", c.Duplicates, p.seenStamps)
+	}
+
+	// tallied up, so the timestamps are forgotten
+	p.forgetStamps()
+	parse("2021-03-04T03:00:00Z 1\n")
+	if c.Duplicates != 1 || len(p.seenStamps) != 1 {
+		t.Errorf("got %d duplicates, %v, want 1 and the time slot of the record", c.Duplicates, p.seenStamps)
+	}
+}
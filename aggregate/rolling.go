@@ -0,0 +1,44 @@
+package aggregate
+
+import "slices"
+
+// Behaviors of Options.RollingWarmup, until Options.Rolling time slots are seen
+const (
+	// the mean of the time slots seen so far
+	RollingWarmupPartial = "partial"
+	// NaN, as the window is incomplete
+	RollingWarmupPlaceholder = "placeholder"
+)
+
+// rollingWindow is the ring buffer of the results of the last time slots.
+type rollingWindow struct {
+	values []float64
+	next   int
+	seen   int
+}
+
+func newRollingWindow(size int) *rollingWindow {
+	return &rollingWindow{values: make([]float64, size)}
+}
+
+// push adds the result of a time slot, then returns the mean of the window and whether the window is full.
+// The mean is recomputed from the window rather than kept running, so the errors don't accumulate.
+func (r *rollingWindow) push(value float64) (mean float64, full bool) {
+	r.values[r.next] = value
+	r.next = (r.next + 1) % len(r.values)
+	r.seen = min(r.seen+1, len(r.values))
+
+	var sum float64
+	for _, v := range r.values[:r.seen] {
+		sum += v
+	}
+	return sum / float64(r.seen), r.seen == len(r.values)
+}
+
+// recent returns the results in the window, the oldest first.
+func (r *rollingWindow) recent() []float64 {
+	if r.seen < len(r.values) {
+		return slices.Clone(r.values[:r.seen])
+	}
+	return append(slices.Clone(r.values[r.next:]), r.values[:r.next]...)
+}
@@ -0,0 +1,70 @@
+package aggregate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRollingWindow(t *testing.T) {
+	r := newRollingWindow(3)
+	// the mean of the seen until full, then of the last 3
+	for i, want := range []struct {
+		mean float64
+		full bool
+	}{{1, false}, {1.5, false}, {2, true}, {3, true}, {4, true}} {
+		if mean, full := r.push(float64(i + 1)); mean != want.mean || full != want.full {
+			t.Errorf("push %d: got %v, %v, want %v, %v", i+1, mean, full, want.mean, want.full)
+		}
+	}
+}
+
+func TestRolling(t *testing.T) {
+	// the hourly averages are 1, 2, 3, 6 and 8
+	const input = "2021-03-04T00:00:00Z 1\n2021-03-04T01:00:00Z 1\n2021-03-04T01:30:00Z 3\n2021-03-04T02:00:00Z 3\n" +
+		"2021-03-04T03:00:00Z 6\n2021-03-04T04:00:00Z 8\n"
+	tests := []struct {
+		name   string
+		warmup string
+		format string
+		want   string
+	}{
+		{
+			name: "partial", warmup: RollingWarmupPartial, format: FormatText,
+			// 1, (1+2)/2, then (1+2+3)/3, (2+3+6)/3 and (3+6+8)/3
+			want: "2021-03-04T00:00:00Z   1.0000   1.0000\n2021-03-04T01:00:00Z   2.0000   1.5000\n2021-03-04T02:00:00Z   3.0000   2.0000\n" +
+				"2021-03-04T03:00:00Z   6.0000   3.6667\n2021-03-04T04:00:00Z   8.0000   5.6667\n",
+		},
+		{
+			name: "placeholder", warmup: RollingWarmupPlaceholder, format: FormatText,
+			want: "2021-03-04T00:00:00Z   1.0000      NaN\n2021-03-04T01:00:00Z   2.0000      NaN\n2021-03-04T02:00:00Z   3.0000   2.0000\n" +
+				"2021-03-04T03:00:00Z   6.0000   3.6667\n2021-03-04T04:00:00Z   8.0000   5.6667\n",
+		},
+		{
+			name: "placeholder jsonl", warmup: RollingWarmupPlaceholder, format: FormatJSONL,
+			want: `{"time":"2021-03-04T00:00:00Z","avg":1.0000,"count":1,"rolling":null}` + "\n" +
+				`{"time":"2021-03-04T01:00:00Z","avg":2.0000,"count":2,"rolling":null}` + "\n" +
+				`{"time":"2021-03-04T02:00:00Z","avg":3.0000,"count":1,"rolling":2.0000}` + "\n" +
+				`{"time":"2021-03-04T03:00:00Z","avg":6.0000,"count":1,"rolling":3.6667}` + "\n" +
+				`{"time":"2021-03-04T04:00:00Z","avg":8.0000,"count":1,"rolling":5.6667}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Rolling, opts.RollingWarmup, opts.Format = 3, tt.warmup, tt.format
+			if got := mustAggregate(t, opts, input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollingWindowRecent(t *testing.T) {
+	r := newRollingWindow(3)
+	for i, want := range [][]float64{{1}, {1, 2}, {1, 2, 3}, {2, 3, 4}, {3, 4, 5}} {
+		r.push(float64(i + 1))
+		if got := r.recent(); !slices.Equal(got, want) {
+			t.Errorf("push %d: got %v, want %v", i+1, got, want)
+		}
+	}
+}
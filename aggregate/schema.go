@@ -0,0 +1,59 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// schemaColumn describes a column of the output lines.
+type schemaColumn struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Format string `json:"format,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+}
+
+// outputColumns returns the columns of each output line, in order.
+// Keep this in sync with the formatting in Run.
+func outputColumns(opts Options) []schemaColumn {
+	value := schemaColumn{Name: opts.Agg, Type: "float64", Unit: opts.ValueUnit}
+	if !math.IsNaN(opts.Quantile) {
+		value.Name = fmt.Sprintf("q%g", opts.Quantile)
+	}
+	if opts.Agg == AggHistogram && math.IsNaN(opts.Quantile) {
+		value = schemaColumn{Name: "histogram", Type: "string", Format: "under [bins...] over"}
+	}
+	if opts.EmitRate {
+		value = schemaColumn{Name: "rate", Type: "float64", Unit: "1/s"}
+	}
+	columns := []schemaColumn{
+		{Name: "time", Type: "timestamp", Format: "RFC3339"},
+		value,
+	}
+	if opts.Rolling > 0 {
+		columns = append(columns, schemaColumn{Name: fmt.Sprintf("rolling%d", opts.Rolling), Type: "float64", Unit: value.Unit})
+	}
+	if opts.WithCount {
+		columns = append(columns, schemaColumn{Name: "count", Type: "int64", Format: "(n=%d)"})
+	}
+	return columns
+}
+
+// writeSchema writes the schema as a comment line, so that it's easily skipped by consumers.
+//
+//	# schema: {"columns":[{"name":"time",...},...]}
+func writeSchema(w io.Writer, opts Options) error {
+	data, err := json.Marshal(struct {
+		Columns []schemaColumn `json:"columns"`
+	}{outputColumns(opts)})
+	if err != nil {
+		return fmt.Errorf("failed to encode schema: %w", err)
+	}
+
+	if _, err = fmt.Fprintf(w, "# schema: %s\n", data); err != nil {
+		return fmt.Errorf("failed to write schema: %w", err)
+	}
+	return nil
+}
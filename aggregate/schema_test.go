@@ -0,0 +1,52 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// the schema has a column for each field of the data lines
+func TestEmitSchema(t *testing.T) {
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n"
+	tests := []struct {
+		name string
+		opts func(*Options)
+		want []string
+	}{
+		{name: "avg", want: []string{"time", "avg"}},
+		{name: "geomean", opts: func(o *Options) { o.Agg = AggGeomean }, want: []string{"time", "geomean"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.EmitSchema = true
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			lines := strings.Split(strings.TrimSuffix(mustAggregate(t, opts, input), "\n"), "\n")
+			header, ok := strings.CutPrefix(lines[0], "# schema: ")
+			if !ok {
+				t.Fatalf("got first line %q, want the schema", lines[0])
+			}
+			var schema struct {
+				Columns []schemaColumn `json:"columns"`
+			}
+			if err := json.Unmarshal([]byte(header), &schema); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, c := range schema.Columns {
+				names = append(names, c.Name)
+			}
+			if strings.Join(names, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got columns %v, want %v", names, tt.want)
+			}
+			for _, line := range lines[1:] {
+				if fields := strings.Fields(line); len(fields) != len(names) {
+					t.Errorf("got %d fields of %q, want %d", len(fields), line, len(names))
+				}
+			}
+		})
+	}
+}
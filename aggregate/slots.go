@@ -0,0 +1,362 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"maps"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+)
+
+// slotWriter tallies up the values into the time slots, writing a line per time slot as each completes.
+type slotWriter struct {
+	opts     *Options
+	w        *bufio.Writer
+	counts   *counts
+	keyWidth int
+
+	// the open time slot
+	acc          accumulator
+	prevTimeSlot [20]byte
+	weightSum    float64
+	// of Options.Quantile and Options.HighPrecision, nil otherwise
+	sketch *quantileSketch
+	bigSum *big.Float
+	// the open time slots by the key, of Options.Unordered
+	unordered map[string]*accumulator
+	// the open pre-bucket, of Options.PreBucket
+	prevPreBucket [20]byte
+	preSum        float64
+	preCount      int
+	// the previous value within the time slot and the violations so far, of Options.ExpectMonotonic
+	prevScore  float64
+	violations int
+	// decimals of the results, widened by Options.DetectPrecision until the first time slot is tallied up
+	precision int
+	// the next time slot expected, of Options.Fill. nil if disabled
+	nextFill []byte
+	window   *rollingWindow
+	checksum hash.Hash
+	// results of Options.Graph, and the number of time slots by the count of Options.CountDistribution
+	graphValues []float64
+	countDist   map[int]int
+	// reused, so each line is streamed without allocation
+	jsonLine []byte
+}
+
+func newSlotWriter(w *bufio.Writer, opts *Options, c *counts) slotWriter {
+	s := slotWriter{
+		opts:      opts,
+		w:         w,
+		counts:    c,
+		keyWidth:  opts.Granularity.KeyWidth,
+		acc:       newAccumulator(*opts),
+		precision: opts.Precision,
+	}
+	if !math.IsNaN(opts.Quantile) {
+		s.sketch = &quantileSketch{}
+	}
+	if opts.HighPrecision {
+		s.bigSum = new(big.Float).SetPrec(highPrecisionBits)
+	}
+	if opts.Unordered {
+		s.unordered = make(map[string]*accumulator)
+	}
+	if opts.DetectPrecision {
+		// widened by the values as read
+		s.precision = 0
+	}
+	if opts.Fill {
+		s.nextFill = opts.Granularity.key(opts.St)
+	}
+	if opts.Rolling > 0 {
+		s.window = newRollingWindow(opts.Rolling)
+	}
+	if opts.TrailingChecksum {
+		s.checksum = sha256.New()
+	}
+	if opts.CountDistribution {
+		s.countDist = make(map[int]int)
+	}
+	return s
+}
+
+// rollup tallies the records of the run in a granularity of Options.Rollups, into its own output.
+type rollup struct {
+	opts Options
+	// of the time slots only, as the records are counted by the run
+	counts counts
+	writer *bufio.Writer
+	slots  slotWriter
+}
+
+func newRollup(ro Rollup, opts Options) *rollup {
+	u := &rollup{opts: opts}
+	// the slot events are of the granularity of the run
+	u.opts.Granularity, u.opts.OnSlot, u.opts.Rollups = ro.Granularity, nil, nil
+	u.writer = writerPool.Get().(*bufio.Writer)
+	u.writer.Reset(ro.W)
+	u.slots = newSlotWriter(u.writer, &u.opts, &u.counts)
+	return u
+}
+
+// tally writes the line of the time slot.
+func (s *slotWriter) tally(timeSlot []byte, acc accumulator) {
+	var (
+		opts   = s.opts
+		count  = acc.count
+		avg    float64
+		result string
+		label  = opts.Granularity.label(timeSlot, opts.WindowOffset)
+	)
+	if s.nextFill != nil && count > 0 {
+		s.fillUntil(timeSlot)
+	}
+	if count == 0 {
+		// placeholder of the time slot without records, under the policy of NaN results unless a number
+		avg = math.NaN()
+		placeholder := opts.FillValue
+		if isNaNText(placeholder) {
+			if opts.DropNaN {
+				return
+			}
+			if opts.NaNAs != "" {
+				placeholder = opts.NaNAs
+			}
+		}
+		result = formatPlaceholder(placeholder, opts.NumberFormat)
+	} else if s.bigSum != nil {
+		bigAvg := new(big.Float).SetPrec(highPrecisionBits).Quo(s.bigSum, big.NewFloat(float64(count)))
+		avg, _ = bigAvg.Float64()
+		switch opts.NumberFormat {
+		case NumberFormatRaw:
+			result = bigAvg.Text('f', -1)
+		case NumberFormatPlain:
+			result = bigAvg.Text('f', s.precision)
+		default:
+			result = fmt.Sprintf("%8.*f", s.precision, bigAvg)
+		}
+	} else {
+		avg = acc.Result()
+		if opts.WeightColumn > 0 {
+			// NaN if all the weights are zero, as the average is undefined
+			avg = math.NaN()
+			if s.weightSum != 0 {
+				avg = acc.value / s.weightSum
+			}
+		}
+		if s.sketch != nil {
+			avg = s.sketch.quantile(opts.Quantile)
+		}
+		if opts.EmitRate {
+			// events per second over the time slot, regardless of the values
+			avg = float64(count) / opts.Granularity.Duration.Seconds()
+		}
+		if math.IsNaN(avg) && opts.DropNaN {
+			return
+		}
+		result = formatResult(avg, s.precision, *opts)
+		if acc.hist != nil && s.sketch == nil && !opts.EmitRate {
+			result = string(acc.hist.appendText(nil))
+		}
+	}
+	slot := Slot{Time: label, Avg: avg, Count: count, Unit: opts.ValueUnit}
+	if s.window != nil && count > 0 {
+		mean, full := s.window.push(avg)
+		if !full && opts.RollingWarmup == RollingWarmupPlaceholder {
+			mean = math.NaN()
+		}
+		slot.Rolling = &mean
+	}
+	if opts.Agg == AggStddev && count > 0 && s.sketch == nil && !opts.EmitRate {
+		// along with the mean, as the deviation alone is hard to interpret
+		mean, stddev := acc.mean, avg
+		slot.Mean, slot.Stddev = &mean, &stddev
+	}
+	if acc.hist != nil && count > 0 && s.sketch == nil && !opts.EmitRate {
+		// copied, as the bins are reused for the next time slot
+		hist := *acc.hist
+		hist.Bins = slices.Clone(hist.Bins)
+		slot.Histogram = &hist
+	}
+	line := slotLine(slot, result, s.precision, *opts)
+	if opts.Format == FormatJSONL {
+		s.jsonLine = appendSlotJSON(s.jsonLine[:0], slot, s.precision)
+		s.w.Write(s.jsonLine)
+	} else {
+		s.w.WriteString(line)
+	}
+	s.counts.Slots++
+	if s.checksum != nil {
+		s.checksum.Write([]byte(line))
+	}
+	if opts.Graph {
+		s.graphValues = append(s.graphValues, avg)
+	}
+	if s.countDist != nil {
+		s.countDist[count]++
+	}
+	if opts.OnSlot != nil {
+		opts.OnSlot(slot)
+	}
+}
+
+// isNaNText reports whether the text is NaN as a number, e.g. the default fill value.
+func isNaNText(text string) bool {
+	v, err := strconv.ParseFloat(text, 64)
+	return err == nil && math.IsNaN(v)
+}
+
+// add adds the record to its time slot, or to its pre-bucket first with Options.PreBucket.
+func (s *slotWriter) add(rec parsedRecord) error {
+	opts := s.opts
+	if opts.DetectPrecision {
+		// after the record is added, as it may tally up the first time slot
+		defer s.detectPrecision(rec.decimals)
+	}
+
+	if opts.PreBucket.KeyWidth == 0 {
+		if err := s.accumulate(rec.timeSlot, rec.score, rec.weight, rec.bigScore); err != nil {
+			return fmt.Errorf("invalid record: %s, err: %w", bytes.TrimSpace(rec.record), err)
+		}
+		return nil
+	}
+
+	// two-stage aggregation. The mean of each pre-bucket is aggregated into the time slot
+	width := opts.PreBucket.KeyWidth
+	if s.preCount > 0 && !bytes.Equal(rec.stamp[:width], s.prevPreBucket[:width]) {
+		if err := s.accumulate(s.prevPreBucket[:s.keyWidth], s.preSum/float64(s.preCount), 1, nil); err != nil {
+			return fmt.Errorf("invalid %s: %s, err: %w", opts.PreBucket.Name, s.prevPreBucket[:width], err)
+		}
+		s.preSum, s.preCount = 0, 0
+	}
+	copy(s.prevPreBucket[:], rec.stamp)
+	s.preSum += rec.score
+	s.preCount++
+	return nil
+}
+
+// detectPrecision widens the precision to the decimals of the record, of Options.DetectPrecision.
+// Fixed once the first time slot is tallied up, so every line has the same decimals.
+func (s *slotWriter) detectPrecision(decimals int) {
+	if s.counts.Slots == 0 {
+		s.precision = max(s.precision, decimals)
+	}
+}
+
+// accumulate adds the score to the time slot. When the time slot changes, the previous one is tallied up.
+// bigScore is the exact score, of Options.HighPrecision.
+func (s *slotWriter) accumulate(timeSlot []byte, score, weight float64, bigScore *big.Float) error {
+	opts := s.opts
+	if s.unordered != nil {
+		a := s.unordered[string(timeSlot)]
+		if a == nil {
+			empty := newAccumulator(*opts)
+			a = &empty
+			s.unordered[string(timeSlot)] = a
+		}
+		if err := a.Add(score); err != nil {
+			return err
+		}
+		if opts.MaxRecordsPerSlot > 0 && a.count > opts.MaxRecordsPerSlot {
+			return fmt.Errorf("too many records in time slot %s (max %d). timestamp parsing may be broken", timeSlot, opts.MaxRecordsPerSlot)
+		}
+		return nil
+	}
+
+	switch {
+	case s.acc.count == 0:
+		// the first record seeds the time slot, as there is nothing to compare with
+	case bytes.Equal(timeSlot, s.prevTimeSlot[:s.keyWidth]):
+		// within the same time slot, go to next
+		if (opts.ExpectMonotonic == MonotonicIncreasing && score < s.prevScore) ||
+			(opts.ExpectMonotonic == MonotonicDecreasing && score > s.prevScore) {
+			// counter reset or data error
+			s.violations++
+		}
+		// weighted only for avg, otherwise the weight is 1
+		if err := s.acc.Add(score * weight); err != nil {
+			return err
+		}
+		s.weightSum += weight
+		if s.sketch != nil {
+			s.sketch.add(score, weight)
+		}
+		if s.bigSum != nil {
+			s.bigSum.Add(s.bigSum, bigScore)
+		}
+		if opts.MaxRecordsPerSlot > 0 && s.acc.count > opts.MaxRecordsPerSlot {
+			return fmt.Errorf("too many records in time slot %s (max %d). timestamp parsing may be broken", timeSlot, opts.MaxRecordsPerSlot)
+		}
+		s.prevScore = score
+		return nil
+	}
+
+	if s.acc.count > 0 && bytes.Compare(timeSlot, s.prevTimeSlot[:s.keyWidth]) < 0 {
+		// the earlier time slot has been tallied up already, so it would be output twice
+		return fmt.Errorf("non-monotonic input: time slot %s after %s. use --unordered for unsorted input", timeSlot, s.prevTimeSlot[:s.keyWidth])
+	}
+
+	// Go to next time slot. The record is added first, so that the previous is not tallied up on error
+	next := newAccumulator(*opts)
+	if err := next.Add(score * weight); err != nil {
+		return err
+	}
+	if s.acc.count > 0 {
+		// tally up the score
+		s.tally(s.prevTimeSlot[:s.keyWidth], s.acc)
+	}
+	copy(s.prevTimeSlot[:], timeSlot)
+	s.acc = next
+	s.weightSum = weight
+	if s.sketch != nil {
+		s.sketch.reset()
+		s.sketch.add(score, weight)
+	}
+	if s.bigSum != nil {
+		s.bigSum.Set(bigScore)
+	}
+	s.prevScore = score
+	return nil
+}
+
+// closeSegment tallies up the open pre-bucket and time slots, so that the next record starts afresh.
+func (s *slotWriter) closeSegment() error {
+	if s.preCount > 0 {
+		if err := s.accumulate(s.prevPreBucket[:s.keyWidth], s.preSum/float64(s.preCount), 1, nil); err != nil {
+			return err
+		}
+		s.preSum, s.preCount = 0, 0
+	}
+	if s.acc.count > 0 {
+		s.tally(s.prevTimeSlot[:s.keyWidth], s.acc)
+		s.acc.Reset()
+	}
+	if len(s.unordered) > 0 {
+		// in the order of the time slots, as RFC3339 is ordered lexicographically
+		keys := slices.Sorted(maps.Keys(s.unordered))
+		for _, key := range keys {
+			s.tally([]byte(key), *s.unordered[key])
+		}
+		clear(s.unordered)
+	}
+	return nil
+}
+
+// fillUntil writes the placeholders of the gap before the time slot, of Options.Fill.
+// The records out of the range don't move back the next expected time slot.
+func (s *slotWriter) fillUntil(timeSlot []byte) {
+	g := s.opts.Granularity
+	for bytes.Compare(s.nextFill, timeSlot) < 0 {
+		s.tally(s.nextFill, accumulator{agg: s.opts.Agg})
+		s.nextFill = g.next(s.nextFill)
+	}
+	if next := g.next(timeSlot); bytes.Compare(next, s.nextFill) > 0 {
+		s.nextFill = next
+	}
+}
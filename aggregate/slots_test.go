@@ -0,0 +1,154 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSlotWriter returns the slot writer of the options, writing to out.
+func newTestSlotWriter(opts *Options, out *bytes.Buffer) (*slotWriter, *counts) {
+	c := new(counts)
+	s := newSlotWriter(bufio.NewWriter(out), opts, c)
+	return &s, c
+}
+
+func TestSlotWriter(t *testing.T) {
+	type value struct {
+		timeSlot string
+		score    float64
+	}
+	tests := []struct {
+		name   string
+		opts   func(*Options)
+		values []value
+		want   string
+		err    string
+	}{
+		{
+			name:   "ordered",
+			values: []value{{"2021-03-04T03", 1}, {"2021-03-04T03", 2}, {"2021-03-04T05", 4}},
+			want:   "2021-03-04T03:00:00Z   1.5000\n2021-03-04T05:00:00Z   4.0000\n",
+		},
+		{
+			name:   "unordered",
+			opts:   func(o *Options) { o.Unordered = true },
+			values: []value{{"2021-03-04T05", 4}, {"2021-03-04T03", 1}, {"2021-03-04T05", 2}},
+			want:   "2021-03-04T03:00:00Z   1.0000\n2021-03-04T05:00:00Z   3.0000\n",
+		},
+		{
+			name:   "fill",
+			opts:   func(o *Options) { o.Fill = true },
+			values: []value{{"2021-03-04T03", 1}, {"2021-03-04T05", 4}},
+			want:   "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z      NaN\n2021-03-04T05:00:00Z   4.0000\n",
+		},
+		{
+			name:   "fill nan as",
+			opts:   func(o *Options) { o.Fill, o.NaNAs = true, "null" },
+			values: []value{{"2021-03-04T03", 1}, {"2021-03-04T05", 4}},
+			want:   "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z     null\n2021-03-04T05:00:00Z   4.0000\n",
+		},
+		{
+			name:   "fill drop nan",
+			opts:   func(o *Options) { o.Fill, o.DropNaN = true, true },
+			values: []value{{"2021-03-04T03", 1}, {"2021-03-04T05", 4}},
+			want:   "2021-03-04T03:00:00Z   1.0000\n2021-03-04T05:00:00Z   4.0000\n",
+		},
+		{
+			// a number is not NaN, so neither applies
+			name:   "fill value",
+			opts:   func(o *Options) { o.Fill, o.FillValue, o.NaNAs = true, "0", "null" },
+			values: []value{{"2021-03-04T03", 1}, {"2021-03-04T05", 4}},
+			want:   "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z        0\n2021-03-04T05:00:00Z   4.0000\n",
+		},
+		{
+			name:   "non-monotonic",
+			values: []value{{"2021-03-04T05", 4}, {"2021-03-04T03", 1}},
+			err:    "non-monotonic input: time slot 2021-03-04T03 after 2021-03-04T05",
+		},
+		{
+			name:   "too many records",
+			opts:   func(o *Options) { o.MaxRecordsPerSlot = 1 },
+			values: []value{{"2021-03-04T03", 1}, {"2021-03-04T03", 2}},
+			err:    "too many records in time slot 2021-03-04T03 (max 1)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.St = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			var out bytes.Buffer
+			s, c := newTestSlotWriter(&opts, &out)
+			var err error
+			for _, v := range tt.values {
+				if err = s.accumulate([]byte(v.timeSlot), v.score, 1, nil); err != nil {
+					break
+				}
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err == nil {
+				err = s.closeSegment()
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			s.w.Flush()
+			if out.String() != tt.want || c.Slots != strings.Count(tt.want, "\n") {
+				t.Errorf("got %q, %d slots, want %q", out.String(), c.Slots, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotWriterMonotonic(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ExpectMonotonic = MonotonicIncreasing
+	var out bytes.Buffer
+	s, _ := newTestSlotWriter(&opts, &out)
+	// the first value of each time slot is compared with nothing
+	for _, v := range []float64{1, 3, 2, 4} {
+		if err := s.accumulate([]byte("2021-03-04T03"), v, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.accumulate([]byte("2021-03-04T04"), 0, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.violations != 1 {
+		t.Errorf("got %d violations, want 1", s.violations)
+	}
+}
+
+func TestSlotWriterPreBucket(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PreBucket = GranularityMinute
+	var out bytes.Buffer
+	s, _ := newTestSlotWriter(&opts, &out)
+	// the mean of each minute is averaged, so the busy minute weighs the same as the other
+	for _, r := range []string{"2021-03-04T03:00:00Z", "2021-03-04T03:00:10Z", "2021-03-04T03:00:20Z", "2021-03-04T03:01:00Z"} {
+		score := 1.0
+		if r == "2021-03-04T03:01:00Z" {
+			score = 3
+		}
+		if err := s.add(parsedRecord{stamp: []byte(r), timeSlot: []byte(r[:13]), score: score, weight: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.closeSegment(); err != nil {
+		t.Fatal(err)
+	}
+	s.w.Flush()
+	if want := "2021-03-04T03:00:00Z   2.0000\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,42 @@
+package aggregate
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// summary is the totals of a run, written after the time slots by Options.Summary.
+type summary struct {
+	records int
+	sum     float64
+	slots   int
+	elapsed time.Duration
+}
+
+// write writes the summary as a comment line, or a JSON object marked by the summary field in jsonl.
+//
+//	# summary: records=120 slots=2 avg=3.1416 elapsed=1.2s
+//	{"summary":true,"records":120,"slots":2,"avg":3.1416,"elapsed_seconds":1.2}
+func (s summary) write(w io.Writer, format string, decimals int) {
+	avg := math.NaN()
+	if s.records > 0 {
+		avg = s.sum / float64(s.records)
+	}
+
+	if format != FormatJSONL {
+		fmt.Fprintf(w, "# summary: records=%d slots=%d avg=%.*f elapsed=%s\n", s.records, s.slots, decimals, avg, s.elapsed.Round(time.Millisecond))
+		return
+	}
+	line := []byte(`{"summary":true,"records":`)
+	line = strconv.AppendInt(line, int64(s.records), 10)
+	line = append(line, `,"slots":`...)
+	line = strconv.AppendInt(line, int64(s.slots), 10)
+	line = append(line, `,"avg":`...)
+	line = appendJSONFloat(line, avg, decimals)
+	line = append(line, `,"elapsed_seconds":`...)
+	line = strconv.AppendFloat(line, s.elapsed.Seconds(), 'f', -1, 64)
+	w.Write(append(line, "}\n"...))
+}
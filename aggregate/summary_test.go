@@ -0,0 +1,33 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	fakeClock(t, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), 1500*time.Millisecond)
+	input := "2021-03-04T00:00:00Z 1\n2021-03-04T00:10:00Z 2\n2021-03-04T01:00:00Z 6\n"
+
+	tests := []struct {
+		name          string
+		format        string
+		deterministic bool
+		want          string
+	}{
+		{name: "text", format: FormatText, want: "# summary: records=3 slots=2 avg=3.0000 elapsed=1.5s\n"},
+		{name: "text deterministic", format: FormatText, deterministic: true, want: "# summary: records=3 slots=2 avg=3.0000 elapsed=0s\n"},
+		{name: "jsonl", format: FormatJSONL, want: `{"summary":true,"records":3,"slots":2,"avg":3.0000,"elapsed_seconds":1.5}` + "\n"},
+		{name: "jsonl deterministic", format: FormatJSONL, deterministic: true, want: `{"summary":true,"records":3,"slots":2,"avg":3.0000,"elapsed_seconds":0}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Summary, opts.Format, opts.Deterministic = true, tt.format, tt.deterministic
+			got := captureStderr(t, func() { mustAggregate(t, opts, input) })
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
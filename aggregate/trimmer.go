@@ -0,0 +1,36 @@
+package aggregate
+
+import (
+	"io"
+)
+
+// newlineTrimmer holds back the trailing new line of each write,
+// and writes it only when more output follows.
+// So the last line is never terminated, regardless of the buffering upstream.
+type newlineTrimmer struct {
+	w    io.Writer
+	held bool
+}
+
+func (t *newlineTrimmer) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if t.held {
+		if _, err = t.w.Write([]byte{'\n'}); err != nil {
+			return 0, err
+		}
+		t.held = false
+	}
+
+	n = len(p)
+	if p[n-1] == '\n' {
+		p = p[:n-1]
+		t.held = true
+	}
+	if _, err = t.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
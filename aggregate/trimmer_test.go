@@ -0,0 +1,28 @@
+package aggregate
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTrimTrailingNewline(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TrimTrailingNewline = true
+	if got := mustAggregate(t, opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T04:00:00Z 004.0000\n"); got != "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   4.0000" {
+		t.Errorf("got %q, want no trailing new line", got)
+	}
+}
+
+func TestNewlineTrimmer(t *testing.T) {
+	var out bytes.Buffer
+	w := &newlineTrimmer{w: &out}
+	// split the same as the buffering upstream may do
+	for _, s := range []string{"a\n", "b", "\n", "", "c\n"} {
+		if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if out.String() != "a\nb\nc" {
+		t.Errorf("got %q", out.String())
+	}
+}
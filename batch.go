@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errBatchFetch is reported when any range of the batch failed to fetch
+var errBatchFetch = errors.New("fetch error")
+
+// runBatch runs the aggregation for each range listed in the file, in order.
+// Each line is the positional args of a single run, e.g. `<start_time> <end_time>`.
+// Empty lines and lines starting with `#` are ignored.
+// The flags apply to all the ranges, and the outputs are concatenated into w.
+func runBatch(ctx context.Context, path string, flags []string, w io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read batch file: %w", err)
+	}
+
+	var failed int
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		opts, err := validateCommandArgs(append(slices.Clone(flags), strings.Fields(line)...))
+		if err != nil {
+			return fmt.Errorf("invalid range at line %d: %w", i+1, err)
+		}
+
+		if opts.outputPath != "" || opts.Format == formatParquet || opts.rawOutputPath != "" || len(opts.granularities) > 0 ||
+			opts.inputPath != "" || opts.inputURL != "" || opts.parallelism > 1 || opts.dryRun {
+			// each range is fetched and written to w alone
+			return fmt.Errorf("--output, --format=parquet, --raw-output, --granularities, --input, --input-url, --parallelism and --dry-run are not supported in batch mode")
+		}
+
+		if err = runBatchRange(ctx, w, opts); err == nil {
+			continue
+		}
+		if !errors.Is(err, errBatchFetch) || !opts.continueOnFetchError {
+			return err
+		}
+		// mark the range in the output, so that it's distinguished from an empty range
+		failed++
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+		fmt.Fprintf(w, "# fetch failed: %s\n", line)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w in %d range(s)", errBatchFetch, failed)
+	}
+	return nil
+}
+
+// runBatchRange aggregates a single range of the batch.
+func runBatchRange(ctx context.Context, w io.Writer, opts options) error {
+	stream, release, err := fetchCached(ctx, newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		return fmt.Errorf("%w in range %s - %s: %v", errBatchFetch, opts.St.Format(time.RFC3339), opts.Ed.Format(time.RFC3339), err)
+	}
+	defer release()
+
+	if stream, err = wrapStream(ctx, stream, opts); err != nil {
+		return fmt.Errorf("%w in range %s - %s: %v", errBatchFetch, opts.St.Format(time.RFC3339), opts.Ed.Format(time.RFC3339), err)
+	}
+	return tally(ctx, stream, w, opts)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeBatchFile writes the ranges into a batch file, returning its path.
+func writeBatchFile(t *testing.T, ranges string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte(ranges), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunBatchInvalidRange(t *testing.T) {
+	path := writeBatchFile(t, "# comment\n\n2021-03-04T05:00:00Z\n")
+	err := runBatch(context.Background(), path, nil, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "invalid range at line 3") {
+		t.Errorf("got %v, want the error of line 3", err)
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	path := writeBatchFile(t, "# comment\n2021-03-04T00:00:00Z 2021-03-04T00:50:00Z\n\n2021-03-04T05:00:00Z 2021-03-04T05:30:00Z\n")
+
+	var out bytes.Buffer
+	if err := runBatch(context.Background(), path, []string{"--url=" + newTestAPI(t)}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "2021-03-04T00:00:00Z   0.2500\n2021-03-04T05:00:00Z   5.1500\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestRunBatchRejectsOutputFlags(t *testing.T) {
+	path := writeBatchFile(t, "2021-03-04T00:00:00Z 2021-03-04T01:00:00Z\n")
+	for _, flag := range []string{"--output=o.txt", "--format=parquet", "--raw-output=raw.txt", "--granularities=hour,day", "--input=in.txt", "--parallelism=2"} {
+		t.Run(flag, func(t *testing.T) {
+			flags := []string{"--url=http://127.0.0.1:1/data", flag}
+			if flag == "--format=parquet" {
+				flags = append(flags, "--output=o.parquet")
+			}
+			var out bytes.Buffer
+			err := runBatch(context.Background(), path, flags, &out)
+			if err == nil || !strings.Contains(err.Error(), "not supported in batch mode") {
+				t.Errorf("got %v, want the unsupported error", err)
+			}
+			if out.Len() > 0 {
+				t.Errorf("got output %q", out.String())
+			}
+		})
+	}
+}
+
+func TestRunBatchContinueOnFetchError(t *testing.T) {
+	// the range of 05:00 is missing
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Query().Get("begin"), "2021-03-04T05") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, testRecords(time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 0, 50, 0, 0, time.UTC)))
+	}))
+	defer srv.Close()
+	path := writeBatchFile(t, "2021-03-04T05:00:00Z 2021-03-04T05:30:00Z\n2021-03-04T00:00:00Z 2021-03-04T00:50:00Z\n")
+
+	var out bytes.Buffer
+	err := runBatch(context.Background(), path, []string{"--url=" + srv.URL}, &out)
+	if !errors.Is(err, errBatchFetch) || out.Len() > 0 {
+		t.Errorf("got %v, %q, want aborted at the failed range", err, out.String())
+	}
+
+	out.Reset()
+	var stderr string
+	_, stderr = captureOutput(t, func() {
+		err = runBatch(context.Background(), path, []string{"--url=" + srv.URL, "--continue-on-fetch-error"}, &out)
+	})
+	if !errors.Is(err, errBatchFetch) || !strings.Contains(err.Error(), "in 1 range(s)") {
+		t.Errorf("got %v, want the failed range counted", err)
+	}
+	if want := "# fetch failed: 2021-03-04T05:00:00Z 2021-03-04T05:30:00Z\n2021-03-04T00:00:00Z   0.2500\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if !strings.Contains(stderr, "Warning: fetch error in range 2021-03-04T05:00:00Z - 2021-03-04T05:30:00Z") {
+		t.Errorf("got stderr %q, want the warning", stderr)
+	}
+}
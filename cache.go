@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cachePath returns the path of the cached body of the request url in dir.
+func cachePath(dir, uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".txt")
+}
+
+// fetchCached fetches the range, through the cache of --cache-dir if set.
+// On a hit, the cached body is read instead. On a miss, the body is written to the cache as it's read,
+// kept only once read to the end. --no-cache skips the hit, refreshing the cache.
+// release must be called once the stream is consumed.
+func fetchCached(ctx context.Context, client *fasthttp.Client, opts options, st, ed time.Time) (stream io.Reader, release func(), err error) {
+	if opts.cacheDir == "" {
+		return fetch(ctx, client, opts, st, ed)
+	}
+
+	path := cachePath(opts.cacheDir, rangeURL(opts, st, ed))
+	if !opts.noCache {
+		if f, oerr := os.Open(path); oerr == nil {
+			if opts.isDebug {
+				fmt.Fprintf(os.Stderr, "cache hit: %s\n", path)
+			}
+			return f, func() { f.Close() }, nil
+		} else if !os.IsNotExist(oerr) {
+			return nil, nil, fmt.Errorf("failed to read cache: %w", oerr)
+		}
+	}
+
+	body, releaseBody, err := fetch(ctx, client, opts, st, ed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = os.MkdirAll(opts.cacheDir, 0o755); err != nil {
+		releaseBody()
+		return nil, nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	f, err := os.CreateTemp(opts.cacheDir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		releaseBody()
+		return nil, nil, fmt.Errorf("failed to create cache: %w", err)
+	}
+	if opts.isDebug {
+		fmt.Fprintf(os.Stderr, "cache miss: %s\n", path)
+	}
+	tee := &cacheTeeReader{r: body, f: f, path: path}
+	return tee, func() {
+		tee.close()
+		releaseBody()
+	}, nil
+}
+
+// cacheTeeReader writes the body to the temporary cache file as it's read,
+// renamed into place at the end of the body, so that a partial body is never cached.
+type cacheTeeReader struct {
+	r    io.Reader
+	f    *os.File
+	path string
+	// Error of writing the cache. The body is read on regardless, just not cached.
+	werr error
+	done bool
+}
+
+func (c *cacheTeeReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	if n > 0 && c.werr == nil {
+		_, c.werr = c.f.Write(p[:n])
+	}
+	if err == io.EOF && !c.done {
+		c.done = true
+		if cerr := c.f.Close(); c.werr == nil {
+			c.werr = cerr
+		}
+		if c.werr == nil {
+			c.werr = os.Rename(c.f.Name(), c.path)
+		}
+		if c.werr != nil {
+			fmt.Fprintln(os.Stderr, "Warning: failed to write cache:", c.werr)
+			os.Remove(c.f.Name())
+		}
+	}
+	return n, err
+}
+
+// close removes the temporary cache file unless the body was read to the end.
+func (c *cacheTeeReader) close() {
+	if !c.done {
+		c.done = true
+		c.f.Close()
+		os.Remove(c.f.Name())
+	}
+}
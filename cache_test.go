@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	// the value of the records changes on each request, so a hit is told apart
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "2021-03-04T03:00:00Z "+strings.Repeat("1", int(n))+"\n")
+	}))
+	defer srv.Close()
+	dir := filepath.Join(t.TempDir(), "cache")
+
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		requests int32
+	}{
+		{name: "miss", want: "2021-03-04T03:00:00Z   1.0000\n", requests: 1},
+		{name: "hit", want: "2021-03-04T03:00:00Z   1.0000\n", requests: 1},
+		// keyed by the range
+		{name: "miss of another range", args: []string{"2021-03-04T03:00:00Z", "2021-03-04T03:30:00Z"}, want: "2021-03-04T03:00:00Z  11.0000\n", requests: 2},
+		{name: "no cache", args: []string{"--no-cache"}, want: "2021-03-04T03:00:00Z 111.0000\n", requests: 3},
+		// refreshed by the above
+		{name: "hit of the refreshed", want: "2021-03-04T03:00:00Z 111.0000\n", requests: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if len(args) < 2 {
+				args = append(args, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z")
+			}
+			stdout, stderr, code := runMain(t, append([]string{"--url=" + srv.URL, "--cache-dir=" + dir}, args...)...)
+			if code != exitOK || stdout != tt.want {
+				t.Errorf("got %d, %q, %q, want %q", code, stdout, stderr, tt.want)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("got %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+
+	// one file per range, and no temporary left
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("got %v, %v, want the 2 ranges cached", entries, err)
+	}
+}
+
+func TestCacheDebugToStderr(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"--url=" + newTestAPI(t), "--cache-dir=" + t.TempDir(), "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.isDebug = true
+	for _, want := range []string{"cache miss: ", "cache hit: "} {
+		stdout, stderr := captureOutput(t, func() {
+			stream, release, ferr := fetchCached(context.Background(), newClient(opts), opts, opts.St, opts.Ed)
+			if ferr != nil {
+				t.Error(ferr)
+				return
+			}
+			io.Copy(io.Discard, stream)
+			release()
+		})
+		// stderr, apart from the output
+		if stdout != "" || !strings.Contains(stderr, want) {
+			t.Errorf("got %q, %q, want %q on stderr", stdout, stderr, want)
+		}
+	}
+}
+
+func TestCachePartialBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "--cache-dir=" + dir, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// released before read to the end, e.g. on an error
+	stream, release, err := fetchCached(context.Background(), newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Read(make([]byte, 10))
+	release()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %v, want the partial body not cached", entries)
+	}
+
+	// read to the end, the body is cached as is
+	if stream, release, err = fetchCached(context.Background(), newClient(opts), opts, opts.St, opts.Ed); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(stream)
+	release()
+	got, err := os.ReadFile(cachePath(dir, rangeURL(opts, opts.St, opts.Ed)))
+	if err != nil || string(got) != "2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestCacheFlags(t *testing.T) {
+	const st, ed = "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"
+	for args, want := range map[string]string{
+		"--no-cache":                    "--no-cache requires --cache-dir",
+		"--cache-dir=":                  "cache dir is empty",
+		"--cache-dir=c --parallelism=2": "--cache-dir cannot be combined with --parallelism, --input or --input-url",
+	} {
+		if _, err := validateCommandArgs(append(strings.Fields(args), st, ed)); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %q", args, err, want)
+		}
+	}
+}
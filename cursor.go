@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Cursor token of chunked backfills
+//
+//	v1.<start time of the next chunk in RFC3339>
+//
+// e.g. `v1.2021-03-05T00:00:00Z`. `done` means the whole range is processed.
+const (
+	cursorPrefix = "v1."
+	cursorDone   = "done"
+)
+
+func encodeCursor(next time.Time) string {
+	return cursorPrefix + next.UTC().Format(time.RFC3339)
+}
+
+func decodeCursor(token string) (time.Time, error) {
+	if !strings.HasPrefix(token, cursorPrefix) {
+		return time.Time{}, fmt.Errorf("invalid cursor: %s, unknown version", token)
+	}
+	next, err := time.Parse(time.RFC3339, strings.TrimPrefix(token, cursorPrefix))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cursor: %s, err: %w", token, err)
+	}
+	return next, nil
+}
+
+// chunkRange returns the chunk of [st, ed] starting at `from`, and the cursor of the next chunk.
+// The next chunk starts at a time slot boundary, so that no time slot is split into 2 runs.
+// As the API range is inclusive on both ends, the chunk ends 1 second before the next chunk,
+// so that every record is processed exactly once over the chain of runs.
+func chunkRange(from, ed time.Time, chunk, slot time.Duration) (chunkSt, chunkEd time.Time, next string) {
+	nextSt := from.Add(chunk).Truncate(slot)
+	if nextSt.After(ed) {
+		return from, ed, cursorDone
+	}
+	return from, nextSt.Add(-time.Second), encodeCursor(nextSt)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the chained runs cover the full range exactly once, the same as a single run
+func TestChunkCursorChain(t *testing.T) {
+	args := []string{"2021-03-04T00:00:00Z", "2021-03-04T05:00:00Z"}
+	opts, err := validateCommandArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustAggregate(t, opts, testRecords(opts.St, opts.Ed))
+
+	var (
+		got    strings.Builder
+		cursor string
+		runs   int
+	)
+	for cursor != cursorDone {
+		chained := append([]string{"--chunk=2h"}, args...)
+		if cursor != "" {
+			chained = append(chained, "--cursor="+cursor)
+		}
+		if opts, err = validateCommandArgs(chained); err != nil {
+			t.Fatal(err)
+		}
+		got.WriteString(mustAggregate(t, opts, testRecords(opts.St, opts.Ed)))
+		if opts.nextCursor == cursor {
+			t.Fatalf("got %q, want the cursor of the next chunk", opts.nextCursor)
+		}
+		cursor = opts.nextCursor
+		if runs++; runs > 3 {
+			t.Fatal("too many runs of 2 hour chunks over 5 hours")
+		}
+	}
+	if got.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got.String(), want)
+	}
+}
+
+func TestChunkRange(t *testing.T) {
+	var (
+		begin = time.Date(2021, 3, 4, 0, 30, 0, 0, time.UTC)
+		end   = time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	)
+	st, ed, next := chunkRange(begin, end, 2*time.Hour, time.Hour)
+	// the next chunk starts at the hour boundary, and this one ends right before it
+	if !st.Equal(begin) || ed.Format(time.RFC3339) != "2021-03-04T01:59:59Z" || next != "v1.2021-03-04T02:00:00Z" {
+		t.Errorf("got %s - %s, %s", st, ed, next)
+	}
+	if _, ed, next = chunkRange(time.Date(2021, 3, 4, 4, 0, 0, 0, time.UTC), end, 2*time.Hour, time.Hour); !ed.Equal(end) || next != cursorDone {
+		t.Errorf("got the end %s, %s, want the last chunk", ed, next)
+	}
+
+	from, err := decodeCursor("v1.2021-03-04T02:00:00Z")
+	if err != nil || from.Format(time.RFC3339) != "2021-03-04T02:00:00Z" {
+		t.Errorf("got %s, %v", from, err)
+	}
+	for _, token := range []string{"2021-03-04T02:00:00Z", "v2.2021-03-04T02:00:00Z", "v1.yesterday"} {
+		if _, err = decodeCursor(token); err == nil {
+			t.Errorf("decodeCursor(%s) succeeded, want the error", token)
+		}
+	}
+}
+
+func TestNarrowToChunk(t *testing.T) {
+	opts := defaultOptions()
+	opts.St, opts.Ed = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	opts.chunk, opts.cursor = 2*time.Hour, "v1.2021-03-04T02:00:00Z"
+	if err := narrowToChunk(&opts); err != nil || opts.St.Format(time.RFC3339) != "2021-03-04T02:00:00Z" || opts.Ed.Format(time.RFC3339) != "2021-03-04T03:59:59Z" || opts.nextCursor != "v1.2021-03-04T04:00:00Z" {
+		t.Errorf("got %s - %s, %s, %v", opts.St, opts.Ed, opts.nextCursor, err)
+	}
+
+	opts = defaultOptions()
+	opts.cursor = "v1.2021-03-04T02:00:00Z"
+	if err := narrowToChunk(&opts); err == nil || err.Error() != "--cursor requires --chunk" {
+		t.Errorf("got %v, want the cursor without the chunk", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+const (
+	decompressNone = "none"
+	decompressGzip = "gzip"
+	// Detect the compression by the magic bytes
+	decompressAuto = "auto"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// newDecompressReader returns the reader of the decompressed stream.
+// In auto mode, the head of the stream is sniffed for the magic bytes,
+// and pushed back so that it's parsed as the data when not compressed.
+func newDecompressReader(src io.Reader, mode string) (io.Reader, error) {
+	switch mode {
+	case decompressGzip:
+		return newGzipReader(src)
+	case decompressAuto:
+		br := bufio.NewReader(src)
+		head, err := br.Peek(len(gzipMagic))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to sniff compression: %w", err)
+		}
+		if bytes.Equal(head, gzipMagic) {
+			return newGzipReader(br)
+		}
+		return br, nil
+	default:
+		return src, nil
+	}
+}
+
+func newGzipReader(src io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+	}
+	return zr, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecompressAuto(t *testing.T) {
+	data := "2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 4\n"
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(data))
+	zw.Close()
+
+	tests := []struct {
+		name string
+		mode string
+		src  []byte
+		want string
+	}{
+		{name: "auto compressed", mode: decompressAuto, src: compressed.Bytes(), want: data},
+		{name: "auto plain", mode: decompressAuto, src: []byte(data), want: data},
+		{name: "gzip", mode: decompressGzip, src: compressed.Bytes(), want: data},
+		{name: "none", mode: decompressNone, src: []byte(data), want: data},
+		// shorter than the magic bytes
+		{name: "auto empty", mode: decompressAuto, src: nil, want: ""},
+		{name: "auto a byte", mode: decompressAuto, src: []byte{0x1f}, want: "\x1f"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newDecompressReader(bytes.NewReader(tt.src), tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newDecompressReader(strings.NewReader(data), decompressGzip); err == nil {
+		t.Error("want the error of the plain stream as gzip")
+	}
+}
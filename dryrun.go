@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// dryRun writes the url of each request of the range to w, without fetching the bodies.
+// The size is the Content-Length of the HEAD request, if the server reports it.
+func dryRun(client *fasthttp.Client, opts options, w io.Writer) {
+	ranges := [][2]time.Time{{opts.St, opts.Ed}}
+	if opts.parallelism > 1 {
+		ranges = splitRange(opts.St, opts.Ed, opts.Granularity, opts.parallelism)
+	}
+
+	for _, r := range ranges {
+		uri := rangeURL(opts, r[0], r[1])
+		fmt.Fprintf(w, "GET %s\n", uri)
+
+		size, err := headContentLength(client, opts, uri)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "  size: unknown, %v\n", err)
+		case size < 0:
+			fmt.Fprintln(w, "  size: unknown, no Content-Length")
+		default:
+			fmt.Fprintf(w, "  size: %d bytes\n", size)
+		}
+	}
+}
+
+// headContentLength returns the Content-Length of the HEAD request of the url, negative if not reported.
+func headContentLength(client *fasthttp.Client, opts options, uri string) (int, error) {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+	req.SetRequestURI(uri)
+	req.Header.SetMethod(fasthttp.MethodHead)
+	if opts.token != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+opts.token)
+	}
+	// no body follows the headers
+	resp.SkipBody = true
+
+	if err := client.DoTimeout(req, resp, opts.requestTimeout); err != nil {
+		return 0, fmt.Errorf("HEAD failed: %w", err)
+	}
+	if statusCode := resp.StatusCode(); statusCode != fasthttp.StatusOK {
+		return 0, fmt.Errorf("HEAD status code: %d", statusCode)
+	}
+	return resp.Header.ContentLength(), nil
+}
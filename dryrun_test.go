@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	var gets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			gets++
+		}
+		w.Header().Set("Content-Length", "100")
+	}))
+	defer srv.Close()
+
+	opts, err := validateCommandArgs([]string{"--url=" + srv.URL + "/data", "--dry-run", "2021-03-04T00:00:00Z", "2021-03-04T03:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	dryRun(newClient(opts), opts, &out)
+
+	want := "GET " + srv.URL + "/data?begin=2021-03-04T00:00:00Z&end=2021-03-04T03:00:00Z\n  size: 100 bytes\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if gets > 0 {
+		t.Errorf("got %d requests of the body", gets)
+	}
+}
+
+func TestDryRunParallel(t *testing.T) {
+	opts := defaultOptions()
+	opts.apiURL = "http://127.0.0.1:1/data"
+	opts.St = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	opts.Ed = time.Date(2021, 3, 4, 4, 0, 0, 0, time.UTC)
+	opts.parallelism = 2
+	opts.requestTimeout = time.Second
+
+	var out bytes.Buffer
+	dryRun(newClient(opts), opts, &out)
+	for _, uri := range []string{
+		"GET http://127.0.0.1:1/data?begin=2021-03-04T00:00:00Z&end=2021-03-04T02:59:59Z\n",
+		"GET http://127.0.0.1:1/data?begin=2021-03-04T03:00:00Z&end=2021-03-04T04:00:00Z\n",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(uri)) {
+			t.Errorf("missing %q in %q", uri, out.String())
+		}
+	}
+	if !bytes.Contains(out.Bytes(), []byte("size: unknown")) {
+		t.Errorf("got %q, want the unknown size of the unreachable server", out.String())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// fetchSlots bounds the fetches in flight, shared by every path issuing them (e.g. server mode). nil means unlimited.
+var fetchSlots chan struct{}
+
+// setMaxParallelFetches sets the max number of fetches in flight. 0 means unlimited.
+// Must be called before any fetch.
+func setMaxParallelFetches(n int) {
+	if n <= 0 {
+		fetchSlots = nil
+		return
+	}
+	fetchSlots = make(chan struct{}, n)
+}
+
+func parseMaxParallelFetches(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid max parallel fetches: %v, must be a positive integer", value)
+	}
+	return n, nil
+}
+
+// acquireFetch blocks until a fetch is allowed or ctx is done, and returns the function to release it.
+// The slot is held until the body is consumed, so a streamed body counts as in flight while read.
+func acquireFetch(ctx context.Context) (release func(), err error) {
+	slots := fetchSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a fetch slot: %w", ctx.Err())
+	}
+}
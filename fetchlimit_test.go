@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxParallelFetches(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		// long enough for the others to pile up
+		time.Sleep(20 * time.Millisecond)
+		begin, _ := time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, testRecords(begin, end))
+	}))
+	defer srv.Close()
+
+	for _, limit := range []int{1, 2, 3} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			setMaxParallelFetches(limit)
+			t.Cleanup(func() { setMaxParallelFetches(0) })
+			peak.Store(0)
+
+			opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "--parallelism=6", "2021-03-04T00:00:00Z", "2021-03-04T05:59:59Z"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream, release, err := fetchParallel(context.Background(), newClient(opts), opts, opts.parallelism)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+			if _, err = io.Copy(io.Discard, stream); err != nil {
+				t.Fatal(err)
+			}
+			if got := peak.Load(); got != int32(limit) {
+				t.Errorf("got %d fetches in flight at most, want %d", got, limit)
+			}
+		})
+	}
+
+	if _, err := parseMaxParallelFetches("0"); err == nil {
+		t.Error("want the error of the non-positive limit")
+	}
+}
+
+func TestFetchSlotHeldUntilRelease(t *testing.T) {
+	url := newTestAPI(t)
+	setMaxParallelFetches(1)
+	t.Cleanup(func() { setMaxParallelFetches(0) })
+
+	// a month of records is over bodyStreamThreshold, so streamed
+	opts, err := validateCommandArgs([]string{"--url=" + url, "2021-03-01T00:00:00Z", "2021-03-31T23:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, release, err := fetch(context.Background(), newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.CopyN(io.Discard, stream, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the body being read holds the only slot
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err = fetch(ctx, newClient(opts), opts, opts.St, opts.St); err == nil || !strings.Contains(err.Error(), "waiting for a fetch slot") {
+		t.Fatalf("got %v, want the error of waiting for a fetch slot", err)
+	}
+
+	release()
+	_, release, err = fetch(context.Background(), newClient(opts), opts, opts.St, opts.St)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// commandFlag is a flag of the command line, bound to the field of options it sets.
+type commandFlag struct {
+	name  string
+	usage string
+	// Takes no value, e.g. `--fill`
+	isBool bool
+	// parses the value into the bound field
+	set func(value string) error
+}
+
+// valueFlag binds the flag to p, parsed by parse. The value is rejected unless valid,
+// as `invalid <name>: <value>, must be <must>`. nil valid accepts any parsed value.
+func valueFlag[T any](name, usage string, p *T, parse func(string) (T, error), valid func(T) bool, must string) commandFlag {
+	return commandFlag{name: name, usage: usage, set: func(value string) error {
+		v, err := parse(value)
+		if err != nil || (valid != nil && !valid(v)) {
+			return fmt.Errorf("invalid %s: %v, must be %s", strings.ReplaceAll(name, "-", " "), value, must)
+		}
+		*p = v
+		return nil
+	}}
+}
+
+// boolFlag binds the flag to b, set without a value.
+func boolFlag(name, usage string, b *bool) commandFlag {
+	f := valueFlag(name, usage, b, strconv.ParseBool, nil, "true or false")
+	f.isBool = true
+	return f
+}
+
+// intFlag binds the flag to an integer of at least least.
+func intFlag(name, usage string, p *int, least int, must string) commandFlag {
+	return valueFlag(name, usage, p, strconv.Atoi, func(v int) bool { return v >= least }, must)
+}
+
+// int64Flag binds the flag to a positive integer.
+func int64Flag(name, usage string, p *int64, must string) commandFlag {
+	parse := func(value string) (int64, error) { return strconv.ParseInt(value, 10, 64) }
+	return valueFlag(name, usage, p, parse, func(v int64) bool { return v > 0 }, must)
+}
+
+// durationFlag binds the flag to a positive duration.
+func durationFlag(name, usage string, p *time.Duration) commandFlag {
+	return valueFlag(name, usage, p, time.ParseDuration, func(v time.Duration) bool { return v > 0 }, "a positive duration")
+}
+
+// floatFlag binds the flag to a number accepted by valid.
+func floatFlag(name, usage string, p *float64, valid func(float64) bool, must string) commandFlag {
+	parse := func(value string) (float64, error) { return strconv.ParseFloat(value, 64) }
+	return valueFlag(name, usage, p, parse, valid, must)
+}
+
+// stringFlag binds the flag to a non-empty string, what being the name of the value for the error.
+func stringFlag(name, usage string, p *string, what string) commandFlag {
+	return funcFlag(name, usage, func(value string) error {
+		if value == "" {
+			return fmt.Errorf("%s is empty", what)
+		}
+		*p = value
+		return nil
+	})
+}
+
+// choiceFlag binds the flag to one of the choices.
+func choiceFlag(name, usage string, p *string, choices ...string) commandFlag {
+	must := strings.Join(choices[:len(choices)-1], ", ") + " or " + choices[len(choices)-1]
+	if len(choices) > 2 {
+		must = "one of " + must
+	}
+	parse := func(value string) (string, error) { return value, nil }
+	return valueFlag(name, usage, p, parse, func(v string) bool { return slices.Contains(choices, v) }, must)
+}
+
+// funcFlag binds the flag to set, e.g. to set several fields or to fail with the error of its own.
+func funcFlag(name, usage string, set func(value string) error) commandFlag {
+	return commandFlag{name: name, usage: usage, set: set}
+}
+
+func isFinite(v float64) bool { return !math.IsNaN(v) && !math.IsInf(v, 0) }
+
+// commandFlags returns the flags of the subcommand, bound to the fields of o.
+// Each subcommand takes only the flags meaningful to it, so the others are rejected as unknown.
+func (o *options) commandFlags(command string) []commandFlag {
+	flags := o.inputFlags()
+	if command != commandValidate {
+		flags = append(flags, o.resultFlags()...)
+	}
+	if command == commandRun {
+		flags = append(flags, o.runFlags()...)
+	}
+	return flags
+}
+
+// inputFlags returns the flags of reading the records, common to every subcommand.
+func (o *options) inputFlags() []commandFlag {
+	return []commandFlag{
+		funcFlag("record-separator", "the byte terminating each record, e.g. \\0", func(value string) (err error) {
+			o.RecordSeparator, err = parseSeparator(value)
+			return
+		}),
+		funcFlag("resolve", "resolve the host of the url to the ip, as `host:ip`", func(value string) error {
+			host, ip, ok := strings.Cut(value, ":")
+			if !ok || host == "" || net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid resolve: %v, must be host:ip", value)
+			}
+			if o.resolve == nil {
+				o.resolve = make(map[string]string)
+			}
+			o.resolve[host] = ip
+			return nil
+		}),
+		boolFlag("pipeline", "read the response body in background, overlapping the network reads and tally", &o.pipeline),
+		funcFlag("url", "endpoint of the API", func(value string) error {
+			if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid url: %v, must be an absolute http or https url", value)
+			}
+			o.apiURL = value
+			return nil
+		}),
+		durationFlag("process-timeout", "timeout of the whole process", &o.processTimeout),
+		durationFlag("request-timeout", "timeout of each request", &o.requestTimeout),
+		stringFlag("comment", "skip the lines beginning with this prefix", &o.Comment, "comment prefix"),
+		choiceFlag("profile-mode", "profile to take, one of cpu, mem, both or none", &o.profileMode, profileModeCPU, profileModeMem, profileModeBoth, profileModeNone),
+		choiceFlag("decompress", "decompression of the response, one of none, gzip or auto", &o.decompress, decompressNone, decompressGzip, decompressAuto),
+		int64Flag("abort-after-bytes", "abort once this many bytes are read from the stream", &o.abortAfterBytes, "a positive integer"),
+		boolFlag("fixed-width", "assert the records are in the fixed width format", &o.FixedWidth),
+		funcFlag("interval", "ISO 8601 interval `<start_time>/<end_time>`, in place of the positional args", func(value string) error {
+			o.interval = value
+			return nil
+		}),
+		funcFlag("input-thousands-sep", "thousands separator of the values stripped before parsing", func(value string) (err error) {
+			o.ThousandsSep, err = parseSeparator(value)
+			return
+		}),
+		funcFlag("max-parallel-fetches", "max number of fetches in flight at once", func(value string) (err error) {
+			o.maxParallelFetches, err = parseMaxParallelFetches(value)
+			return
+		}),
+		columnFlag("ts-col", "column of the timestamp, the byte range start:end or the 0-based whitespace separated field", &o.TimestampColumn),
+		columnFlag("value-col", "column of the value, the byte range start:end or the 0-based whitespace separated field", &o.ValueColumn),
+		stringFlag("cache-dir", "directory to cache the response bodies in, keyed by the url of the range", &o.cacheDir, "cache dir"),
+		boolFlag("no-cache", "fetch even if cached, refreshing the cache", &o.noCache),
+		funcFlag("reset-marker", "lines of this separate the segments of the stream, each aggregated afresh", func(value string) error {
+			if strings.TrimSpace(value) == "" {
+				return fmt.Errorf("reset marker is empty")
+			}
+			o.ResetMarker = strings.TrimSpace(value)
+			return nil
+		}),
+		funcFlag("input-url", "read the data from the object of this url instead of the API, e.g. s3:// or gs://", func(value string) error {
+			if _, err := parseObjectURL(value); err != nil {
+				return err
+			}
+			o.inputURL = value
+			return nil
+		}),
+		funcFlag("input", "read the data from these comma separated files, - for stdin or unix://<socket path>", func(value string) error {
+			for _, path := range strings.Split(value, ",") {
+				if path == "" {
+					return fmt.Errorf("input path is empty")
+				}
+				if path == unixInputPrefix {
+					return fmt.Errorf("invalid input: %v, must be unix://<socket path>", path)
+				}
+				o.inputPaths = append(o.inputPaths, path)
+			}
+			o.inputPath = o.inputPaths[0]
+			return nil
+		}),
+		intFlag("parallelism", "number of chunks the range is split into, fetched concurrently. each buffers up to 64 KB, the rest streamed as consumed", &o.parallelism, 1, "a positive integer"),
+		stringFlag("token", "bearer token of the API, defaults to $"+tokenEnv, &o.token, "token"),
+		boolFlag("align-minute", "require the start and end time at the beginning of the minute", &o.alignMinute),
+		boolFlag("truncate", "round the start and end time down to the minute", &o.truncateMinute),
+		int64Flag("max-body-size", "refuse the response of which the body is larger than this many bytes", &o.maxBodySize, "a positive number of bytes"),
+		boolFlag("unordered", "accept the records in any order of the time slots", &o.Unordered),
+		stringFlag("value-column-name", "name of the value column of labeled input with a header row", &o.ValueColumnName, "value column name"),
+		intFlag("skip-header-rows", "number of leading lines to ignore", &o.SkipHeaderRows, 0, "a non-negative integer"),
+		boolFlag("debug", "print the debug messages and the progress to stderr", &o.isDebug),
+	}
+}
+
+// resultFlags returns the flags of the records counted and the values output, of run and stats.
+func (o *options) resultFlags() []commandFlag {
+	return []commandFlag{
+		boolFlag("enforce-range", "drop the records out of the range", &o.EnforceRange),
+		valueFlag("clock-skew", "widen the range of --enforce-range by this on both ends", &o.ClockSkew, time.ParseDuration, func(v time.Duration) bool { return v >= 0 }, "a non-negative duration"),
+		floatFlag("min-value", "skip the records of which the value is below this", &o.MinValue, func(v float64) bool { return !math.IsNaN(v) }, "a number"),
+		floatFlag("max-value", "skip the records of which the value is above this", &o.MaxValue, func(v float64) bool { return !math.IsNaN(v) }, "a number"),
+		boolFlag("strict", "fail on a malformed record instead of skipping it", &o.Strict),
+		boolFlag("dedup", "drop the records of a timestamp already seen", &o.Dedup),
+		intFlag("precision", "number of decimals of the output values", &o.Precision, 0, "a non-negative integer"),
+	}
+}
+
+// runFlags returns the flags of the aggregation and the output, of run only.
+func (o *options) runFlags() []commandFlag {
+	return []commandFlag{
+		intFlag("max-records-per-slot", "max number of records a single time slot may hold", &o.MaxRecordsPerSlot, 1, "a positive integer"),
+		stringFlag("checkpoint", "path to periodically save the in-progress state", &o.CheckpointPath, "checkpoint path"),
+		boolFlag("resume", "restart from the --checkpoint", &o.Resume),
+		choiceFlag("expect-monotonic", "expected order of the values within a time slot, increasing or decreasing", &o.ExpectMonotonic, aggregate.MonotonicIncreasing, aggregate.MonotonicDecreasing),
+		boolFlag("emit-schema", "print the schema of the output before the data", &o.EmitSchema),
+		boolFlag("trailing-checksum", "append a line with the hash of all preceding data lines", &o.TrailingChecksum),
+		intFlag("target-buckets", "select the granularity of about this many time slots", &o.targetBuckets, 1, "a positive integer"),
+		durationFlag("max-age", "max age of the newest record relative to now", &o.MaxAge),
+		funcFlag("bucket", "size of the time slots, one of minute, hour or day", func(value string) (err error) {
+			o.bucket, err = aggregate.ParseGranularity(value)
+			return
+		}),
+		funcFlag("granularities", "comma separated granularities to output at once, each to <granularity>.txt, or <output>.<granularity> with --output", func(value string) error {
+			for _, name := range strings.Split(value, ",") {
+				g, err := aggregate.ParseGranularity(name)
+				if err != nil {
+					return err
+				}
+				o.granularities = append(o.granularities, g)
+			}
+			return nil
+		}),
+		boolFlag("fail-on-empty", "fail when no record is aggregated", &o.FailOnEmpty),
+		boolFlag("passthrough", "print each record prefixed by its time slot instead of aggregating", &o.Passthrough),
+		boolFlag("drop-nan", "omit the time slots of which the result is NaN", &o.DropNaN),
+		stringFlag("nan-as", "print NaN results as this instead, e.g. null", &o.NaNAs, "nan as"),
+		intFlag("weight-column", "index of the field holding the weight of each record", &o.WeightColumn, 1, "a positive integer"),
+		boolFlag("continue-on-fetch-error", "in batch mode, skip the ranges failed to fetch instead of aborting", &o.continueOnFetchError),
+		affixFlag("line-prefix", "prefix of each time slot line", &o.LinePrefix),
+		affixFlag("line-suffix", "suffix of each time slot line", &o.LineSuffix),
+		choiceFlag("format", "format of the output, one of text, jsonl or parquet", &o.Format, aggregate.FormatText, aggregate.FormatJSONL, formatParquet),
+		boolFlag("dry-run", "print the urls of the requests and the size reported by HEAD, without fetching", &o.dryRun),
+		choiceFlag("number-format", "format of the numbers of the text output, fixed (right aligned %8.4f), plain (unpadded %.4f) or raw (without --precision)", &o.NumberFormat, aggregate.NumberFormatFixed, aggregate.NumberFormatPlain, aggregate.NumberFormatRaw),
+		stringFlag("output", "path to write the output to instead of stdout", &o.outputPath, "output path"),
+		boolFlag("emit-rate", "output the number of records per second of each time slot", &o.EmitRate),
+		boolFlag("output-utc", "normalize every timestamp into UTC", &o.OutputUTC),
+		stringFlag("raw-output", "path to write the records as is to, in addition to the output", &o.rawOutputPath, "raw output path"),
+		valueFlag("window-offset", "shift the boundaries of the time slots by this", &o.WindowOffset, time.ParseDuration,
+			func(v time.Duration) bool { return v > 0 && v%time.Second == 0 }, "a positive duration in whole seconds"),
+		boolFlag("preflight", "estimate the volume of the range by a sample before fetching it", &o.preflight),
+		int64Flag("preflight-confirm", "abort when the preflight estimate exceeds this many bytes, implies --preflight", &o.preflightMaxBytes, "a positive number of bytes"),
+		floatFlag("quantile", "output this quantile of each time slot, between 0 and 1", &o.Quantile, func(v float64) bool { return v >= 0 && v <= 1 }, "between 0 and 1"),
+		floatFlag("histogram-min", "lower bound of the range of --agg=histogram", &o.HistogramMin, isFinite, "a finite number"),
+		floatFlag("histogram-max", "upper bound of the range of --agg=histogram", &o.HistogramMax, isFinite, "a finite number"),
+		intFlag("histogram-bins", "number of the bins of --agg=histogram", &o.HistogramBins, 1, "a positive integer"),
+		boolFlag("fill", "output every time slot of the range, with the fill value for the empty ones", &o.Fill),
+		funcFlag("fill-value", "value of the empty time slots, implies --fill", func(value string) error {
+			if value == "" {
+				return fmt.Errorf("fill value is empty")
+			}
+			o.FillValue, o.Fill = value, true
+			return nil
+		}),
+		boolFlag("with-count", "append the number of records of each time slot", &o.WithCount),
+		intFlag("rolling", "also output the mean of the results of the last this many time slots", &o.Rolling, 1, "a positive number of time slots"),
+		choiceFlag("rolling-warmup", "output of the rolling mean until the window is full, partial or placeholder", &o.RollingWarmup, aggregate.RollingWarmupPartial, aggregate.RollingWarmupPlaceholder),
+		intFlag("sample-rate", "aggregate only every this many records of each time slot", &o.SampleRate, 1, "a positive integer"),
+		boolFlag("summary", "print the totals of the run to stderr", &o.Summary),
+		boolFlag("fail-on-warnings", "fail after the output if any warning is reported", &o.FailOnWarnings),
+		boolFlag("value-format-detect", "output as many decimals as the most precise input value of the first time slot", &o.DetectPrecision),
+		boolFlag("deterministic", "omit the timing dependent fields of the output, e.g. the duration of the report", &o.Deterministic),
+		stringFlag("report-json", "path to write the JSON report of the run at exit", &o.reportPath, "report json path"),
+		boolFlag("trim-trailing-newline", "omit the new line of the last output line", &o.TrimTrailingNewline),
+		funcFlag("agg", "aggregation function of each time slot, or a percentile like p90", func(value string) error {
+			if q, ok := aggregate.ParsePercentile(value); ok {
+				// e.g. p90, the same as the quantile
+				o.Quantile = q
+				return nil
+			}
+			if !slices.Contains(aggregate.AggFuncs, value) {
+				return fmt.Errorf("invalid agg: %v, must be one of %s or a percentile like p90", value, strings.Join(aggregate.AggFuncs, ", "))
+			}
+			o.Agg = value
+			return nil
+		}),
+		boolFlag("partial-output-on-error", "on an error, also output the time slot open before it", &o.PartialOutputOnError),
+		durationFlag("round-to", "round each timestamp to the nearest multiple of this before bucketing", &o.RoundTo),
+		boolFlag("high-precision", "accumulate with math/big instead of float64", &o.HighPrecision),
+		boolFlag("graph", "render a sparkline of the time slots to stderr", &o.Graph),
+		boolFlag("count-distribution", "print how many time slots had each number of records to stderr", &o.CountDistribution),
+		stringFlag("value-unit", "unit of the values carried into the output, e.g. celsius", &o.ValueUnit, "value unit"),
+		durationFlag("chunk", "process only a chunk of this size of the range, then print the cursor of the next chunk", &o.chunk),
+		funcFlag("cursor", "cursor of the chunk printed by the previous run", func(value string) error {
+			o.cursor = value
+			return nil
+		}),
+		funcFlag("pre-bucket", "finer granularity the records are averaged in first, second or minute", func(value string) error {
+			switch value {
+			case aggregate.GranularitySecond.Name:
+				o.PreBucket = aggregate.GranularitySecond
+			case aggregate.GranularityMinute.Name:
+				o.PreBucket = aggregate.GranularityMinute
+			default:
+				return fmt.Errorf("invalid pre bucket: %v, must be second or minute", value)
+			}
+			return nil
+		}),
+	}
+}
+
+// affixFlag binds the flag to the affix of each time slot line, of a single line.
+func affixFlag(name, usage string, p *string) commandFlag {
+	return funcFlag(name, usage, func(value string) error {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid %s: %q, must not contain a new line", strings.ReplaceAll(name, "-", " "), value)
+		}
+		*p = value
+		return nil
+	})
+}
+
+// columnFlag binds the flag to the column of a custom layout.
+func columnFlag(name, usage string, p **aggregate.Column) commandFlag {
+	return funcFlag(name, usage, func(value string) error {
+		c, err := aggregate.ParseColumn(value)
+		if err != nil {
+			return err
+		}
+		*p = &c
+		return nil
+	})
+}
+
+// flagValue is a commandFlag as flag.Value. The error of set is kept in err as is, as the flag package wraps it.
+type flagValue struct {
+	commandFlag
+	err *error
+}
+
+func (v flagValue) String() string   { return "" }
+func (v flagValue) IsBoolFlag() bool { return v.isBool }
+func (v flagValue) Set(value string) error {
+	*v.err = v.set(value)
+	return *v.err
+}
+
+// newFlagSet returns the flag set of the flags, named for the usage.
+func newFlagSet(name string, flags []commandFlag) (fs *flag.FlagSet, setErr *error) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	setErr = new(error)
+	for _, f := range flags {
+		fs.Var(flagValue{commandFlag: f, err: setErr}, f.name, f.usage)
+	}
+	return
+}
+
+// isSet reports whether the flag is set by the args, rather than defaulted.
+func isSet(fs *flag.FlagSet, name string) (set bool) {
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return
+}
+
+// parseFlags parses the flags of args, interleaved with the positional args, and returns the latter.
+func parseFlags(fs *flag.FlagSet, setErr *error, args []string) (positional []string, err error) {
+	for {
+		if err = fs.Parse(args); err != nil {
+			if *setErr != nil {
+				return nil, *setErr
+			}
+			if name, ok := strings.CutPrefix(err.Error(), "flag provided but not defined: -"); ok {
+				return nil, fmt.Errorf("unknown flag: --%s", name)
+			}
+			if errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "Usage: %s [flags] <start_time> <end_time>\n", fs.Name())
+				fs.SetOutput(os.Stderr)
+				fs.PrintDefaults()
+			}
+			return nil, err
+		}
+		// the parsing stops at the first positional arg, so resumed after it
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+func TestParseFlags(t *testing.T) {
+	var (
+		agg       string
+		precision int
+		dedup     bool
+	)
+	fs, setErr := newFlagSet("test", []commandFlag{
+		choiceFlag("agg", "", &agg, "avg", "sum"),
+		intFlag("precision", "", &precision, 0, "a non-negative integer"),
+		boolFlag("dedup", "", &dedup),
+	})
+	// the positional args are kept in order, wherever the flags are
+	positional, err := parseFlags(fs, setErr, []string{"--agg=sum", "a", "--precision", "2", "b", "--dedup", "c"})
+	if err != nil || !slices.Equal(positional, []string{"a", "b", "c"}) {
+		t.Errorf("got %v, %v", positional, err)
+	}
+	if agg != "sum" || precision != 2 || !dedup {
+		t.Errorf("got %s, %d, %v", agg, precision, dedup)
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want func(options) bool
+		err  string
+	}{
+		{args: []string{"--max-records-per-slot=3"}, want: func(o options) bool { return o.MaxRecordsPerSlot == 3 }},
+		{args: []string{"--max-records-per-slot=0"}, err: "invalid max records per slot: 0, must be a positive integer"},
+		{args: []string{"--precision=0"}, want: func(o options) bool { return o.Precision == 0 }},
+		{args: []string{"--precision=-1"}, err: "invalid precision: -1, must be a non-negative integer"},
+		{args: []string{"--clock-skew=0s"}, want: func(o options) bool { return o.ClockSkew == 0 }},
+		{args: []string{"--request-timeout=0s"}, err: "invalid request timeout: 0s, must be a positive duration"},
+		{args: []string{"--window-offset=1500ms"}, err: "invalid window offset: 1500ms, must be a positive duration in whole seconds"},
+		{args: []string{"--format=xml"}, err: "invalid format: xml, must be one of text, jsonl or parquet"},
+		{args: []string{"--number-format=sci"}, err: "invalid number format: sci, must be one of fixed, plain or raw"},
+		{args: []string{"--number-format=plain", "--precision=2"}, want: func(o options) bool { return o.NumberFormat == "plain" && o.Precision == 2 }},
+		{args: []string{"--number-format=raw"}, want: func(o options) bool { return o.NumberFormat == "raw" }},
+		{args: []string{"--number-format=raw", "--precision=4"}, err: "--number-format=raw cannot be combined with --precision or --value-format-detect"},
+		{args: []string{"--number-format=raw", "--value-format-detect"}, err: "--number-format=raw cannot be combined with --precision or --value-format-detect"},
+		{args: []string{"--histogram-min=inf"}, err: "invalid histogram min: inf, must be a finite number"},
+		{args: []string{"--quantile=0.9"}, want: func(o options) bool { return o.Quantile == 0.9 }},
+		{args: []string{"--output="}, err: "output path is empty"},
+		{args: []string{"--fill-value=0"}, want: func(o options) bool { return o.Fill && o.FillValue == "0" }},
+		{args: []string{"--preflight-confirm=100"}, want: func(o options) bool { return o.preflight && o.preflightMaxBytes == 100 }},
+		{args: []string{"--dedup=false"}, want: func(o options) bool { return !o.Dedup }},
+	}
+	for _, tt := range tests {
+		opts, err := validateCommandArgs(append(tt.args, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%v: got %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !tt.want(opts) {
+			t.Errorf("%v: got %v", tt.args, err)
+		}
+	}
+}
+
+func TestFlagOrderings(t *testing.T) {
+	const (
+		st = "2021-03-04T03:00:00Z"
+		ed = "2021-03-04T04:59:59Z"
+	)
+	for _, args := range [][]string{
+		{"--agg=sum", "--precision=2", "--debug", st, ed},
+		{st, ed, "--agg=sum", "--precision=2", "--debug"},
+		{st, "--agg=sum", ed, "--precision", "2", "--debug"},
+		{"-agg", "sum", st, "-precision=2", ed, "-debug"},
+		// `debug` following the range, as before the flags
+		{"--precision=2", st, ed, "--agg=sum", "debug"},
+	} {
+		opts, err := validateCommandArgs(args)
+		if err != nil {
+			t.Errorf("%v: got %v", args, err)
+			continue
+		}
+		if opts.St.Format(time.RFC3339) != st || opts.Ed.Format(time.RFC3339) != ed || opts.Agg != aggregate.AggSum || opts.Precision != 2 || !opts.isDebug {
+			t.Errorf("%v: got %s, %s, %s, %d, %v", args, opts.St, opts.Ed, opts.Agg, opts.Precision, opts.isDebug)
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{st}, err: "invalid number of arguments. Usage: <start_time> <end_time>"},
+		{args: []string{"--agg=sum"}, err: "invalid number of arguments. Usage: <start_time> <end_time>"},
+		{args: []string{"yesterday", ed}, err: "invalid start time: yesterday"},
+		{args: []string{st, "--agg=sum", "today"}, err: "invalid end time: today"},
+		{args: []string{ed, st}, err: "start time is after end time: 2021-03-04 04:59:59 +0000 UTC, 2021-03-04 03:00:00 +0000 UTC"},
+		{args: []string{"--nope", st, ed}, err: "unknown flag: --nope"},
+		{args: []string{st, ed, "--dedup=maybe"}, err: "invalid dedup: maybe, must be true or false"},
+		{args: []string{st, ed, "--precision"}, err: "flag needs an argument: -precision"},
+	} {
+		if _, err := validateCommandArgs(tt.args); err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.err)
+		}
+	}
+}
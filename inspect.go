@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// Subcommands given as the first argument. Without any, it's run.
+const (
+	// fetch and aggregate the range
+	commandRun = "run"
+	// only check the records are well formed, reporting the malformed
+	commandValidate = "validate"
+	// summarize the whole range, instead of per time slot
+	commandStats = "stats"
+)
+
+// validate reads the stream to the end, writing each malformed record to w, then the counts.
+// Fails if any record is malformed.
+func validate(ctx context.Context, stream io.Reader, w io.Writer, opts options) error {
+	var stats aggregate.Stats
+	opts.Stats = &stats
+	opts.Strict = false
+	opts.OnMalformed = func(err error) {
+		fmt.Fprintln(w, err)
+	}
+	if err := tally(ctx, stream, io.Discard, opts); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "records: %d\nmalformed: %d\n", stats.Records, stats.Malformed)
+	if stats.Malformed > 0 {
+		return fmt.Errorf("%d malformed record(s)", stats.Malformed)
+	}
+	return nil
+}
+
+// printStats writes the number of records, the first and last timestamps and the mean of the whole stream to w.
+// The records are aggregated per second, so the time slots are the timestamps.
+func printStats(ctx context.Context, stream io.Reader, w io.Writer, opts options) error {
+	var (
+		count       int
+		sum         float64
+		first, last string
+	)
+	opts.Granularity = aggregate.GranularitySecond
+	opts.Agg = aggregate.AggAvg
+	opts.Quantile = math.NaN()
+	opts.Fill = false
+	opts.OnSlot = func(s aggregate.Slot) {
+		if count == 0 {
+			first = s.Time
+		}
+		last = s.Time
+		count += s.Count
+		sum += s.Avg * float64(s.Count)
+	}
+	if err := tally(ctx, stream, io.Discard, opts); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "records: %d\n", count)
+	if count > 0 {
+		fmt.Fprintf(w, "first: %s\nlast: %s\nmean: %.*f\n", first, last, opts.Precision, sum/float64(count))
+	}
+	return nil
+}
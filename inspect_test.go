@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSubcommands(t *testing.T) {
+	const records = "2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n2021-03-04T04:10:00Z 6\n"
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte(records), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "run by default", args: []string{"--input=" + input}, want: "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   6.0000\n"},
+		{name: "run", args: []string{"run", "--input=" + input}, want: "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   6.0000\n"},
+		{name: "validate", args: []string{"validate", "--input=" + input}, want: "records: 3\nmalformed: 0\n"},
+		{name: "stats", args: []string{"stats", "--input=" + input}, want: "records: 3\nfirst: 2021-03-04T03:00:00Z\nlast: 2021-03-04T04:10:00Z\nmean: 3.0000\n"},
+		{name: "stats precision", args: []string{"stats", "--precision=1", "--input=" + input}, want: "records: 3\nfirst: 2021-03-04T03:00:00Z\nlast: 2021-03-04T04:10:00Z\nmean: 3.0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if stdout, stderr, code := runMain(t, tt.args...); code != exitOK || stdout != tt.want {
+				t.Errorf("got %d, %q, %q, want %q", code, stdout, stderr, tt.want)
+			}
+		})
+	}
+
+	// the range as the first argument is run as well
+	url := newTestAPI(t)
+	if stdout, stderr, code := runMain(t, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z", "--url="+url); code != exitOK || stdout != "2021-03-04T03:00:00Z   3.2500\n" {
+		t.Errorf("got %d, %q, %q", code, stdout, stderr)
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte("2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z one\n2021-03-04T03:20:00Z 3\nnot a record\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// every malformed record is reported, then the counts
+	stdout, stderr, code := runMain(t, "validate", "--input="+input)
+	want := "line 2: invalid value. invalid data format: 2021-03-04T03:10:00Z one\n" +
+		"line 4: too short record(12 bytes). invalid data format: not a record\n" +
+		"records: 4\nmalformed: 2\n"
+	if code != exitError || stdout != want || !strings.Contains(stderr, "Error: 2 malformed record(s)") {
+		t.Errorf("got %d, %q, %q, want %q", code, stdout, stderr, want)
+	}
+
+	// while run fails at the invalid value
+	if _, stderr, code = runMain(t, "run", "--input="+input); code != exitError || !strings.Contains(stderr, `parse error: strconv.ParseFloat: parsing "one": invalid syntax`) {
+		t.Errorf("got %d, %q, want the parse error", code, stderr)
+	}
+}
+
+func TestStatsEmpty(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if stdout, stderr, code := runMain(t, "stats", "--input="+input); code != exitOK || stdout != "records: 0\n" {
+		t.Errorf("got %d, %q, %q, want no first, last nor mean", code, stdout, stderr)
+	}
+}
+
+func TestSubcommandFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		// the output of run means nothing to the others
+		{args: []string{"stats", "--emit-rate"}, err: "unknown flag: --emit-rate"},
+		{args: []string{"stats", "--output=out.txt"}, err: "unknown flag: --output"},
+		{args: []string{"validate", "--precision=2"}, err: "unknown flag: --precision"},
+		{args: []string{"validate", "--strict"}, err: "unknown flag: --strict"},
+		// while reading the records is common
+		{args: []string{"validate", "--input=records.txt", "--skip-header-rows=1"}},
+		{args: []string{"stats", "--input=records.txt", "--min-value=0", "--precision=2"}},
+		{args: []string{"run", "--input=records.txt", "--emit-rate"}},
+	}
+	for _, tt := range tests {
+		_, err := validateSubcommandArgs(tt.args[0], tt.args[1:])
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.err)
+		}
+	}
+
+	if _, stderr, code := runMain(t, "stats", "--emit-rate", "--input=records.txt"); code != exitUsage || !strings.Contains(stderr, "unknown flag: --emit-rate") {
+		t.Errorf("got %d, %q, want the usage error", code, stderr)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// byteLimitReader fails once the source yields more than the limit,
+// unlike io.LimitReader which silently truncates.
+type byteLimitReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+func newByteLimitReader(r io.Reader, limit int64) *byteLimitReader {
+	return &byteLimitReader{r: r, limit: limit, remaining: limit}
+}
+
+func (l *byteLimitReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if l.remaining <= 0 {
+		// probe whether the source has more
+		var probe [1]byte
+		if n, err = l.r.Read(probe[:]); n > 0 {
+			return 0, fmt.Errorf("aborted after reading %d bytes, the stream is larger than expected", l.limit)
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err = l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// contentLengthReader reports io.ErrUnexpectedEOF when the source ends short of the Content-Length,
+// e.g. the connection dropped, as the body stream reports it as the clean io.EOF.
+type contentLengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func newContentLengthReader(r io.Reader, length int64) *contentLengthReader {
+	return &contentLengthReader{r: r, remaining: length}
+}
+
+func (c *contentLengthReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
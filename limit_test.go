@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestByteLimitReader(t *testing.T) {
+	data := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T04:00:00Z 004.0000\n"
+
+	// exactly the limit is fine
+	got, err := io.ReadAll(newByteLimitReader(strings.NewReader(data), int64(len(data))))
+	if err != nil || string(got) != data {
+		t.Errorf("got %q, %v, want the whole stream", got, err)
+	}
+
+	_, err = io.ReadAll(newByteLimitReader(strings.NewReader(data), 30))
+	if err == nil || err.Error() != "aborted after reading 30 bytes, the stream is larger than expected" {
+		t.Errorf("got %v, want the limit tripped", err)
+	}
+}
+
+func TestAbortAfterBytes(t *testing.T) {
+	url := newTestAPI(t)
+	_, stderr, code := runMain(t, "--url="+url, "--abort-after-bytes=100", "2021-03-04T00:00:00Z", "2021-03-04T05:00:00Z")
+	if code != exitError || !strings.Contains(stderr, "aborted after reading 100 bytes") {
+		t.Errorf("got %d, %q, want the limit tripped", code, stderr)
+	}
+}
+
+func TestContentLengthReader(t *testing.T) {
+	data := "2021-03-04T03:00:00Z 001.0000\n"
+
+	if _, err := io.ReadAll(newContentLengthReader(strings.NewReader(data), int64(len(data)))); err != nil {
+		t.Errorf("got %v, want the clean EOF", err)
+	}
+	if _, err := io.ReadAll(newContentLengthReader(strings.NewReader(data), int64(len(data))+1)); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
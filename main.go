@@ -1,143 +1,871 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof" // Register pprof handlers
 
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
 	"github.com/valyala/fasthttp"
 )
 
 const (
-	// Endpoint for the API
+	// Default endpoint for the API
 	apiURL = "https://tsserv.tinkermode.dev/data"
-	// Entire process timeout.
+	// Default entire process timeout.
 	// Must complete entire process within this timeout.
 	// Otherwise, print tentative result and exit.
 	processTimeout = 5 * time.Minute
-	// Request timeout
+	// Default request timeout
 	requestTimeout = 100 * time.Second
+	// Attempts of a fetch, including the first one
+	fetchAttempts = 3
+	// Profile output files
+	cpuProfilePath = "cpu.prof"
+	memProfilePath = "mem.prof"
+	// Prefix of --input to read from the Unix domain socket
+	unixInputPrefix = "unix://"
+	// Responses larger than this are streamed instead of buffered
+	bodyStreamThreshold = 64 * 1024
+	// Environment variable of the API token, used without --token
+	tokenEnv = "MODE_API_TOKEN"
 )
 
-func handleError(err error, callbackBeforeExit func()) {
+// now returns the current time. Replaceable for testing.
+var now = time.Now
+
+// fetchBackoff is the delay before the first retry of a fetch, doubled on each retry. Replaceable for testing.
+var fetchBackoff = time.Second
+
+// Exit codes of the process
+//
+//	0   success
+//	1   failed to aggregate the data, or other errors
+//	2   timeout reached mid-stream, after printing the partial result
+//	64  invalid command line arguments
+//	69  failed to fetch the data
+//	130 interrupted by SIGINT or SIGTERM mid-stream, after printing the partial result
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitTimeout     = 2
+	exitUsage       = 64
+	exitFetch       = 69
+	exitInterrupted = 130
+)
+
+// exit terminates the process. Replaceable for testing.
+var exit = os.Exit
+
+func handleError(err error, code int, callbackBeforeExit func()) {
 	if err != nil {
-		fmt.Println("Error:", err)
+		// stderr, so the error is never mistaken for the output, e.g. after the partial result
+		fmt.Fprintln(os.Stderr, "Error:", err)
 		if callbackBeforeExit != nil {
 			callbackBeforeExit()
 		}
-		os.Exit(1)
+		exit(code)
 	}
 }
 
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), processTimeout)
+	// Ctrl-C cancels the run the same as the timeout, so the completed time slots are flushed
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// a second signal kills the process, e.g. when stuck reading the stream
+	context.AfterFunc(sigCtx, stop)
+	ctx, cancel := context.WithTimeout(sigCtx, processTimeout)
 	defer cancel()
 
+	// offline smoke test of the whole pipeline
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		err := selftest(ctx)
+		handleError(err, exitError, nil)
+		fmt.Println("selftest passed")
+		return
+	}
+
+	// serve the aggregation over http
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		addr := defaultServeAddr
+		for _, arg := range os.Args[2:] {
+			if value, ok := strings.CutPrefix(arg, "--max-parallel-fetches="); ok {
+				n, err := parseMaxParallelFetches(value)
+				handleError(err, exitUsage, nil)
+				setMaxParallelFetches(n)
+			} else {
+				addr = arg
+			}
+		}
+		err := serve(addr)
+		handleError(err, exitError, nil)
+		return
+	}
+
+	// aggregate each of the ranges listed in a file
+	if len(os.Args) > 2 && os.Args[1] == "batch" {
+		// the flags are validated per range
+		err := runBatch(ctx, os.Args[2], os.Args[3:], os.Stdout)
+		code := exitError
+		if errors.Is(err, errBatchFetch) {
+			code = exitFetch
+		}
+		handleError(err, code, nil)
+		return
+	}
+
+	// run by default, so the plain range keeps working
+	command, args := commandRun, os.Args[1:]
+	if len(args) > 0 && (args[0] == commandRun || args[0] == commandValidate || args[0] == commandStats) {
+		command, args = args[0], args[1:]
+	}
+
 	// validate command args, then obtain start and end time
-	st, ed, isDebug, err := validateCommandArgs(os.Args[1:])
-	handleError(err, nil)
+	opts, err := validateSubcommandArgs(command, args)
+	handleError(err, exitUsage, nil)
+	// the timeout may be overridden by the flag
+	cancel()
+	ctx, cancel = context.WithTimeout(sigCtx, opts.processTimeout)
+	defer cancel()
+	setMaxParallelFetches(opts.maxParallelFetches)
 
-	if isDebug {
-		// print the start and end time
-		fmt.Printf("Start time: %s, End time: %s\n", st.Format(time.RFC3339), ed.Format(time.RFC3339))
+	if opts.isDebug {
+		// print the start and end time. stderr, so the output stays parseable
+		fmt.Fprintf(os.Stderr, "Start time: %s, End time: %s\n", opts.St.Format(time.RFC3339), opts.Ed.Format(time.RFC3339))
+		fmt.Fprintf(os.Stderr, "Granularity: %s\n", opts.Granularity.Name)
+		fmt.Fprintf(os.Stderr, "Process timeout: %s, Request timeout: %s, Parallelism: %d\n", opts.processTimeout, opts.requestTimeout, opts.parallelism)
 
 		// live profiling
 		go func() {
 			err = http.ListenAndServe("localhost:6060", nil)
-			handleError(err, nil)
+			handleError(err, exitError, nil)
 		}()
 	}
 
+	if opts.dryRun {
+		// print what would be requested, then exit without reading the data
+		dryRun(newClient(opts), opts, os.Stdout)
+		return
+	}
+
+	var stopCPUProfile func()
+	if opts.profileMode == profileModeCPU || opts.profileMode == profileModeBoth {
+		stopCPUProfile = startCPUProfile()
+		defer stopCPUProfile()
+	}
+
+	var report *runReport
+	if opts.reportPath != "" {
+		report = newRunReport(opts)
+		opts.Stats = &report.Stats
+	}
+	// clean up on error exit. err is the latest error of the run
+	beforeExit := func() {
+		if stopCPUProfile != nil {
+			stopCPUProfile()
+		}
+		if report != nil {
+			if werr := report.write(opts.reportPath, err); werr != nil {
+				fmt.Fprintln(os.Stderr, "Warning:", werr)
+			}
+		}
+	}
+
 	// fetch data
-	stream, bodyStreamResp, err := fetch(st, ed, isDebug)
-	if bodyStreamResp != nil {
-		defer fasthttp.ReleaseResponse(bodyStreamResp)
+	var stream io.Reader
+	if len(opts.inputPaths) > 1 {
+		// all opened upfront, so an unreadable one fails before any output
+		for _, path := range opts.inputPaths {
+			var f *os.File
+			f, err = os.Open(path)
+			handleError(err, exitFetch, beforeExit)
+			defer f.Close()
+			var r io.Reader
+			r, err = wrapStream(ctx, f, opts)
+			handleError(err, exitFetch, beforeExit)
+			opts.sources = append(opts.sources, aggregate.Source{Name: path, R: r})
+		}
+	} else if opts.inputPath == "-" {
+		stream = os.Stdin
+	} else if socket, ok := strings.CutPrefix(opts.inputPath, unixInputPrefix); ok {
+		// streamed by a local producer, e.g. a sidecar
+		var conn net.Conn
+		conn, err = (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		handleError(err, exitFetch, beforeExit)
+		defer conn.Close()
+		stream = conn
+	} else if opts.inputPath != "" {
+		var f *os.File
+		f, err = os.Open(opts.inputPath)
+		handleError(err, exitFetch, beforeExit)
+		defer f.Close()
+		stream = f
+	} else if opts.inputURL != "" {
+		var body io.ReadCloser
+		body, err = openObject(ctx, opts.inputURL)
+		handleError(err, exitFetch, beforeExit)
+		defer body.Close()
+		stream = body
+	} else {
+		client := newClient(opts)
+		if opts.preflight {
+			var est volumeEstimate
+			est, err = preflight(ctx, client, opts)
+			handleError(err, exitFetch, beforeExit)
+			fmt.Fprintf(os.Stderr, "preflight: estimated %d KB, %d records\n", est.Bytes/1024, est.Records)
+			if opts.preflightMaxBytes > 0 && est.Bytes > opts.preflightMaxBytes {
+				err = fmt.Errorf("estimated %d bytes exceeds --preflight-confirm=%d. aborted", est.Bytes, opts.preflightMaxBytes)
+				handleError(err, exitError, beforeExit)
+			}
+		}
+
+		if opts.parallelism > 1 {
+			var release func()
+			stream, release, err = fetchParallel(ctx, client, opts, opts.parallelism)
+			handleError(err, exitFetch, beforeExit)
+			defer release()
+		} else {
+			var release func()
+			stream, release, err = fetchCached(ctx, client, opts, opts.St, opts.Ed)
+			handleError(err, exitFetch, beforeExit)
+			defer release()
+		}
+	}
+
+	if opts.sources == nil {
+		stream, err = wrapStream(ctx, stream, opts)
+		handleError(err, exitFetch, beforeExit)
 	}
-	handleError(err, nil)
 
 	// tally up the data
-	err = tally(ctx, stream)
-	handleError(err, nil)
+	switch {
+	case command == commandValidate:
+		err = validate(ctx, stream, os.Stdout, opts)
+	case command == commandStats:
+		err = printStats(ctx, stream, os.Stdout, opts)
+	case len(opts.granularities) > 0:
+		err = tallyGranularities(ctx, stream, opts)
+	default:
+		err = tallyToOutput(ctx, stream, opts)
+	}
+	code := exitError
+	if errors.Is(err, aggregate.ErrTimeout) {
+		code = exitTimeout
+	} else if errors.Is(err, aggregate.ErrInterrupted) {
+		code = exitInterrupted
+	}
+	handleError(err, code, beforeExit)
 
-	if isDebug {
+	if opts.chunk > 0 {
+		// pass to the next run by `--cursor`
+		fmt.Fprintf(os.Stderr, "cursor: %s\n", opts.nextCursor)
+	}
+
+	if opts.profileMode == profileModeMem || opts.profileMode == profileModeBoth {
 		takeMemProfile()
 	}
+
+	if report != nil {
+		err = report.write(opts.reportPath, nil)
+		handleError(err, exitError, nil)
+	}
 }
 
-func validateCommandArgs(args []string) (st time.Time, ed time.Time, isDebug bool, err error) {
-	if len(args) < 2 {
-		err = fmt.Errorf("invalid number of arguments. Usage: <start_time> <end_time>")
+// options holds the parsed command line arguments, embedding the ones of the aggregation.
+type options struct {
+	aggregate.Options
+
+	isDebug bool
+	// Pinned addresses by host, used instead of DNS resolution.
+	resolve map[string]string
+	// Granularity chosen by name. Zero value means the default, hour.
+	bucket aggregate.Granularity
+	// Desired number of time slots. The granularity is selected to yield roughly this many. 0 means disabled.
+	targetBuckets int
+	// Read the response body in background, overlapping the network reads and tally.
+	pipeline bool
+	// Which profiles to capture: cpu, mem, both or none
+	profileMode string
+	// Process only a chunk of this size of the range, then print the cursor of the next chunk. 0 means disabled.
+	chunk time.Duration
+	// Cursor token printed by the previous run
+	cursor string
+	// Cursor token of the next run, resolved from chunk and cursor
+	nextCursor string
+	// Decompression of the stream, one of none, gzip or auto
+	decompress string
+	// Abort once this many bytes are read from the stream. 0 means unlimited.
+	abortAfterBytes int64
+	// Path to write the JSON report of the run at exit. Empty means disabled.
+	reportPath string
+	// Tally in each of these granularities in a single read, writing to a file per granularity. Empty means disabled.
+	granularities []aggregate.Granularity
+	// In batch mode, skip the ranges failed to fetch instead of aborting
+	continueOnFetchError bool
+	// Max number of fetches in flight at once across the process. 0 means unlimited.
+	maxParallelFetches int
+	// Path to write the output. Empty means stdout.
+	outputPath string
+	// Path to write the raw records as read, alongside the aggregated output. Empty means disabled.
+	rawOutputPath string
+	// URL of the object to read instead of fetching from the API, e.g. `s3://bucket/key`. Empty means disabled.
+	inputURL string
+	// Path of the local file to read instead of fetching from the API. `-` means stdin,
+	// and `unix://<path>` the Unix domain socket. Empty means disabled.
+	inputPath string
+	// Paths of the files merged into a single output, when --input is repeated or a comma separated list
+	inputPaths []string
+	// Streams of inputPaths, read instead of the stream
+	sources []aggregate.Source
+	// Estimate the volume of the range by a sample before fetching it
+	preflight bool
+	// Abort when the preflight estimate exceeds this many bytes. 0 means no limit.
+	preflightMaxBytes int64
+	// Endpoint of the API, timeout of the whole process and of each request
+	apiURL         string
+	processTimeout time.Duration
+	requestTimeout time.Duration
+	// Number of chunks the range is split into, fetched concurrently. 1 means a single fetch.
+	parallelism int
+	// Fail when the start or end time is not at the beginning of the minute
+	alignMinute bool
+	// Round the start and end time down to the minute instead
+	truncateMinute bool
+	// Bearer token of the API. Empty means no authentication.
+	token string
+	// Refuse the response of which the body is larger than this many bytes. 0 means unlimited.
+	maxBodySize int64
+	// Directory of the cached response bodies, keyed by the url of the range. Empty means disabled.
+	cacheDir string
+	// Fetch even if cached, refreshing the cache
+	noCache bool
+	// Print the urls of the requests instead of fetching them
+	dryRun bool
+	// ISO 8601 interval `<start_time>/<end_time>`, in place of the positional args. Empty means disabled.
+	interval string
+}
+
+func defaultOptions() options {
+	return options{
+		Options:        aggregate.DefaultOptions(),
+		profileMode:    profileModeNone,
+		decompress:     decompressNone,
+		apiURL:         apiURL,
+		processTimeout: processTimeout,
+		requestTimeout: requestTimeout,
+		parallelism:    1,
+		token:          os.Getenv(tokenEnv),
+	}
+}
+
+const (
+	profileModeCPU  = "cpu"
+	profileModeMem  = "mem"
+	profileModeBoth = "both"
+	profileModeNone = "none"
+)
+
+// validateCommandArgs validates the args of run, the default subcommand.
+func validateCommandArgs(args []string) (opts options, err error) {
+	return validateSubcommandArgs(commandRun, args)
+}
+
+// validateSubcommandArgs validates the args of the subcommand, which takes the flags of its own.
+func validateSubcommandArgs(command string, args []string) (opts options, err error) {
+	opts = defaultOptions()
+
+	// the flags, e.g. `--name=value`, are interleaved with the positional args
+	name := os.Args[0]
+	if command != commandRun {
+		name += " " + command
+	}
+	fs, setErr := newFlagSet(name, opts.commandFlags(command))
+	positional, err := parseFlags(fs, setErr, args)
+	if err != nil {
+		return
+	}
+	if opts.preflightMaxBytes > 0 {
+		// implies the preflight
+		opts.preflight = true
+	}
+	if opts.NumberFormat == aggregate.NumberFormatRaw && (isSet(fs, "precision") || opts.DetectPrecision) {
+		// the digits of raw are those of the value itself
+		err = fmt.Errorf("--number-format=raw cannot be combined with --precision or --value-format-detect")
+		return
+	}
+
+	if err = checkFlags(opts); err != nil {
+		return
+	}
+	if len(opts.inputPaths) > 1 {
+		// a time slot may be in several files
+		opts.Unordered = true
+	}
+
+	if err = parsePositional(&opts, positional); err != nil {
+		return
+	}
+
+	if err = selectGranularity(&opts); err != nil {
+		return
+	}
+
+	if err = narrowToChunk(&opts); err != nil {
+		return
+	}
+
+	opts.Progress = opts.isDebug
+
+	return
+}
+
+// checkFlags makes sure the flags are consistent, as far as known without the range.
+func checkFlags(opts options) (err error) {
+	if opts.Rolling > 0 && (opts.Fill || opts.Agg == aggregate.AggHistogram || opts.Passthrough) {
+		// no single value to roll, or to append to
+		err = fmt.Errorf("--rolling cannot be combined with --fill, --agg=histogram or --passthrough")
+		return
+	}
+
+	if opts.MinValue > opts.MaxValue {
+		err = fmt.Errorf("min value is greater than max value: %v, %v", opts.MinValue, opts.MaxValue)
+		return
+	}
+
+	if opts.Resume && opts.CheckpointPath == "" {
+		err = fmt.Errorf("--resume requires --checkpoint")
+		return
+	}
+
+	if (opts.Agg == aggregate.AggStddev || opts.Agg == aggregate.AggHistogram) && opts.CheckpointPath != "" {
+		// the running mean or the bins are not saved in the checkpoint
+		err = fmt.Errorf("--agg=%s cannot be combined with --checkpoint", opts.Agg)
+		return
+	}
+
+	if opts.Agg == aggregate.AggHistogram && !(opts.HistogramMin < opts.HistogramMax) {
+		err = fmt.Errorf("--agg=histogram requires --histogram-min less than --histogram-max")
+		return
+	}
+
+	if opts.HighPrecision && (opts.Agg != aggregate.AggAvg || opts.CheckpointPath != "") {
+		err = fmt.Errorf("--high-precision only supports --agg=avg without --checkpoint")
+		return
+	}
+
+	if opts.WeightColumn > 0 && (opts.Agg != aggregate.AggAvg || opts.HighPrecision || opts.CheckpointPath != "" || opts.PreBucket.KeyWidth > 0) {
+		err = fmt.Errorf("--weight-column only supports --agg=avg without --high-precision, --checkpoint or --pre-bucket")
+		return
+	}
+
+	if opts.ThousandsSep != 0 {
+		// must not be confused with the field delimiter, the record separator or the number itself
+		if sep := opts.ThousandsSep; sep == ' ' || sep == '\t' || sep == opts.RecordSeparator || strings.IndexByte("0123456789.+-eE", sep) >= 0 {
+			err = fmt.Errorf("invalid input thousands sep: %q, ambiguous with the field delimiter, the record separator or the number", sep)
+			return
+		}
+	}
+
+	if opts.Format == formatParquet {
+		if opts.outputPath == "" {
+			err = fmt.Errorf("--format=parquet requires --output")
+			return
+		}
+		if len(opts.granularities) > 0 || opts.Passthrough || opts.CheckpointPath != "" || opts.TrailingChecksum {
+			err = fmt.Errorf("--format=parquet cannot be combined with --granularities, --passthrough, --checkpoint or --trailing-checksum")
+			return
+		}
+	}
+
+	if opts.Format == aggregate.FormatJSONL && (opts.EmitSchema || opts.ResetMarker != "" || opts.TrailingChecksum || opts.Passthrough || opts.LinePrefix != "" || opts.LineSuffix != "" || opts.NaNAs != "") {
+		// each line must be a JSON object, so neither the comment lines nor the decorations are allowed
+		err = fmt.Errorf("--format=jsonl cannot be combined with --emit-schema, --reset-marker, --trailing-checksum, --passthrough, --line-prefix, --line-suffix or --nan-as")
+		return
+	}
+
+	if opts.Unordered && (opts.HighPrecision || opts.WeightColumn > 0 || !math.IsNaN(opts.Quantile) || opts.CheckpointPath != "" || opts.PreBucket.KeyWidth > 0 || opts.ExpectMonotonic != "") {
+		// the buffered slots hold the accumulator alone
+		err = fmt.Errorf("--unordered cannot be combined with --high-precision, --weight-column, --quantile, --checkpoint, --pre-bucket or --expect-monotonic")
+		return
+	}
+
+	if opts.Fill && (opts.WindowOffset != 0 || opts.ResetMarker != "" || opts.Passthrough || opts.CheckpointPath != "") {
+		// the slots to fill are those of the range in UTC, as a whole
+		err = fmt.Errorf("--fill cannot be combined with --window-offset, --reset-marker, --passthrough or --checkpoint")
+		return
+	}
+
+	if fillValue, _ := strconv.ParseFloat(opts.FillValue, 64); opts.Fill && opts.DropNaN && math.IsNaN(fillValue) {
+		// every placeholder would be dropped
+		err = fmt.Errorf("--fill cannot be combined with --drop-nan unless --fill-value is a number")
+		return
+	}
+
+	if opts.parallelism > 1 && (opts.inputPath != "" || opts.inputURL != "") {
+		err = fmt.Errorf("--parallelism cannot be combined with --input or --input-url")
+		return
+	}
+
+	if opts.cacheDir != "" && (opts.parallelism > 1 || opts.inputPath != "" || opts.inputURL != "") {
+		// only the body of a single fetch is cached
+		err = fmt.Errorf("--cache-dir cannot be combined with --parallelism, --input or --input-url")
+		return
+	}
+
+	if opts.dryRun && (opts.inputPath != "" || opts.inputURL != "") {
+		// nothing is requested
+		err = fmt.Errorf("--dry-run cannot be combined with --input or --input-url")
+		return
+	}
+
+	if opts.noCache && opts.cacheDir == "" {
+		err = fmt.Errorf("--no-cache requires --cache-dir")
+		return
+	}
+
+	if opts.inputPath != "" && opts.inputURL != "" {
+		err = fmt.Errorf("--input cannot be combined with --input-url")
+		return
+	}
+
+	if opts.rawOutputPath != "" && len(opts.granularities) > 0 {
+		err = fmt.Errorf("--raw-output cannot be combined with --granularities")
+		return
+	}
+
+	if !math.IsNaN(opts.Quantile) && (opts.HighPrecision || opts.EmitRate || opts.CheckpointPath != "" || opts.PreBucket.KeyWidth > 0) {
+		err = fmt.Errorf("--quantile cannot be combined with --high-precision, --emit-rate, --checkpoint or --pre-bucket")
+		return
+	}
+
+	if opts.EmitRate && (opts.HighPrecision || opts.WeightColumn > 0) {
+		err = fmt.Errorf("--emit-rate cannot be combined with --high-precision or --weight-column")
+		return
+	}
+
+	if opts.ResetMarker != "" && opts.CheckpointPath != "" {
+		// the segment is not in the checkpoint
+		err = fmt.Errorf("--reset-marker cannot be combined with --checkpoint")
+		return
+	}
+
+	if opts.ClockSkew > 0 && !opts.EnforceRange {
+		err = fmt.Errorf("--clock-skew requires --enforce-range")
 		return
 	}
 
-	if st, err = time.Parse(time.RFC3339, args[0]); err != nil {
-		err = fmt.Errorf("invalid start time: %v, err: %w", args[0], err)
+	if opts.DropNaN && opts.NaNAs != "" {
+		err = fmt.Errorf("--drop-nan cannot be combined with --nan-as")
 		return
 	}
 
-	if ed, err = time.Parse(time.RFC3339, args[1]); err != nil {
-		err = fmt.Errorf("invalid end time: %v, err: %w", args[1], err)
+	if opts.Passthrough && opts.CheckpointPath != "" {
+		err = fmt.Errorf("--passthrough cannot be combined with --checkpoint")
 		return
 	}
 
-	// make sure start time is before end time
-	if st.After(ed) {
-		err = fmt.Errorf("start time is after end time: %v, %v", st, ed)
+	if opts.FixedWidth && (opts.ValueColumnName != "" || opts.RoundTo > 0 || opts.OutputUTC) {
+		err = fmt.Errorf("--fixed-width cannot be combined with --value-column-name, --round-to or --output-utc")
+		return
+	}
+
+	if (opts.TimestampColumn != nil || opts.ValueColumn != nil) && (opts.ValueColumnName != "" || opts.FixedWidth) {
+		err = fmt.Errorf("--ts-col and --value-col cannot be combined with --value-column-name or --fixed-width")
+		return
+	}
+
+	if opts.PartialOutputOnError && opts.CheckpointPath != "" {
+		// the output must not get ahead of the checkpoint
+		err = fmt.Errorf("--partial-output-on-error cannot be combined with --checkpoint")
+		return
+	}
+
+	if len(opts.inputPaths) > 1 {
+		for _, path := range opts.inputPaths {
+			if path == "-" || strings.HasPrefix(path, unixInputPrefix) {
+				err = fmt.Errorf("invalid input: %v, only files can be merged", path)
+				return
+			}
+		}
+		if len(opts.granularities) > 0 || opts.rawOutputPath != "" {
+			err = fmt.Errorf("multiple --input cannot be combined with --granularities or --raw-output")
+			return
+		}
+	}
+	return
+}
+
+// parsePositional parses the positional args, the start and end time followed by `debug` optionally.
+// The range may be given by the interval instead, or neither with --input. It's aligned to the minute as the flags require.
+func parsePositional(opts *options, positional []string) (err error) {
+	if interval := opts.interval; interval != "" {
+		// ISO 8601 interval `<start_time>/<end_time>`, in place of the positional args
+		begin, end, ok := strings.Cut(interval, "/")
+		if !ok || begin == "" || end == "" || strings.Contains(end, "/") {
+			err = fmt.Errorf("invalid interval: %v, must be <start_time>/<end_time>", interval)
+			return
+		}
+		if len(positional) > 0 && positional[0] != "debug" {
+			err = fmt.Errorf("--interval cannot be combined with the positional start and end time")
+			return
+		}
+		positional = append([]string{begin, end}, positional...)
+	}
+
+	// the range is optional with --input, as the data is given
+	hasRange := len(positional) >= 2
+	if !hasRange && opts.inputPath == "" {
+		err = fmt.Errorf("invalid number of arguments. Usage: <start_time> <end_time>")
+		return
+	}
+	if !hasRange && len(positional) == 1 && positional[0] != "debug" {
+		err = fmt.Errorf("invalid number of arguments. Usage: --input=<path> [<start_time> <end_time>]")
+		return
+	}
+	if !hasRange && (opts.targetBuckets > 0 || opts.chunk > 0 || opts.EnforceRange || opts.Fill) {
+		err = fmt.Errorf("--target-buckets, --chunk, --enforce-range and --fill require the start and end time")
 		return
 	}
 
-	// The sec must be zero
-	// Optional, but it's better to have it.
-	// if st.Second() != 0 || ed.Second() != 0 {
-	// 	err = fmt.Errorf("start time and end time must be at the beginning of the minute")
-	// 	return
-	// }
+	if hasRange {
+		if opts.St, err = time.Parse(time.RFC3339, positional[0]); err != nil {
+			err = fmt.Errorf("invalid start time: %v, err: %w", positional[0], err)
+			return
+		}
 
-	// Check if debug mode is enabled
-	if len(args) > 2 && args[2] == "debug" {
-		isDebug = true
+		if opts.Ed, err = time.Parse(time.RFC3339, positional[1]); err != nil {
+			err = fmt.Errorf("invalid end time: %v, err: %w", positional[1], err)
+			return
+		}
+
+		// The sec must be zero
+		// Optional, but it's better to have it.
+		if opts.truncateMinute {
+			opts.St, opts.Ed = opts.St.Truncate(time.Minute), opts.Ed.Truncate(time.Minute)
+		} else if opts.alignMinute && (!opts.St.Equal(opts.St.Truncate(time.Minute)) || !opts.Ed.Equal(opts.Ed.Truncate(time.Minute))) {
+			err = fmt.Errorf("start time and end time must be at the beginning of the minute: %v, %v. use --truncate to round them down", opts.St, opts.Ed)
+			return
+		}
+
+		// make sure start time is before end time
+		if opts.St.After(opts.Ed) {
+			err = fmt.Errorf("start time is after end time: %v, %v", opts.St, opts.Ed)
+			return
+		}
+	}
+
+	// Check if debug mode is enabled. `debug` following the range is kept as the same as --debug
+	if debugArg := len(positional) - 1; debugArg >= 0 && positional[debugArg] == "debug" && (debugArg == 2 || !hasRange) {
+		opts.isDebug = true
+	}
+	return
+}
+
+// selectGranularity selects the granularity by --bucket, --target-buckets or --granularities, then checks the pre-bucket is finer.
+func selectGranularity(opts *options) (err error) {
+	if opts.bucket.KeyWidth > 0 {
+		if opts.targetBuckets > 0 || len(opts.granularities) > 0 {
+			err = fmt.Errorf("--bucket cannot be combined with --target-buckets or --granularities")
+			return
+		}
+		opts.Granularity = opts.bucket
+	}
+
+	if opts.targetBuckets > 0 {
+		if opts.Granularity, err = aggregate.SelectGranularity(opts.St, opts.Ed, opts.targetBuckets); err != nil {
+			return
+		}
+	}
+
+	if len(opts.granularities) > 0 {
+		if opts.targetBuckets > 0 || opts.CheckpointPath != "" || opts.Passthrough || opts.SampleRate > 1 {
+			// the records are parsed, and sampled, once for all of the granularities
+			err = fmt.Errorf("--granularities cannot be combined with --target-buckets, --checkpoint, --passthrough or --sample-rate")
+			return
+		}
+		for _, g := range opts.granularities {
+			if opts.PreBucket.KeyWidth > 0 && opts.PreBucket.KeyWidth <= g.KeyWidth {
+				err = fmt.Errorf("pre bucket(%s) must be finer than the %s granularity", opts.PreBucket.Name, g.Name)
+				return
+			}
+			// the chunk must be aligned to the coarsest
+			if g.Duration > opts.Granularity.Duration {
+				opts.Granularity = g
+			}
+		}
+	}
+
+	if opts.PreBucket.KeyWidth > 0 {
+		if opts.PreBucket.KeyWidth <= opts.Granularity.KeyWidth {
+			err = fmt.Errorf("pre bucket(%s) must be finer than the %s granularity", opts.PreBucket.Name, opts.Granularity.Name)
+			return
+		}
+		if opts.HighPrecision || opts.CheckpointPath != "" {
+			err = fmt.Errorf("--pre-bucket cannot be combined with --high-precision or --checkpoint")
+			return
+		}
+	}
+	return
+}
+
+// narrowToChunk narrows the range down to the chunk of this run, resolving the cursor of the next, by --chunk and --cursor.
+func narrowToChunk(opts *options) (err error) {
+	if opts.cursor != "" && opts.chunk == 0 {
+		err = fmt.Errorf("--cursor requires --chunk")
+		return
 	}
 
+	if opts.chunk > 0 {
+		if opts.chunk%opts.Granularity.Duration != 0 {
+			// otherwise, the chunks vary in size
+			err = fmt.Errorf("chunk(%s) must be a multiple of the %s granularity", opts.chunk, opts.Granularity.Name)
+			return
+		}
+
+		from := opts.St
+		if opts.cursor != "" {
+			if from, err = decodeCursor(opts.cursor); err != nil {
+				return
+			}
+			if from.Before(opts.St) || from.After(opts.Ed) {
+				err = fmt.Errorf("cursor(%s) is out of the range", opts.cursor)
+				return
+			}
+		}
+		opts.St, opts.Ed, opts.nextCursor = chunkRange(from, opts.Ed, opts.chunk, opts.Granularity.Duration)
+	}
 	return
 }
 
-// TODO: Return resp if it's a body stream. I'm not sure what happen if immediate release the response.
-func fetch(st, ed time.Time, isDebug bool) (stream io.Reader, resp *fasthttp.Response, err error) {
+// wrapStream wraps the fetched stream by the readers the options require.
+func wrapStream(ctx context.Context, stream io.Reader, opts options) (io.Reader, error) {
+	if opts.pipeline {
+		stream = newPipelineReader(ctx, stream)
+	}
+
+	// decompress after the pipeline, so that the network reads still overlap
+	stream, err := newDecompressReader(stream, opts.decompress)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.abortAfterBytes > 0 {
+		// guard the decompressed bytes, as those are what's processed
+		stream = newByteLimitReader(stream, opts.abortAfterBytes)
+	}
+	return stream, nil
+}
+
+// parseSeparator parses a single byte separator.
+// Accepts a literal byte (e.g. `;`) or one of the escapes `\n`, `\r`, `\t` and `\0`.
+func parseSeparator(value string) (sep byte, err error) {
+	switch value {
+	case `\n`:
+		return '\n', nil
+	case `\r`:
+		return '\r', nil
+	case `\t`:
+		return '\t', nil
+	case `\0`:
+		return 0, nil
+	}
+	if len(value) != 1 {
+		err = fmt.Errorf("invalid separator: %q, must be a single byte", value)
+		return
+	}
+	return value[0], nil
+}
+
+// newClient creates the http client.
+// If resolve is set, dials the pinned address for the host instead of resolving it.
+// The original host is still used for the Host header and TLS server name.
+func newClient(opts options) *fasthttp.Client {
+	// return the response before the whole body is read, so tally can start early.
+	// A body up to the threshold is read whole, so the chunks of --parallelism hold at most
+	// parallelism * bodyStreamThreshold bytes between them, the rest read from the connections as consumed
+	client := &fasthttp.Client{
+		StreamResponseBody:  true,
+		MaxResponseBodySize: bodyStreamThreshold,
+	}
+	if len(opts.resolve) > 0 {
+		client.Dial = func(addr string) (net.Conn, error) {
+			if host, port, err := net.SplitHostPort(addr); err == nil {
+				if ip, ok := opts.resolve[host]; ok {
+					addr = net.JoinHostPort(ip, port)
+				}
+			}
+			return fasthttp.Dial(addr)
+		}
+	}
+	return client
+}
+
+// rangeURL returns the url of the API requesting the range.
+func rangeURL(opts options, st, ed time.Time) string {
+	return fmt.Sprintf("%s?begin=%s&end=%s", opts.apiURL, st.Format(time.RFC3339), ed.Format(time.RFC3339))
+}
+
+// fetch requests the data of the range, by the endpoint, token and timeout of the options.
+// The caller must call release after consuming the stream. Until then, the fetch slot is held by a streamed body.
+func fetch(ctx context.Context, client *fasthttp.Client, opts options, st, ed time.Time) (stream io.Reader, release func(), err error) {
+	slot, err := acquireFetch(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fetchInSlot(ctx, client, opts, st, ed, slot)
+}
+
+// fetchInSlot is fetch of the fetch slot already acquired, released by release or on the error.
+// The slot is held through the retries, as well as the body.
+func fetchInSlot(ctx context.Context, client *fasthttp.Client, opts options, st, ed time.Time, slot func()) (stream io.Reader, release func(), err error) {
 	var (
-		url           = fmt.Sprintf("%s?begin=%s&end=%s", apiURL, st.Format(time.RFC3339), ed.Format(time.RFC3339))
-		req           = fasthttp.AcquireRequest()
-		hasBodyStream = false
+		uri     = rangeURL(opts, st, ed)
+		req     = fasthttp.AcquireRequest()
+		isDebug = opts.isDebug
 	)
-	req.SetRequestURI(url)
+	req.SetRequestURI(uri)
 	req.Header.SetMethod("GET")
+	if opts.token != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+opts.token)
+	}
 
-	resp = fasthttp.AcquireResponse()
+	resp := fasthttp.AcquireResponse()
 	defer func() {
-		if !hasBodyStream {
-			// clean up response if it's not a body stream
+		if err != nil {
+			// clean up response as nothing to consume
 			fasthttp.ReleaseResponse(resp)
+			slot()
 		}
 	}()
 
-	err = fasthttp.DoTimeout(req, resp, requestTimeout)
+	err = doWithRetry(ctx, client, req, resp, opts.requestTimeout, isDebug)
 	fasthttp.ReleaseRequest(req)
 	if err != nil {
 		err = fmt.Errorf("failed to fetch data: %w", err)
 		return
 	}
 
-	if statusCode := resp.StatusCode(); statusCode != fasthttp.StatusOK {
+	switch statusCode := resp.StatusCode(); statusCode {
+	case fasthttp.StatusOK:
+	case fasthttp.StatusUnauthorized, fasthttp.StatusForbidden:
+		err = fmt.Errorf("authentication failed: status code %d. check --token or %s", statusCode, tokenEnv)
+		return
+	default:
 		err = fmt.Errorf("unexpected status code: %d", statusCode)
 		return
 	}
@@ -150,120 +878,130 @@ func fetch(st, ed time.Time, isDebug bool) (stream io.Reader, resp *fasthttp.Res
 
 	// print content length in KB order
 	if isDebug {
-		fmt.Printf("Content-Length: %d KB\n", resp.Header.ContentLength()/1024)
+		fmt.Fprintf(os.Stderr, "Content-Length: %d KB\n", resp.Header.ContentLength()/1024)
+	}
+
+	if opts.maxBodySize > 0 && int64(resp.Header.ContentLength()) > opts.maxBodySize {
+		// refused before reading the body
+		err = fmt.Errorf("response body exceeds the max body size(%d bytes): Content-Length %d", opts.maxBodySize, resp.Header.ContentLength())
+		return
 	}
 
 	if resp.IsBodyStream() {
-		// from the doc, more than 10MB will be returned as a body stream
-		// But, not works as the server doesn't support it
-		// It's required server support: `Transfer-Encoding: chunked` or `Content-Length` is set
-		hasBodyStream = true
+		// a large body is read from the connection as tally consumes it, so the memory is flat
 		stream = resp.BodyStream()
-		if isDebug {
-			// haven't reach here yet
-			fmt.Println("body stream enabled")
+		if length := resp.Header.ContentLength(); length > 0 {
+			stream = newContentLengthReader(stream, int64(length))
+		}
+		if opts.maxBodySize > 0 {
+			// the length is unknown in advance when chunked
+			stream = newByteLimitReader(stream, opts.maxBodySize)
 		}
-	} else {
-		data := resp.Body()
-		stream = bytes.NewReader(data)
 		if isDebug {
-			// print the size of the data by KB order
-			fmt.Printf("Data size: %d KB\n", len(data)/1024)
+			fmt.Fprintln(os.Stderr, "body stream enabled")
 		}
+		// the body is read from the connection until released, so is the slot
+		return stream, func() {
+			fasthttp.ReleaseResponse(resp)
+			slot()
+		}, nil
 	}
 
-	return
+	data := resp.Body()
+	if isDebug {
+		// print the size of the data by KB order
+		fmt.Fprintf(os.Stderr, "Data size: %d KB\n", len(data)/1024)
+	}
+	// read in full already
+	slot()
+	return bytes.NewReader(data), func() { fasthttp.ReleaseResponse(resp) }, nil
 }
 
-func tally(ctx context.Context, stream io.Reader) (err error) {
-	var (
-		n             int
-		writer        = bufio.NewWriter(os.Stdout)
-		buf           = make([]byte, 30)
-		prevTimeSlot  [13]byte
-		score         float64
-		sum           float64
-		count         int
-		tallyAndPrint = func(timeSlot [13]byte, sum float64, count int) {
-			avg := sum / float64(count)
-			writer.WriteString(fmt.Sprintf("%s:00:00Z %8.4f\n", timeSlot, avg))
+// doWithRetry sends the request, retrying with exponential backoff on connection errors, 5xx and 429, but not on the other 4xx.
+// On 429 and 503, the Retry-After header takes precedence over the backoff. The last failed response is left to the caller. It gives up early rather than sleeping past the deadline of the context.
+func doWithRetry(ctx context.Context, client *fasthttp.Client, req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration, isDebug bool) error {
+	delay := fetchBackoff
+	for attempt := 1; ; attempt++ {
+		err := client.DoTimeout(req, resp, timeout)
+		if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+			// the same on retry
+			return fmt.Errorf("response body exceeds the max body size(%d bytes)", client.MaxResponseBodySize)
 		}
-	)
-	defer writer.Flush()
-
-	for {
-		// make sure timeout is not reached
-		if ctx.Err() != nil {
-			err = fmt.Errorf("timeout reached(%s seconds). please extend the timeout: %w", requestTimeout.String(), ctx.Err())
-			return
+		statusCode := resp.StatusCode()
+		if err == nil && statusCode < fasthttp.StatusInternalServerError && statusCode != fasthttp.StatusTooManyRequests {
+			return nil
 		}
 
-		// read from stream
-		n, err = stream.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			err = fmt.Errorf("read error: %w", err)
-			return
+		if attempt == fetchAttempts {
+			return err
 		}
-
-		// if there is data to process
-		if n > 0 {
-			// We assume the data format is always correct.
-			// YYYY-MM-DDTHH:MM:SSZ 000.0000\n
-			// To confirm this, just check the last byte. make sure the last is new line
-			if buf[n-1] != '\n' {
-				err = fmt.Errorf("the last is not a new line. invalid data format: %s", buf[:n])
-				return
+		wait := delay
+		if statusCode == fasthttp.StatusTooManyRequests || statusCode == fasthttp.StatusServiceUnavailable {
+			// the server knows better when to come back
+			if d, ok := retryAfter(&resp.Header); ok {
+				wait = d
 			}
-
-			// extract `YYYY-MM-DD HH` part
-			timeSlot := buf[:13]
-			// extract the number
-			score, err = strconv.ParseFloat(strings.TrimSpace(string(buf[21:29])), 32)
+		}
+		if deadline, ok := ctx.Deadline(); ok && now().Add(wait).After(deadline) {
+			return err
+		}
+		if isDebug {
+			reason := fmt.Sprintf("status code %d", statusCode)
 			if err != nil {
-				err = fmt.Errorf("parse error: %w", err)
-				return
+				reason = err.Error()
 			}
+			// stderr, apart from the output
+			fmt.Fprintf(os.Stderr, "retry %d/%d in %s: %s\n", attempt, fetchAttempts-1, wait, reason)
+		}
 
-			if count == 0 {
-				// The fist iteration, set the prev time slot
-				copy(prevTimeSlot[:], timeSlot)
-			}
-
-			if bytes.Equal(timeSlot, prevTimeSlot[:]) {
-				// within the same time slot, go to next
-				sum += score
-				count++
-				continue
-			}
-
-			// tally up the score
-			tallyAndPrint(prevTimeSlot, sum, count)
-
-			// Go to next time slot
-			copy(prevTimeSlot[:], timeSlot)
-			count = 1
-			sum = score
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
 		}
+		resp.Reset()
+		delay *= 2
 	}
+}
 
-	// tally up the last time slot
-	tallyAndPrint(prevTimeSlot, sum, count)
+// retryAfter returns the delay of the Retry-After header, either in seconds or an HTTP date.
+func retryAfter(header *fasthttp.ResponseHeader) (time.Duration, bool) {
+	value := header.Peek(fasthttp.HeaderRetryAfter)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(string(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := fasthttp.ParseHTTPDate(value); err == nil {
+		return max(date.Sub(now()), 0), true
+	}
+	return 0, false
+}
+
+// startCPUProfile starts CPU profiling, returns the function to stop it.
+func startCPUProfile() (stop func()) {
+	f, err := os.Create(cpuProfilePath)
+	handleError(err, exitError, nil)
 
-	return nil
+	err = pprof.StartCPUProfile(f)
+	handleError(err, exitError, nil)
+
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+	}
 }
 
 func takeMemProfile() {
 	// Dump heap profile at end
-	f, err := os.Create("mem.prof")
-	handleError(err, nil)
+	f, err := os.Create(memProfilePath)
+	handleError(err, exitError, nil)
 	defer f.Close()
 
 	// Force GC to get up-to-date statistics
 	runtime.GC()
 
 	err = pprof.WriteHeapProfile(f)
-	handleError(err, nil)
+	handleError(err, exitError, nil)
 }
@@ -0,0 +1,1310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+	"github.com/valyala/fasthttp"
+)
+
+// testRecords returns the records every 10 minutes of [begin, end], of which the value is `hour.minute`, e.g. 3.2 at 03:20.
+func testRecords(begin, end time.Time) string {
+	var b strings.Builder
+	for t := begin; !t.After(end); t = t.Add(10 * time.Minute) {
+		fmt.Fprintf(&b, "%s %8.4f\n", t.Format(time.RFC3339), float64(t.Hour())+float64(t.Minute())/100)
+	}
+	return b.String()
+}
+
+// newTestAPI starts a stub of the API serving testRecords of the requested range, returning its url.
+func newTestAPI(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin, err1 := time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
+		end, err2 := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid range", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, testRecords(begin, end))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/data"
+}
+
+func TestTallyToOutputAtomic(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "out.txt")
+		opts = defaultOptions()
+	)
+	opts.outputPath = path
+
+	if err := tallyToOutput(context.Background(), strings.NewReader("2021-03-04T03:00:00Z 1\n"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "2021-03-04T03:00:00Z   1.0000\n" {
+		t.Errorf("got %q", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o644 {
+		t.Errorf("got %v, %v, want 0644", info.Mode(), err)
+	}
+
+	// a failed run leaves the previous output as is, without the temporary file
+	opts.Strict = true
+	if err := tallyToOutput(context.Background(), strings.NewReader("2021-03-04T04:00:00Z 2\nbroken\n"), opts); err == nil {
+		t.Fatal("want the error of the malformed record")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "2021-03-04T03:00:00Z   1.0000\n" {
+		t.Errorf("got %q, want the previous output", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d entries, want only the output", len(entries))
+	}
+}
+
+// mustAggregate tallies the input with the options, failing the test on the error.
+func mustAggregate(t *testing.T, opts options, input string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := tally(context.Background(), strings.NewReader(input), &out, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return out.String()
+}
+
+// captureOutput returns what f writes to os.Stdout and os.Stderr.
+func captureOutput(t *testing.T, f func()) (stdout, stderr string) {
+	t.Helper()
+	capture := func(file **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := *file
+		*file = w
+		done := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(r)
+			done <- string(b)
+		}()
+		return func() string {
+			*file = orig
+			w.Close()
+			return <-done
+		}
+	}
+	restoreStdout, restoreStderr := capture(&os.Stdout), capture(&os.Stderr)
+	f()
+	return restoreStdout(), restoreStderr()
+}
+
+// fakeExit replaces exit with the one recording the code, until the test ends. -1 means not exited.
+func fakeExit(t *testing.T) *int {
+	t.Helper()
+	code := -1
+	orig := exit
+	t.Cleanup(func() { exit = orig })
+	exit = func(c int) { code = c }
+	return &code
+}
+
+func TestHandleError(t *testing.T) {
+	code := fakeExit(t)
+	var cleaned bool
+	stdout, stderr := captureOutput(t, func() {
+		handleError(errors.New("boom"), exitFetch, func() { cleaned = true })
+	})
+	if stdout != "" || stderr != "Error: boom\n" {
+		t.Errorf("got stdout %q, stderr %q, want the error in stderr only", stdout, stderr)
+	}
+	if *code != exitFetch || !cleaned {
+		t.Errorf("got code %d, cleaned %v", *code, cleaned)
+	}
+
+	*code = -1
+	handleError(nil, exitError, func() { t.Error("called without the error") })
+	if *code != -1 {
+		t.Errorf("exited with %d without the error", *code)
+	}
+}
+
+// runMain runs main with the args, returning the output and the exit code, 0 if not exited.
+func runMain(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	origArgs, origExit := os.Args, exit
+	t.Cleanup(func() { os.Args, exit = origArgs, origExit })
+	os.Args = append([]string{"tally"}, args...)
+	// unwinds main instead of terminating the test
+	type exited struct{ code int }
+	exit = func(c int) { panic(exited{c}) }
+
+	stdout, stderr = captureOutput(t, func() {
+		defer func() {
+			if r := recover(); r != nil {
+				e, ok := r.(exited)
+				if !ok {
+					panic(r)
+				}
+				code = e.code
+			}
+		}()
+		main()
+	})
+	return
+}
+
+func TestParseSeparator(t *testing.T) {
+	for value, want := range map[string]byte{`\n`: '\n', `\r`: '\r', `\t`: '\t', `\0`: 0, ";": ';', "|": '|'} {
+		if got, err := parseSeparator(value); err != nil || got != want {
+			t.Errorf("parseSeparator(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", ";;", `\x`} {
+		if _, err := parseSeparator(value); err == nil {
+			t.Errorf("parseSeparator(%q) succeeded, want the error", value)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		fmt.Fprint(w, "2021-03-04T03:00:00Z 1\n")
+	}))
+	defer srv.Close()
+	_, port, _ := strings.Cut(strings.TrimPrefix(srv.URL, "http://"), ":")
+
+	// the reserved TLD never resolves, so only the pinned address is reachable
+	opts, err := validateCommandArgs([]string{"--url=http://api.invalid:" + port + "/data", "--resolve=api.invalid:127.0.0.1", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, release, err := fetch(context.Background(), newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		t.Fatalf("failed to fetch by the pinned address: %v", err)
+	}
+	defer release()
+	if body, _ := io.ReadAll(stream); string(body) != "2021-03-04T03:00:00Z 1\n" {
+		t.Errorf("got body %q", body)
+	}
+	if host != "api.invalid:"+port {
+		t.Errorf("got Host %q, want the original host", host)
+	}
+
+	for _, value := range []string{"api.invalid", "api.invalid:localhost", ":127.0.0.1"} {
+		if _, err = validateCommandArgs([]string{"--resolve=" + value, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil {
+			t.Errorf("--resolve=%s accepted, want the error", value)
+		}
+	}
+}
+
+func TestProfileMode(t *testing.T) {
+	for _, mode := range []string{"cpu", "mem", "both", "none"} {
+		if opts, err := validateCommandArgs([]string{"--profile-mode=" + mode, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil || opts.profileMode != mode {
+			t.Errorf("--profile-mode=%s: got %q, %v", mode, opts.profileMode, err)
+		}
+	}
+	if _, err := validateCommandArgs([]string{"--profile-mode=trace", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil {
+		t.Error("want the error of the unknown mode")
+	}
+
+	dir := t.TempDir()
+	chdir(t, dir)
+	stop := startCPUProfile()
+	mustAggregate(t, defaultOptions(), "2021-03-04T03:00:00Z 001.0000\n")
+	stop()
+	takeMemProfile()
+	for _, name := range []string{cpuProfilePath, memProfilePath} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Size() == 0 {
+			t.Errorf("got %v, want the profile %s", err, name)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "ok", args: []string{"selftest"}, want: exitOK},
+		{name: "unknown flag", args: []string{"--no-such-flag", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}, want: exitUsage},
+		{name: "missing range", args: []string{"2021-03-04T03:00:00Z"}, want: exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if stdout, _, code := runMain(t, tt.args...); code != tt.want {
+				t.Errorf("got %d, want %d: %s", code, tt.want, stdout)
+			}
+		})
+	}
+}
+
+func TestInterval(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"--interval=2021-03-04T03:00:00Z/2021-03-04T05:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.St.Format(time.RFC3339) != "2021-03-04T03:00:00Z" || opts.Ed.Format(time.RFC3339) != "2021-03-04T05:00:00Z" {
+		t.Errorf("got %s - %s", opts.St, opts.Ed)
+	}
+	if opts, err = validateCommandArgs([]string{"--interval=2021-03-04T03:00:00Z/2021-03-04T05:00:00Z", "debug"}); err != nil || !opts.isDebug {
+		t.Errorf("got %v, debug %v, want the interval with debug", err, opts.isDebug)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "no slash", args: []string{"--interval=2021-03-04T03:00:00Z"}, want: "invalid interval"},
+		{name: "no start", args: []string{"--interval=/2021-03-04T05:00:00Z"}, want: "invalid interval"},
+		{name: "no end", args: []string{"--interval=2021-03-04T03:00:00Z/"}, want: "invalid interval"},
+		{name: "three parts", args: []string{"--interval=2021-03-04T03:00:00Z/2021-03-04T04:00:00Z/2021-03-04T05:00:00Z"}, want: "invalid interval"},
+		{name: "duration", args: []string{"--interval=2021-03-04T03:00:00Z/PT2H"}, want: "invalid end time"},
+		{name: "reversed", args: []string{"--interval=2021-03-04T05:00:00Z/2021-03-04T03:00:00Z"}, want: "start time"},
+		{name: "with positional", args: []string{"--interval=2021-03-04T03:00:00Z/2021-03-04T05:00:00Z", "2021-03-04T03:00:00Z", "2021-03-04T05:00:00Z"}, want: "cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := validateCommandArgs(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineAffixesFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--line-prefix=a\nb"}, want: "invalid line prefix"},
+		{args: []string{"--line-suffix=\r"}, want: "invalid line suffix"},
+		{args: []string{"--line-prefix=temp,", "--format=jsonl"}, want: "--format=jsonl cannot be combined"},
+		{args: []string{"--line-suffix=;", "--format=jsonl"}, want: "--format=jsonl cannot be combined"},
+	}
+	for _, tt := range tests {
+		_, err := validateCommandArgs(append(tt.args, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+	if _, err := validateCommandArgs([]string{"--line-prefix=temp,", "--format=parquet", "--output=out.parquet", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil {
+		t.Errorf("got %v, want the affixes ignored by parquet", err)
+	}
+}
+
+func TestThousandsSepAmbiguous(t *testing.T) {
+	for _, sep := range []string{".", " ", `\t`, "-", "5", ";"} {
+		args := []string{"--input-thousands-sep=" + sep, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}
+		if sep == ";" {
+			args = append(args, "--record-separator=;")
+		}
+		_, err := validateCommandArgs(args)
+		if err == nil || !strings.Contains(err.Error(), "invalid input thousands sep") {
+			t.Errorf("%q: got %v, want the ambiguous separator", sep, err)
+		}
+	}
+	if opts, err := validateCommandArgs([]string{"--input-thousands-sep=,", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil || opts.ThousandsSep != ',' {
+		t.Errorf("got %q, %v", opts.ThousandsSep, err)
+	}
+}
+
+func TestClockSkewFlag(t *testing.T) {
+	if _, err := validateCommandArgs([]string{"--clock-skew=5s", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil || !strings.Contains(err.Error(), "requires --enforce-range") {
+		t.Errorf("got %v, want the missing --enforce-range", err)
+	}
+	opts, err := validateCommandArgs([]string{"--enforce-range", "--clock-skew=5s", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil || !opts.EnforceRange || opts.ClockSkew != 5*time.Second {
+		t.Errorf("got %v, %v, %v", opts.EnforceRange, opts.ClockSkew, err)
+	}
+}
+
+func TestTargetBuckets(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"--target-buckets=2", "2021-03-04T00:00:00Z", "2021-03-05T23:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Granularity.Name != "day" {
+		t.Fatalf("got %s, want day", opts.Granularity.Name)
+	}
+	input := "2021-03-04T03:00:00Z 001.0000\n2021-03-04T13:00:00Z 003.0000\n2021-03-05T03:00:00Z 004.0000\n"
+	if got := mustAggregate(t, opts, input); got != "2021-03-04T00:00:00Z   2.0000\n2021-03-05T00:00:00Z   4.0000\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStreamBoundedHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 40 MB")
+	}
+	// about 40 MB of the days of the records, generated as written with the Content-Length, so not chunked
+	const days = 10_000
+	begin := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	dayLength := len(testRecords(begin, begin.Add(24*time.Hour-time.Second)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(days*dayLength))
+		for day := range days {
+			st := begin.AddDate(0, 0, day)
+			io.WriteString(w, testRecords(st, st.Add(24*time.Hour-time.Second)))
+		}
+	}))
+	defer srv.Close()
+
+	opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "2021-03-04T00:00:00Z", "2048-07-20T23:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out countingWriter
+	grown := heapGrowth(func() {
+		stream, release, err := fetch(context.Background(), newClient(opts), opts, opts.St, opts.Ed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		if err = tally(context.Background(), stream, &out, opts); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := days * 24; out.lines != want {
+		t.Errorf("got %d hours, want %d", out.lines, want)
+	}
+	// well below the body, with room for the garbage of the stub collected lazily
+	if grown > 16<<20 {
+		t.Errorf("heap grew by %d bytes reading %d bytes, want bounded", grown, days*dayLength)
+	}
+}
+
+// heapGrowth returns the peak growth of the heap in use while f runs, sampled every few milliseconds.
+func heapGrowth(f func()) int64 {
+	runtime.GC()
+	var base runtime.MemStats
+	runtime.ReadMemStats(&base)
+	var (
+		peak atomic.Uint64
+		done = make(chan struct{})
+	)
+	go func() {
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak.Load() {
+				peak.Store(m.HeapInuse)
+			}
+		}
+	}()
+	defer close(done)
+	f()
+	return int64(peak.Load()) - int64(base.HeapInuse)
+}
+
+// countingWriter counts the lines written, discarding them.
+type countingWriter struct{ lines int }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.lines += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
+
+func TestInterruptSignal(t *testing.T) {
+	// the hour 03, then the records of 04 trickle until the request is gone
+	written := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		begin := time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+		io.WriteString(w, testRecords(begin, begin.Add(50*time.Minute)))
+		w.(http.Flusher).Flush()
+		close(written)
+		for i := 0; ; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			fmt.Fprintf(w, "%s 4.0000\n", begin.Add(time.Hour+time.Duration(i)*time.Second).Format(time.RFC3339))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	// the exited run leaves the connection open
+	defer srv.CloseClientConnections()
+
+	go func() {
+		<-written
+		time.Sleep(50 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	stdout, stderr, code := runMain(t, "--url="+srv.URL, "2021-03-04T03:00:00Z", "2021-03-04T04:59:59Z")
+	if code != exitInterrupted || !strings.Contains(stderr, "# interrupted\n") {
+		t.Errorf("got %d, %q, want interrupted", code, stderr)
+	}
+	// the completed hour, then the open one so far
+	if want := "2021-03-04T03:00:00Z   3.2500\n2021-03-04T04:00:00Z   4.0000\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
+
+func TestRawOutput(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		begin = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+		input = testRecords(begin, begin.Add(2*time.Hour+50*time.Minute))
+		opts  = defaultOptions()
+	)
+	opts.outputPath = filepath.Join(dir, "out.txt")
+	opts.rawOutputPath = filepath.Join(dir, "raw.txt")
+
+	if err := tallyToOutput(context.Background(), strings.NewReader(input), opts); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(opts.rawOutputPath)
+	if err != nil || string(raw) != input {
+		t.Fatalf("got %q, %v, want the records as is", raw, err)
+	}
+	out, _ := os.ReadFile(opts.outputPath)
+
+	// aggregating the raw output again yields the same
+	opts.outputPath, opts.rawOutputPath = filepath.Join(dir, "again.txt"), ""
+	if err = tallyToOutput(context.Background(), bytes.NewReader(raw), opts); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := os.ReadFile(opts.outputPath)
+	if want := "2021-03-04T03:00:00Z   3.2500\n2021-03-04T04:00:00Z   4.2500\n2021-03-04T05:00:00Z   5.2500\n"; string(out) != want || string(again) != want {
+		t.Errorf("got %q and %q, want %q", out, again, want)
+	}
+}
+
+func TestInput(t *testing.T) {
+	const (
+		records = "2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n2021-03-04T04:00:00Z 4\n"
+		want    = "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n"
+	)
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte(records), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the range is optional
+	for _, args := range [][]string{{"--input=" + input}, {"--input=" + input, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}} {
+		if stdout, stderr, code := runMain(t, args...); code != exitOK || stdout != want {
+			t.Errorf("%v: got %d, %q, %q", args, code, stdout, stderr)
+		}
+	}
+
+	t.Run("stdin", func(t *testing.T) {
+		f, err := os.Open(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		origStdin := os.Stdin
+		t.Cleanup(func() { os.Stdin = origStdin })
+		os.Stdin = f
+
+		if stdout, stderr, code := runMain(t, "--input=-"); code != exitOK || stdout != want {
+			t.Errorf("got %d, %q, %q", code, stdout, stderr)
+		}
+	})
+
+	// the range is still required without it
+	if _, _, code := runMain(t); code != exitUsage {
+		t.Errorf("got %d, want the usage error", code)
+	}
+}
+
+func TestMultipleInputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, records string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(records), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// the hour 04 in both, the later file first
+	a := write("a.txt", "2021-03-04T04:30:00Z 6\n2021-03-04T05:00:00Z 3\n")
+	b := write("b.txt", "2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 2\n")
+	const want = "2021-03-04T03:00:00Z   1.0000\n2021-03-04T04:00:00Z   8.0000\n2021-03-04T05:00:00Z   3.0000\n"
+	for _, args := range [][]string{{"--input=" + a, "--input=" + b}, {"--input=" + a + "," + b}} {
+		if stdout, stderr, code := runMain(t, append(args, "--agg=sum")...); code != exitOK || stdout != want {
+			t.Errorf("%v: got %d, %q, %q", args, code, stdout, stderr)
+		}
+	}
+
+	// an unreadable one fails before any output
+	stdout, stderr, code := runMain(t, "--input="+a, "--input="+filepath.Join(dir, "missing.txt"))
+	if code != exitFetch || stdout != "" || !strings.Contains(stderr, "missing.txt: no such file or directory") {
+		t.Errorf("got %d, %q, %q, want the missing file", code, stdout, stderr)
+	}
+
+	bad := write("bad.txt", "2021-03-04T06:00:00Z six\n")
+	if _, stderr, code = runMain(t, "--input="+a, "--input="+bad); code != exitError || !strings.Contains(stderr, bad+": parse error") {
+		t.Errorf("got %d, %q, want the error of the file", code, stderr)
+	}
+
+	if _, err := validateCommandArgs([]string{"--input=" + a, "--input=-"}); err == nil || err.Error() != "invalid input: -, only files can be merged" {
+		t.Errorf("got %v, want stdin refused", err)
+	}
+}
+
+func TestDedupFlag(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte("2021-03-04T03:00:00Z 1\n2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--agg=count"}, want: "2021-03-04T03:00:00Z   3.0000\n"},
+		{args: []string{"--agg=count", "--dedup"}, want: "2021-03-04T03:00:00Z   2.0000\n"},
+		{args: []string{"--agg=sum", "--dedup", "--unordered"}, want: "2021-03-04T03:00:00Z   3.0000\n"},
+	} {
+		if stdout, stderr, code := runMain(t, append(tt.args, "--input="+input)...); code != exitOK || stdout != tt.want {
+			t.Errorf("%v: got %d, %q, %q", tt.args, code, stdout, stderr)
+		}
+	}
+}
+
+func TestProgressFlag(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want bool
+	}{
+		{args: []string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}, want: false},
+		{args: []string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z", "debug"}, want: true},
+	} {
+		if opts, err := validateCommandArgs(tt.args); err != nil || opts.Progress != tt.want {
+			t.Errorf("%v: got %v, %v, want %v", tt.args, opts.Progress, err, tt.want)
+		}
+	}
+}
+
+func TestValueBoundFlags(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil || !math.IsInf(opts.MinValue, -1) || !math.IsInf(opts.MaxValue, 1) {
+		t.Errorf("got %v, %v, %v, want unbounded", opts.MinValue, opts.MaxValue, err)
+	}
+	for _, tt := range []struct {
+		args     []string
+		min, max float64
+	}{
+		{args: []string{"--min-value=-1.5"}, min: -1.5, max: math.Inf(1)},
+		{args: []string{"--max-value=10"}, min: math.Inf(-1), max: 10},
+		{args: []string{"--min-value=2", "--max-value=2"}, min: 2, max: 2},
+	} {
+		if opts, err = validateCommandArgs(append(tt.args, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")); err != nil || opts.MinValue != tt.min || opts.MaxValue != tt.max {
+			t.Errorf("%v: got %v, %v, %v", tt.args, opts.MinValue, opts.MaxValue, err)
+		}
+	}
+	for args, want := range map[string]string{
+		"--min-value=NaN":             "invalid min value: NaN, must be a number",
+		"--max-value=ten":             "invalid max value: ten, must be a number",
+		"--min-value=3 --max-value=2": "min value is greater than max value: 3, 2",
+	} {
+		if _, err = validateCommandArgs(append(strings.Fields(args), "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %q", args, err, want)
+		}
+	}
+}
+
+func TestHistogramFlags(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte("2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 3\n2021-03-04T03:20:00Z -2\n2021-03-04T03:30:00Z 9\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runMain(t, "--input="+input, "--agg=histogram", "--histogram-min=0", "--histogram-max=4", "--histogram-bins=2")
+	if code != exitOK || stdout != "2021-03-04T03:00:00Z 1 [1 1] 1\n" {
+		t.Errorf("got %d, %q, %q", code, stdout, stderr)
+	}
+
+	for args, want := range map[string]string{
+		"--agg=histogram": "--agg=histogram requires --histogram-min less than --histogram-max",
+		"--agg=histogram --histogram-min=4 --histogram-max=4": "--agg=histogram requires --histogram-min less than --histogram-max",
+		"--histogram-max=Inf": "invalid histogram max: Inf, must be a finite number",
+		"--histogram-bins=0":  "invalid histogram bins: 0, must be a positive integer",
+	} {
+		if _, err := validateCommandArgs(append(strings.Fields(args), "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %q", args, err, want)
+		}
+	}
+}
+
+func TestAlignMinute(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		st, ed string
+		err    string
+	}{
+		{name: "aligned", args: []string{"--align-minute", "2021-03-04T03:00:00Z", "2021-03-04T04:59:00Z"}, st: "2021-03-04T03:00:00Z", ed: "2021-03-04T04:59:00Z"},
+		{name: "unaligned", args: []string{"--align-minute", "2021-03-04T03:00:00Z", "2021-03-04T04:59:59Z"}, err: "must be at the beginning of the minute: 2021-03-04 03:00:00 +0000 UTC, 2021-03-04 04:59:59 +0000 UTC. use --truncate to round them down"},
+		{name: "truncated", args: []string{"--truncate", "2021-03-04T03:00:30Z", "2021-03-04T04:59:59Z"}, st: "2021-03-04T03:00:00Z", ed: "2021-03-04T04:59:00Z"},
+		// truncated rather than refused
+		{name: "both", args: []string{"--align-minute", "--truncate", "2021-03-04T03:00:30Z", "2021-03-04T04:59:59Z"}, st: "2021-03-04T03:00:00Z", ed: "2021-03-04T04:59:00Z"},
+		// as is by default
+		{name: "neither", args: []string{"2021-03-04T03:00:30Z", "2021-03-04T04:59:59Z"}, st: "2021-03-04T03:00:30Z", ed: "2021-03-04T04:59:59Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := validateCommandArgs(tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || opts.St.Format(time.RFC3339) != tt.st || opts.Ed.Format(time.RFC3339) != tt.ed {
+				t.Errorf("got %s, %s, %v, want %s, %s", opts.St.Format(time.RFC3339), opts.Ed.Format(time.RFC3339), err, tt.st, tt.ed)
+			}
+		})
+	}
+
+	// refused as the usage error
+	if _, stderr, code := runMain(t, "--align-minute", "2021-03-04T03:00:00Z", "2021-03-04T04:59:59Z"); code != exitUsage || !strings.Contains(stderr, "use --truncate") {
+		t.Errorf("got %d, %q", code, stderr)
+	}
+}
+
+func TestRollingFlags(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte("2021-03-04T00:00:00Z 1\n2021-03-04T01:00:00Z 2\n2021-03-04T02:00:00Z 6\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--rolling=2"}, want: "2021-03-04T00:00:00Z   1.0000   1.0000\n2021-03-04T01:00:00Z   2.0000   1.5000\n2021-03-04T02:00:00Z   6.0000   4.0000\n"},
+		{args: []string{"--rolling=2", "--rolling-warmup=placeholder"}, want: "2021-03-04T00:00:00Z   1.0000      NaN\n2021-03-04T01:00:00Z   2.0000   1.5000\n2021-03-04T02:00:00Z   6.0000   4.0000\n"},
+	} {
+		if stdout, stderr, code := runMain(t, append(tt.args, "--input="+input)...); code != exitOK || stdout != tt.want {
+			t.Errorf("%v: got %d, %q, %q", tt.args, code, stdout, stderr)
+		}
+	}
+
+	for args, want := range map[string]string{
+		"--rolling=0":               "invalid rolling: 0, must be a positive number of time slots",
+		"--rolling-warmup=zero":     "invalid rolling warmup: zero, must be partial or placeholder",
+		"--rolling=2 --fill":        "--rolling cannot be combined with --fill, --agg=histogram or --passthrough",
+		"--rolling=2 --passthrough": "--rolling cannot be combined with --fill, --agg=histogram or --passthrough",
+	} {
+		if _, err := validateCommandArgs(append(strings.Fields(args), "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %q", args, err, want)
+		}
+	}
+}
+
+func TestSampleRateFlag(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil || opts.SampleRate != 1 {
+		t.Errorf("got %d, %v, want every record by default", opts.SampleRate, err)
+	}
+	if opts, err = validateCommandArgs([]string{"--sample-rate=10", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil || opts.SampleRate != 10 {
+		t.Errorf("got %d, %v", opts.SampleRate, err)
+	}
+	for _, value := range []string{"0", "-2", "half"} {
+		if _, err = validateCommandArgs([]string{"--sample-rate=" + value, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil || err.Error() != "invalid sample rate: "+value+", must be a positive integer" {
+			t.Errorf("%s: got %v", value, err)
+		}
+	}
+}
+
+func TestColumnFlags(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, records string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(records), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	const want = "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n"
+	tests := []struct {
+		name  string
+		args  []string
+		input string
+	}{
+		{name: "id prefixed", args: []string{"--ts-col=5:25", "--value-col=26:40"}, input: "0001 2021-03-04T03:00:00Z 1\n0002 2021-03-04T03:30:00Z 2\n0003 2021-03-04T04:00:00Z 4\n"},
+		{name: "tab delimited", args: []string{"--ts-col=1", "--value-col=2"}, input: "a\t2021-03-04T03:00:00Z\t1\nb\t2021-03-04T03:30:00Z\t2\nc\t2021-03-04T04:00:00Z\t4\n"},
+		{name: "default", input: "2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n2021-03-04T04:00:00Z 4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := write(strings.ReplaceAll(tt.name, " ", "-")+".txt", tt.input)
+			if stdout, stderr, code := runMain(t, append(tt.args, "--input="+input)...); code != exitOK || stdout != want {
+				t.Errorf("got %d, %q, %q", code, stdout, stderr)
+			}
+		})
+	}
+
+	for args, want := range map[string]string{
+		"--ts-col=5:5":                        "invalid column: 5:5, must be start:end of 0 <= start < end",
+		"--value-col=-1":                      "invalid column: -1, must be start:end or a non-negative field index",
+		"--ts-col=1 --fixed-width":            "--ts-col and --value-col cannot be combined with --value-column-name or --fixed-width",
+		"--value-col=2 --value-column-name=v": "--ts-col and --value-col cannot be combined with --value-column-name or --fixed-width",
+	} {
+		if _, err := validateCommandArgs(append(strings.Fields(args), "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %q", args, err, want)
+		}
+	}
+}
+
+func TestAggFlag(t *testing.T) {
+	for _, agg := range []string{aggregate.AggAvg, aggregate.AggMin, aggregate.AggMax, aggregate.AggSum, aggregate.AggCount, aggregate.AggStddev} {
+		if opts, err := validateCommandArgs([]string{"--agg=" + agg, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil || opts.Agg != agg {
+			t.Errorf("%s: got %q, %v", agg, opts.Agg, err)
+		}
+	}
+	for agg, want := range map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99} {
+		if opts, err := validateCommandArgs([]string{"--agg=" + agg, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil || math.Abs(opts.Quantile-want) > 1e-12 {
+			t.Errorf("%s: got %v, %v, want %v", agg, opts.Quantile, err, want)
+		}
+	}
+	if _, err := validateCommandArgs([]string{"--agg=p101", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil || !strings.Contains(err.Error(), "invalid agg: p101") {
+		t.Errorf("got %v, want the invalid percentile", err)
+	}
+	if _, err := validateCommandArgs([]string{"--agg=median", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil || !strings.Contains(err.Error(), "invalid agg: median") {
+		t.Errorf("got %v, want the invalid agg", err)
+	}
+}
+
+// newFlakyAPI starts a fasthttp stub of the API responding with the status codes in turn, then testRecords of 03:00-03:50.
+// Returns its url and the number of the requests served.
+func newFlakyAPI(t *testing.T, statusCodes ...int) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := new(atomic.Int32)
+	srv := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		if n := int(requests.Add(1)); n <= len(statusCodes) {
+			ctx.SetStatusCode(statusCodes[n-1])
+			return
+		}
+		begin := time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+		ctx.SetContentType("text/plain")
+		ctx.WriteString(testRecords(begin, begin.Add(50*time.Minute)))
+	}}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown() })
+	return "http://" + ln.Addr().String() + "/data", requests
+}
+
+func TestFetchRetry(t *testing.T) {
+	orig := fetchBackoff
+	t.Cleanup(func() { fetchBackoff = orig })
+	fetchBackoff = 10 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		statusCodes []int
+		timeout     time.Duration
+		err         string
+		requests    int32
+	}{
+		{name: "fails twice then succeeds", statusCodes: []int{500, 503}, requests: 3},
+		{name: "fails thrice", statusCodes: []int{502, 502, 502}, err: "unexpected status code: 502", requests: 3},
+		{name: "4xx not retried", statusCodes: []int{404}, err: "unexpected status code: 404", requests: 1},
+		// the backoff of 10ms, then 20ms, doesn't fit
+		{name: "past the deadline", statusCodes: []int{500, 500}, timeout: 25 * time.Millisecond, err: "unexpected status code: 500", requests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests := newFlakyAPI(t, tt.statusCodes...)
+			opts, err := validateCommandArgs([]string{"--url=" + url, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.isDebug = true
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			var body []byte
+			stdout, stderr := captureOutput(t, func() {
+				var stream io.Reader
+				var release func()
+				if stream, release, err = fetch(ctx, newClient(opts), opts, opts.St, opts.Ed); err == nil {
+					body, err = io.ReadAll(stream)
+					release()
+				}
+			})
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("got %d requests, want %d", got, tt.requests)
+			}
+			if tt.err == "" && (stdout != "" || !strings.Contains(stderr, "retry 1/2 in 10ms: status code 500\n") || !strings.Contains(stderr, "retry 2/2 in 20ms: status code 503\n") || !strings.HasPrefix(string(body), "2021-03-04T03:00:00Z")) {
+				t.Errorf("got %q, %q, %q, want the retries logged to stderr with the delays", stdout, stderr, body)
+			}
+		})
+	}
+}
+
+func TestConnectionDrop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// large enough to be streamed, then dropped in the middle of a record
+	begin := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	body := testRecords(begin, begin.Add(60*24*time.Hour))
+	body = body[:bodyStreamThreshold*2+10]
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(body)+100, body)
+	}()
+
+	opts, err := validateCommandArgs([]string{"--url=http://" + ln.Addr().String() + "/data", "2021-03-04T00:00:00Z", "2021-04-03T00:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, release, err := fetch(context.Background(), newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	err = tally(context.Background(), stream, io.Discard, opts)
+	if err == nil || !strings.Contains(err.Error(), "truncated stream, ended in the middle of a record") {
+		t.Errorf("got %v, want the truncation", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	fakeNow(t, time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC), 0)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{value: "3", want: 3 * time.Second, ok: true},
+		{value: "0", want: 0, ok: true},
+		{value: "Thu, 04 Mar 2021 03:00:05 GMT", want: 5 * time.Second, ok: true},
+		// a date in the past is right away
+		{value: "Thu, 04 Mar 2021 02:00:00 GMT", want: 0, ok: true},
+		{value: "", ok: false},
+		{value: "-1", ok: false},
+		{value: "soon", ok: false},
+	}
+	for _, tt := range tests {
+		var header fasthttp.ResponseHeader
+		if tt.value != "" {
+			header.Set(fasthttp.HeaderRetryAfter, tt.value)
+		}
+		if got, ok := retryAfter(&header); got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFetchRetryAfter(t *testing.T) {
+	orig := fetchBackoff
+	t.Cleanup(func() { fetchBackoff = orig })
+	fetchBackoff = 10 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		statusCode int
+		retryAfter string
+		timeout    time.Duration
+		log        string
+		err        string
+		requests   int32
+	}{
+		{name: "seconds of 429", statusCode: 429, retryAfter: "0", log: "retry 1/2 in 0s: status code 429\n", requests: 2},
+		{name: "date of 503", statusCode: 503, retryAfter: time.Now().UTC().Add(-time.Hour).Format(http.TimeFormat), log: "retry 1/2 in 0s: status code 503\n", requests: 2},
+		// only 429 and 503 are told when to come back
+		{name: "ignored on 500", statusCode: 500, retryAfter: "0", log: "retry 1/2 in 10ms: status code 500\n", requests: 2},
+		{name: "past the deadline", statusCode: 429, retryAfter: "60", timeout: time.Second, err: "unexpected status code: 429", requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(tt.statusCode)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "2021-03-04T03:00:00Z 1\n")
+			}))
+			defer srv.Close()
+			opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.isDebug = true
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			start := time.Now()
+			stdout, stderr := captureOutput(t, func() {
+				var release func()
+				if _, release, err = fetch(ctx, newClient(opts), opts, opts.St, opts.Ed); err == nil {
+					release()
+				}
+			})
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+			if stdout != "" || !strings.Contains(stderr, tt.log) {
+				t.Errorf("got %q, %q, want %q on stderr", stdout, stderr, tt.log)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("got %d requests, want %d", got, tt.requests)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("took %s, want no sleep past the Retry-After or the deadline", elapsed)
+			}
+		})
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	// 30 bytes a record, every 10 minutes
+	day := testRecords(time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 23, 59, 59, 0, time.UTC))
+	large := strings.Repeat(day, 20)
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		code    int
+		err     string
+	}{
+		{name: "oversized Content-Length", body: day, code: exitFetch, err: "response body exceeds the max body size(1000 bytes)"},
+		{name: "oversized streamed Content-Length", body: large, code: exitFetch, err: fmt.Sprintf("response body exceeds the max body size(1000 bytes): Content-Length %d", len(large))},
+		// the length is unknown until read, so aborted while tallied
+		{name: "chunked", body: large, chunked: true, code: exitError, err: "read error: aborted after reading 1000 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				if !tt.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			_, stderr, code := runMain(t, "--url="+srv.URL, "--max-body-size=1000", "2021-03-04T00:00:00Z", "2021-03-04T23:59:59Z")
+			if code != tt.code || !strings.Contains(stderr, tt.err) {
+				t.Errorf("got %d, %q, want %q", code, stderr, tt.err)
+			}
+		})
+	}
+
+	// within the limit
+	url := newTestAPI(t)
+	stdout, stderr, code := runMain(t, "--url="+url, "--max-body-size=1000", "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z")
+	if code != exitOK || stdout != "2021-03-04T03:00:00Z   3.2500\n" {
+		t.Errorf("got %d, %q, %q", code, stdout, stderr)
+	}
+}
+
+func TestToken(t *testing.T) {
+	const token = "s3cret-token"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer " + token:
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "2021-03-04T03:00:00Z 1\n")
+		case "":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		code int
+		err  string
+	}{
+		{name: "flag", args: []string{"--token=" + token}, code: exitOK},
+		{name: "env", env: token, code: exitOK},
+		{name: "flag over env", env: "stale", args: []string{"--token=" + token}, code: exitOK},
+		{name: "missing", code: exitFetch, err: "authentication failed: status code 401. check --token or MODE_API_TOKEN"},
+		{name: "wrong", args: []string{"--token=wrong"}, code: exitFetch, err: "authentication failed: status code 403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tokenEnv, tt.env)
+			stdout, stderr, code := runMain(t, append(tt.args, "--url="+srv.URL, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z")...)
+			if code != tt.code || !strings.Contains(stderr, tt.err) {
+				t.Errorf("got %d, %q, want %d, %q", code, stderr, tt.code, tt.err)
+			}
+			if tt.code == exitOK && stdout != "2021-03-04T03:00:00Z   1.0000\n" {
+				t.Errorf("got %q", stdout)
+			}
+			if strings.Contains(stdout+stderr, token) {
+				t.Errorf("got the token printed: %q, %q", stdout, stderr)
+			}
+		})
+	}
+
+	// nor in the debug output
+	opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "--token=" + token, "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.isDebug = true
+	stdout, stderr := captureOutput(t, func() {
+		var release func()
+		if _, release, err = fetch(context.Background(), newClient(opts), opts, opts.St, opts.Ed); err == nil {
+			release()
+		}
+	})
+	// stderr, apart from the output
+	if err != nil || stdout != "" || stderr == "" || strings.Contains(stderr, token) {
+		t.Errorf("got %v, %q, %q, want the debug output without the token", err, stdout, stderr)
+	}
+}
+
+func TestURLAndTimeoutFlags(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil || opts.apiURL != apiURL || opts.processTimeout != processTimeout || opts.requestTimeout != requestTimeout {
+		t.Errorf("got %s, %s, %s, %v, want the defaults", opts.apiURL, opts.processTimeout, opts.requestTimeout, err)
+	}
+	opts, err = validateCommandArgs([]string{"--url=http://staging.example.com:8080/data", "--process-timeout=10m", "--request-timeout=30s", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil || opts.apiURL != "http://staging.example.com:8080/data" || opts.processTimeout != 10*time.Minute || opts.requestTimeout != 30*time.Second {
+		t.Errorf("got %s, %s, %s, %v", opts.apiURL, opts.processTimeout, opts.requestTimeout, err)
+	}
+
+	for flag, want := range map[string]string{
+		"--url=staging.example.com/data": "invalid url",
+		"--url=ftp://example.com/data":   "invalid url",
+		"--url=http://":                  "invalid url",
+		"--process-timeout=0s":           "invalid process timeout",
+		"--process-timeout=5":            "invalid process timeout",
+		"--request-timeout=-1s":          "invalid request timeout",
+	} {
+		if _, err = validateCommandArgs([]string{flag, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", flag, err, want)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	orig := fetchBackoff
+	t.Cleanup(func() { fetchBackoff = orig })
+	fetchBackoff = time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, stderr, code := runMain(t, "--url="+srv.URL, "--request-timeout=20ms", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")
+	if code != exitFetch || !strings.Contains(stderr, "timeout") {
+		t.Errorf("got %d, %q, want the request timed out", code, stderr)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s, want the attempts cut by the request timeout", elapsed)
+	}
+}
+
+func TestEmptyResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer srv.Close()
+	args := []string{"--url=" + srv.URL, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}
+
+	stdout, stderr, code := runMain(t, args...)
+	if stdout != "" || stderr != "# no data\n" || code != exitOK {
+		t.Errorf("got %q, %q, %d, want the empty output", stdout, stderr, code)
+	}
+
+	stdout, stderr, code = runMain(t, append([]string{"--fail-on-empty"}, args...)...)
+	if stdout != "" || stderr != "Error: no records in the range\n" || code != exitError {
+		t.Errorf("got %q, %q, %d, want the error", stdout, stderr, code)
+	}
+}
+
+func TestFailOnWarningsOutput(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(input, []byte("2021-03-04T03:00:00Z 1\nbroken\n2021-03-04T03:10:00Z 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runMain(t, "--input="+input, "--fail-on-warnings")
+	if code != exitError || stdout != "2021-03-04T03:00:00Z   1.5000\n" || !strings.Contains(stderr, "1 warning(s) reported with --fail-on-warnings") {
+		t.Errorf("got %d, %q, %q, want the output then the error", code, stdout, stderr)
+	}
+}
+
+func TestInputUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "feed.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// a producer writing the records in pieces, then closing
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, piece := range []string{"2021-03-04T03:00:00Z 1\n2021-03-04T03:", "30:00Z 2\n", "2021-03-04T04:00:00Z 4\n"} {
+			io.WriteString(conn, piece)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	stdout, stderr, code := runMain(t, "--input=unix://"+socket)
+	if code != exitOK || stdout != "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n" {
+		t.Errorf("got %d, %q, %q", code, stdout, stderr)
+	}
+
+	// nothing listening
+	if stdout, _, code = runMain(t, "--input=unix://"+filepath.Join(t.TempDir(), "missing.sock")); code != exitFetch {
+		t.Errorf("got %d, %q, want the dial error", code, stdout)
+	}
+}
+
+func TestBucketFlag(t *testing.T) {
+	opts, err := validateCommandArgs([]string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil || opts.Granularity.Name != "hour" {
+		t.Errorf("got %s, %v, want hour by default", opts.Granularity.Name, err)
+	}
+	for _, name := range []string{"minute", "hour", "day"} {
+		if opts, err = validateCommandArgs([]string{"--bucket=" + name, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err != nil || opts.Granularity.Name != name {
+			t.Errorf("--bucket=%s: got %s, %v", name, opts.Granularity.Name, err)
+		}
+	}
+	if _, err = validateCommandArgs([]string{"--bucket=week", "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}); err == nil {
+		t.Error("want the error of the unknown bucket")
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	opts := defaultOptions()
+	if err := checkFlags(opts); err != nil {
+		t.Errorf("got %v for the defaults", err)
+	}
+	opts.Resume = true
+	if err := checkFlags(opts); err == nil || err.Error() != "--resume requires --checkpoint" {
+		t.Errorf("got %v, want the resume without the checkpoint", err)
+	}
+	opts = defaultOptions()
+	opts.inputPaths = []string{"a.txt", "-"}
+	if err := checkFlags(opts); err == nil || err.Error() != "invalid input: -, only files can be merged" {
+		t.Errorf("got %v, want stdin not merged", err)
+	}
+	opts = defaultOptions()
+	opts.Fill, opts.DropNaN = true, true
+	if err := checkFlags(opts); err == nil || err.Error() != "--fill cannot be combined with --drop-nan unless --fill-value is a number" {
+		t.Errorf("got %v, want every placeholder dropped rejected", err)
+	}
+	opts.FillValue = "0"
+	if err := checkFlags(opts); err != nil {
+		t.Errorf("got %v, want the numeric placeholders kept", err)
+	}
+}
+
+func TestParsePositional(t *testing.T) {
+	tests := []struct {
+		name       string
+		positional []string
+		interval   string
+		input      string
+		st, ed     string
+		debug      bool
+		err        string
+	}{
+		{name: "range", positional: []string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}, st: "2021-03-04T03:00:00Z", ed: "2021-03-04T04:00:00Z"},
+		{name: "debug", positional: []string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z", "debug"}, st: "2021-03-04T03:00:00Z", ed: "2021-03-04T04:00:00Z", debug: true},
+		{name: "interval", positional: []string{"debug"}, interval: "2021-03-04T03:00:00Z/2021-03-04T04:00:00Z", st: "2021-03-04T03:00:00Z", ed: "2021-03-04T04:00:00Z", debug: true},
+		{name: "input without range", input: "records.txt", st: "0001-01-01T00:00:00Z", ed: "0001-01-01T00:00:00Z"},
+		{name: "missing end", positional: []string{"2021-03-04T03:00:00Z"}, err: "invalid number of arguments"},
+		{name: "interval and range", positional: []string{"2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"}, interval: "2021-03-04T03:00:00Z/2021-03-04T04:00:00Z", err: "--interval cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := defaultOptions()
+			opts.inputPath, opts.interval = tt.input, tt.interval
+			err := parsePositional(&opts, tt.positional)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || opts.St.Format(time.RFC3339) != tt.st || opts.Ed.Format(time.RFC3339) != tt.ed || opts.isDebug != tt.debug {
+				t.Errorf("got %s, %s, %v, %v", opts.St, opts.Ed, opts.isDebug, err)
+			}
+		})
+	}
+}
+
+func TestSelectGranularity(t *testing.T) {
+	opts := defaultOptions()
+	opts.granularities = []aggregate.Granularity{aggregate.GranularityMinute, aggregate.GranularityDay}
+	// the coarsest, as the chunks are aligned to it
+	if err := selectGranularity(&opts); err != nil || opts.Granularity.Name != "day" {
+		t.Errorf("got %s, %v, want day", opts.Granularity.Name, err)
+	}
+	opts = defaultOptions()
+	opts.PreBucket = aggregate.GranularityMinute
+	opts.bucket = aggregate.GranularityMinute
+	if err := selectGranularity(&opts); err == nil || err.Error() != "pre bucket(minute) must be finer than the minute granularity" {
+		t.Errorf("got %v, want the pre bucket not finer", err)
+	}
+}
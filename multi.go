@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// Output file of each granularity with `--granularities`, named by the granularity.
+// With --output, it's `<output>.<granularity>` instead.
+const granularityOutputPattern = "%s.txt"
+
+// granularityOutputPath returns the path of the output file of the granularity.
+func granularityOutputPath(opts options, g aggregate.Granularity) string {
+	if opts.outputPath != "" {
+		return opts.outputPath + "." + g.Name
+	}
+	return fmt.Sprintf(granularityOutputPattern, g.Name)
+}
+
+// tallyGranularities tallies the stream in each of opts.granularities with a single read and parse,
+// each written to its own file. The files are replaced only if all of them succeed, the same as --output.
+func tallyGranularities(ctx context.Context, stream io.Reader, opts options) (err error) {
+	files := make([]*atomicFile, 0, len(opts.granularities))
+	defer func() {
+		for i, f := range files {
+			if cerr := f.commit(err == nil); err == nil && cerr != nil {
+				err = fmt.Errorf("failed to write output of %s: %w", opts.granularities[i].Name, cerr)
+			}
+		}
+	}()
+	for _, g := range opts.granularities {
+		var f *atomicFile
+		if f, err = createAtomic(granularityOutputPath(opts, g)); err != nil {
+			return fmt.Errorf("failed to create output of %s: %w", g.Name, err)
+		}
+		files = append(files, f)
+	}
+
+	// the first granularity is that of the run, counted by the stats. The others are rolled up along with it
+	o := opts
+	o.Granularity = opts.granularities[0]
+	o.Rollups = nil
+	for i, g := range opts.granularities[1:] {
+		o.Rollups = append(o.Rollups, aggregate.Rollup{Granularity: g, W: files[i+1]})
+	}
+	return tally(ctx, stream, files[0], o)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// chdir changes the working directory to dir until the test ends.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// each rollup is the same as a single run of the granularity
+func TestTallyGranularities(t *testing.T) {
+	chdir(t, t.TempDir())
+	begin := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	input := testRecords(begin, begin.Add(50*time.Hour))
+	opts, err := validateCommandArgs([]string{"--granularities=minute,hour,day", "2021-03-04T00:00:00Z", "2021-03-06T02:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tallyGranularities(context.Background(), strings.NewReader(input), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range opts.granularities {
+		got, err := os.ReadFile(g.Name + ".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		single := defaultOptions()
+		single.Granularity = g
+		if want := mustAggregate(t, single, input); string(got) != want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", g.Name, got, want)
+		}
+	}
+
+	// a failure of any aborts the others. in another directory, as the outputs are never overwritten
+	chdir(t, t.TempDir())
+	opts.Strict = true
+	if err = tallyGranularities(context.Background(), strings.NewReader(input+"broken\n"), opts); err == nil {
+		t.Error("want the error of the malformed record")
+	}
+}
+
+// the outputs are named by the granularity, or by --output
+func TestGranularityOutputs(t *testing.T) {
+	const input = "2021-03-04T00:00:00Z 1\n2021-03-04T00:30:00Z 3\n2021-03-04T01:00:00Z 5\n"
+	opts := defaultOptions()
+	opts.granularities = []aggregate.Granularity{aggregate.GranularityHour, aggregate.GranularityDay}
+
+	t.Run("default", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		if err := tallyGranularities(context.Background(), strings.NewReader(input), opts); err != nil {
+			t.Fatal(err)
+		}
+		for path, want := range map[string]string{
+			"hour.txt": "2021-03-04T00:00:00Z   2.0000\n2021-03-04T01:00:00Z   5.0000\n",
+			"day.txt":  "2021-03-04T00:00:00Z   3.0000\n",
+		} {
+			if got, _ := os.ReadFile(path); string(got) != want {
+				t.Errorf("%s: got %q, want %q", path, got, want)
+			}
+		}
+
+		// replaced by the next run, but not by a failed one
+		if err := tallyGranularities(context.Background(), strings.NewReader("2021-03-04T00:00:00Z 7\n"), opts); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile("day.txt"); string(got) != "2021-03-04T00:00:00Z   7.0000\n" {
+			t.Errorf("got %q, want replaced", got)
+		}
+		err := tallyGranularities(context.Background(), strings.NewReader("2021-03-04T00:00:00Z 9\n2021-03-04T00:00:00Z x\n"), opts)
+		if err == nil || !strings.Contains(err.Error(), "parse error") {
+			t.Errorf("got %v, want the parse error", err)
+		}
+		if got, _ := os.ReadFile("hour.txt"); string(got) != "2021-03-04T00:00:00Z   7.0000\n" {
+			t.Errorf("got %q, want the previous output kept", got)
+		}
+		if entries, _ := os.ReadDir("."); len(entries) != 2 {
+			t.Errorf("got %v, want no temporary file left", entries)
+		}
+	})
+
+	t.Run("output", func(t *testing.T) {
+		o := opts
+		o.outputPath = filepath.Join(t.TempDir(), "out")
+		if err := tallyGranularities(context.Background(), strings.NewReader(input), o); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(o.outputPath + ".day"); string(got) != "2021-03-04T00:00:00Z   3.0000\n" {
+			t.Errorf("got %q", got)
+		}
+		if _, err := os.Stat(o.outputPath + ".hour"); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// objectOpener opens the object of the URL as a stream.
+type objectOpener func(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+
+// objectOpeners by the URL scheme. The SDKs are behind build tags, so registered by those files.
+//
+//	s3://bucket/key  -tags s3
+//	gs://bucket/key  -tags gcs
+var objectOpeners = map[string]objectOpener{}
+
+// parseObjectURL parses the URL of the form `<scheme>://<bucket>/<key>`.
+func parseObjectURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid input url: %v, must be s3://<bucket>/<key> or gs://<bucket>/<key>", rawURL)
+	}
+	return u, nil
+}
+
+// openObject opens the object of the URL as a stream, instead of fetching from the API.
+// Credentials come from the standard chain of each SDK.
+func openObject(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := parseObjectURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	open, ok := objectOpeners[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("%s:// is not supported by this build. rebuild with -tags %s", u.Scheme, map[string]string{"s3": "s3", "gs": "gcs"}[u.Scheme])
+	}
+
+	body, err := open(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", rawURL, err)
+	}
+	return body, nil
+}
@@ -0,0 +1,43 @@
+//go:build gcs
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+func init() {
+	objectOpeners["gs"] = openGCSObject
+}
+
+// gcsObjectReader closes the client together with the object.
+type gcsObjectReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (r gcsObjectReader) Close() error {
+	return errors.Join(r.Reader.Close(), r.client.Close())
+}
+
+// openGCSObject streams the object from Google Cloud Storage.
+// An emulator is used with `STORAGE_EMULATOR_HOST`.
+func openGCSObject(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := client.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).NewReader(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return gcsObjectReader{Reader: r, client: client}, nil
+}
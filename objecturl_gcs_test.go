@@ -0,0 +1,42 @@
+//go:build gcs
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenGCSObject(t *testing.T) {
+	const body = "2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 4\n"
+	var path string
+	// a stub of the emulator, serving the object by the XML API
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if r.Method != http.MethodGet || r.URL.Path != "/bucket/data/2021-03-04.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	r, err := openObject(context.Background(), "gs://bucket/data/2021-03-04.txt")
+	if err != nil {
+		t.Fatalf("%v, from %s", err, path)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || string(got) != body {
+		t.Errorf("got %q, %v, from %s", got, err, path)
+	}
+
+	if _, err = openObject(context.Background(), "gs://bucket/missing.txt"); err == nil {
+		t.Error("want the error of the missing object")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build s3
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func init() {
+	objectOpeners["s3"] = openS3Object
+}
+
+// openS3Object streams the object from S3.
+// An S3 compatible storage (e.g. minio) is used with `AWS_ENDPOINT_URL`.
+func openS3Object(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// path style, as the compatible storages rarely serve virtual hosted buckets
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = cfg.BaseEndpoint != nil
+	})
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
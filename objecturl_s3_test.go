@@ -0,0 +1,47 @@
+//go:build s3
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenS3Object(t *testing.T) {
+	const body = "2021-03-04T03:00:00Z 1\n2021-03-04T04:00:00Z 4\n"
+	var path string
+	// an S3 compatible stub, addressed in the path style
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if r.Method != http.MethodGet || r.URL.Path != "/bucket/data/2021-03-04.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+
+	r, err := openObject(context.Background(), "s3://bucket/data/2021-03-04.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || string(got) != body {
+		t.Errorf("got %q, %v, from %s", got, err, path)
+	}
+
+	if _, err = openObject(context.Background(), "s3://bucket/missing.txt"); err == nil {
+		t.Error("want the error of the missing key")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseObjectURL(t *testing.T) {
+	for _, rawURL := range []string{"s3://bucket/key.txt", "gs://bucket/dir/key.txt"} {
+		if _, err := parseObjectURL(rawURL); err != nil {
+			t.Errorf("%s: got %v", rawURL, err)
+		}
+	}
+	for _, rawURL := range []string{"http://bucket/key.txt", "s3://bucket", "s3://bucket/", "s3:///key.txt", "bucket/key.txt"} {
+		if _, err := parseObjectURL(rawURL); err == nil {
+			t.Errorf("%s: accepted, want the error", rawURL)
+		}
+	}
+}
+
+// mockObjectOpener registers the opener of the scheme serving the objects by bucket/key, for the duration of the test.
+func mockObjectOpener(t *testing.T, scheme string, objects map[string]string) {
+	t.Helper()
+	orig, ok := objectOpeners[scheme]
+	t.Cleanup(func() {
+		if ok {
+			objectOpeners[scheme] = orig
+		} else {
+			delete(objectOpeners, scheme)
+		}
+	})
+	objectOpeners[scheme] = func(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+		body, ok := objects[u.Host+u.Path]
+		if !ok {
+			return nil, errors.New("no such key")
+		}
+		return io.NopCloser(strings.NewReader(body)), nil
+	}
+}
+
+func TestInputURL(t *testing.T) {
+	mockObjectOpener(t, "s3", map[string]string{"bucket/data/2021-03-04.txt": "2021-03-04T03:00:00Z 1\n2021-03-04T03:30:00Z 2\n2021-03-04T04:00:00Z 4\n"})
+
+	stdout, stderr, code := runMain(t, "--input-url=s3://bucket/data/2021-03-04.txt", "2021-03-04T03:00:00Z", "2021-03-04T04:59:59Z")
+	if code != exitOK || stdout != "2021-03-04T03:00:00Z   1.5000\n2021-03-04T04:00:00Z   4.0000\n" {
+		t.Errorf("got %d, %q, %q", code, stdout, stderr)
+	}
+
+	_, stderr, code = runMain(t, "--input-url=s3://bucket/missing.txt", "2021-03-04T03:00:00Z", "2021-03-04T04:59:59Z")
+	if code != exitFetch || !strings.Contains(stderr, "failed to open s3://bucket/missing.txt: no such key") {
+		t.Errorf("got %d, %q, want the open error", code, stderr)
+	}
+}
+
+func TestInputURLNotBuilt(t *testing.T) {
+	if _, ok := objectOpeners["gs"]; ok {
+		t.Skip("built with -tags gcs")
+	}
+	_, err := openObject(context.Background(), "gs://bucket/key.txt")
+	if err == nil || err.Error() != "gs:// is not supported by this build. rebuild with -tags gcs" {
+		t.Errorf("got %v", err)
+	}
+}
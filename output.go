@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// Format of the output written by parquet-go, in addition to the text formats of aggregate
+const formatParquet = "parquet"
+
+// tallyToOutput tallies the stream into the output of the options, stdout by default.
+func tallyToOutput(ctx context.Context, stream io.Reader, opts options) (err error) {
+	var w io.Writer = os.Stdout
+	if opts.outputPath != "" {
+		f, ferr := createAtomic(opts.outputPath)
+		if ferr != nil {
+			return fmt.Errorf("failed to create output: %w", ferr)
+		}
+		defer func() {
+			if cerr := f.commit(err == nil); err == nil && cerr != nil {
+				err = fmt.Errorf("failed to write output: %w", cerr)
+			}
+		}()
+		w = f
+	}
+
+	if opts.rawOutputPath != "" {
+		// tee the records as is, in the same pass as the aggregation
+		f, ferr := os.Create(opts.rawOutputPath)
+		if ferr != nil {
+			return fmt.Errorf("failed to create raw output: %w", ferr)
+		}
+		raw := bufio.NewWriter(f)
+		defer func() {
+			ferr := raw.Flush()
+			if cerr := f.Close(); ferr == nil {
+				ferr = cerr
+			}
+			if err == nil && ferr != nil {
+				err = fmt.Errorf("failed to write raw output: %w", ferr)
+			}
+		}()
+		stream = io.TeeReader(stream, raw)
+	}
+
+	if opts.Format == formatParquet {
+		// the slots are written as rows, instead of the text lines
+		pw := newParquetSlotWriter(w)
+		opts.OnSlot = pw.write
+		if err = tally(ctx, stream, io.Discard, opts); err != nil {
+			return err
+		}
+		return pw.Close()
+	}
+	return tally(ctx, stream, w, opts)
+}
+
+// atomicFile is an output written to a temporary file in the same directory, then renamed into place on success,
+// so that a failed run never leaves a partial output behind.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+// commit closes the file, then renames it into place if ok. Otherwise, or on the error, the file is removed.
+func (f *atomicFile) commit(ok bool) (err error) {
+	err = f.Close()
+	if ok && err == nil {
+		if err = os.Chmod(f.Name(), 0o644); err == nil {
+			err = os.Rename(f.Name(), f.path)
+		}
+	}
+	if !ok || err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// tally aggregates the stream into w, or the sources of the options if any.
+func tally(ctx context.Context, stream io.Reader, w io.Writer, opts options) error {
+	a := aggregate.NewAggregator(w, opts.Options)
+	if len(opts.sources) > 0 {
+		return a.RunSources(ctx, opts.sources...)
+	}
+	return a.Run(ctx, stream)
+}
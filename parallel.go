@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+	"github.com/valyala/fasthttp"
+)
+
+// fetchParallel fetches the range split into n contiguous chunks concurrently,
+// then concatenates the bodies in order, so the stream is the same as a single fetch.
+// Each body larger than bodyStreamThreshold is streamed from its connection as consumed, so the memory is bounded regardless of n.
+// The fetch slots are taken in the order of the chunks, each held until its chunk is consumed,
+// so the chunk read next never waits for the slot of a later one.
+// It returns once the first chunk responds. A failure of any chunk cancels the rest,
+// and is returned by then, or by the next read of the stream otherwise.
+// The caller must call release after consuming the stream.
+func fetchParallel(ctx context.Context, client *fasthttp.Client, opts options, n int) (stream io.Reader, release func(), err error) {
+	ranges := splitRange(opts.St, opts.Ed, opts.Granularity, n)
+	ctx, cancel := context.WithCancel(ctx)
+	p := &parallelStream{
+		chunks: make([]parallelChunk, len(ranges)),
+		failed: make(chan struct{}),
+		cancel: cancel,
+	}
+	for i, r := range ranges {
+		c := &p.chunks[i]
+		c.done = make(chan struct{})
+		// only the bounds shared with the adjacent chunks. the outer ones are the same as a single fetch
+		if i > 0 {
+			c.check.from = r[0]
+		}
+		if i < len(ranges)-1 {
+			c.check.until = r[1].Add(time.Second)
+		}
+		c.check.chunk, c.check.sep = r, opts.RecordSeparator
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for i, r := range ranges {
+			slot, aerr := acquireFetch(ctx)
+			if aerr != nil {
+				// canceled, so the rest is never fetched
+				p.fail(aerr)
+				for j := i; j < len(p.chunks); j++ {
+					close(p.chunks[j].done)
+				}
+				return
+			}
+			c := &p.chunks[i]
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				defer close(c.done)
+				var ferr error
+				if c.check.r, c.release, ferr = fetchInSlot(ctx, client, opts, r[0], r[1], slot); ferr != nil {
+					p.fail(fmt.Errorf("chunk %s - %s: %w", r[0].Format(time.RFC3339), r[1].Format(time.RFC3339), ferr))
+				}
+			}()
+		}
+	}()
+
+	select {
+	case <-p.chunks[0].done:
+	case <-p.failed:
+	}
+	if err = p.failure(); err != nil {
+		p.close()
+		return nil, nil, err
+	}
+	return p, p.close, nil
+}
+
+// parallelStream is the stream of the chunks of fetchParallel, read in order.
+type parallelStream struct {
+	chunks []parallelChunk
+	// index of the chunk read
+	next int
+	// closed on the first failure, which is err
+	failed chan struct{}
+	err    error
+	once   sync.Once
+	cancel context.CancelFunc
+	// the fetches, and the loop starting them
+	wg sync.WaitGroup
+}
+
+type parallelChunk struct {
+	// the body, checked by the range of the chunk
+	check chunkCheckReader
+	// releases the response and the fetch slot. nil once released, or if failed
+	release func()
+	// closed once fetched, or failed
+	done chan struct{}
+}
+
+// fail fails the stream by err, unless failed already, canceling the fetches.
+func (p *parallelStream) fail(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.failed)
+		p.cancel()
+	})
+}
+
+// failure returns the error of the failure if failed, nil otherwise.
+func (p *parallelStream) failure() error {
+	select {
+	case <-p.failed:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+func (p *parallelStream) Read(b []byte) (int, error) {
+	for p.next < len(p.chunks) {
+		c := &p.chunks[p.next]
+		select {
+		case <-c.done:
+		case <-p.failed:
+		}
+		if err := p.failure(); err != nil {
+			return 0, err
+		}
+		n, err := c.check.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		// consumed, so the slot is free for a later chunk
+		c.release()
+		c.release = nil
+		p.next++
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// close cancels the chunks yet to respond, and releases the responses once they end.
+// The requests in flight don't see the context, so waited for in background.
+func (p *parallelStream) close() {
+	p.cancel()
+	go func() {
+		p.wg.Wait()
+		for i := range p.chunks {
+			if c := &p.chunks[i]; c.release != nil {
+				c.release()
+			}
+		}
+	}()
+}
+
+// chunkCheckReader fails once a record of the chunk is out of [from, until), e.g. the server returned more than requested.
+// As the ranges are split at the boundaries of the time slots, such a record would be counted in the time slot
+// of the adjacent chunk too. Zero value of the bounds means unchecked.
+type chunkCheckReader struct {
+	r           io.Reader
+	chunk       [2]time.Time
+	from, until time.Time
+	sep         byte
+	// Timestamp of the current record so far, the first field
+	stamp   []byte
+	inStamp bool
+	midLine bool
+}
+
+// Max length of the timestamp checked, e.g. with fractional seconds and an offset
+const maxStampLength = 40
+
+func (c *chunkCheckReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	for _, b := range p[:n] {
+		switch {
+		case b == c.sep:
+			if cerr := c.check(); cerr != nil {
+				return 0, cerr
+			}
+			c.midLine = false
+		case !c.midLine:
+			c.midLine, c.inStamp, c.stamp = true, true, append(c.stamp[:0], b)
+		case c.inStamp && (b == ' ' || b == '\t'):
+			c.inStamp = false
+		case c.inStamp && len(c.stamp) < maxStampLength:
+			c.stamp = append(c.stamp, b)
+		}
+	}
+	if err == io.EOF && c.midLine {
+		// the last record is not terminated
+		if cerr := c.check(); cerr != nil {
+			return 0, cerr
+		}
+		c.midLine = false
+	}
+	return n, err
+}
+
+// check checks the timestamp of the record just read. Malformed ones are left to the aggregation.
+func (c *chunkCheckReader) check() error {
+	if !c.midLine {
+		return nil
+	}
+	t, perr := time.Parse(time.RFC3339, string(c.stamp))
+	if perr != nil {
+		return nil
+	}
+	if (!c.from.IsZero() && t.Before(c.from)) || (!c.until.IsZero() && !t.Before(c.until)) {
+		return fmt.Errorf("chunk %s - %s returned a record out of its range: %s. the time slot on the boundary would be double counted",
+			c.chunk[0].Format(time.RFC3339), c.chunk[1].Format(time.RFC3339), c.stamp)
+	}
+	return nil
+}
+
+// splitRange splits [st, ed] into at most n contiguous ranges of about the same number of time slots.
+// The ranges are split at the boundaries of the time slots, so no time slot spans two ranges.
+// Each range ends a second before the next begins, as the range of the API includes the end.
+func splitRange(st, ed time.Time, g aggregate.Granularity, n int) [][2]time.Time {
+	per := (g.BucketCount(st, ed) + int64(n) - 1) / int64(n)
+
+	var ranges [][2]time.Time
+	from := st
+	for {
+		boundary := from.Truncate(g.Duration).Add(time.Duration(per) * g.Duration)
+		if !boundary.Before(ed) {
+			break
+		}
+		ranges = append(ranges, [2]time.Time{from, boundary.Add(-time.Second)})
+		from = boundary
+	}
+	return append(ranges, [2]time.Time{from, ed})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+func TestSplitRange(t *testing.T) {
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2021, 3, 4, hour, minute, second, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		st, ed time.Time
+		n      int
+		want   [][2]time.Time
+	}{
+		{name: "even", st: at(0, 0, 0), ed: at(3, 59, 59), n: 2, want: [][2]time.Time{{at(0, 0, 0), at(1, 59, 59)}, {at(2, 0, 0), at(3, 59, 59)}}},
+		{name: "uneven", st: at(0, 0, 0), ed: at(2, 59, 59), n: 2, want: [][2]time.Time{{at(0, 0, 0), at(1, 59, 59)}, {at(2, 0, 0), at(2, 59, 59)}}},
+		// split at the boundaries of the hours, even from the middle of one
+		{name: "mid hour", st: at(0, 30, 0), ed: at(2, 15, 0), n: 3, want: [][2]time.Time{{at(0, 30, 0), at(0, 59, 59)}, {at(1, 0, 0), at(1, 59, 59)}, {at(2, 0, 0), at(2, 15, 0)}}},
+		{name: "fewer hours than n", st: at(0, 0, 0), ed: at(1, 30, 0), n: 4, want: [][2]time.Time{{at(0, 0, 0), at(0, 59, 59)}, {at(1, 0, 0), at(1, 30, 0)}}},
+		{name: "single", st: at(0, 0, 0), ed: at(5, 0, 0), n: 1, want: [][2]time.Time{{at(0, 0, 0), at(5, 0, 0)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitRange(tt.st, tt.ed, aggregate.GranularityHour, tt.n)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchParallel(t *testing.T) {
+	url := newTestAPI(t)
+	run := func(args ...string) string {
+		stdout, stderr, code := runMain(t, append(append([]string{"--url=" + url}, args...), "2021-03-04T00:30:00Z", "2021-03-06T12:00:00Z")...)
+		if code != exitOK {
+			t.Fatalf("exited with %d: %s", code, stderr)
+		}
+		return stdout
+	}
+	single := run()
+	if strings.Count(single, "\n") != 61 {
+		t.Fatalf("got %q, want 61 hours", single)
+	}
+	for _, n := range []string{"2", "4", "7"} {
+		if got := run("--parallelism=" + n); got != single {
+			t.Errorf("--parallelism=%s: got %q, want the same as a single fetch", n, got)
+		}
+	}
+}
+
+func TestFetchParallelFailure(t *testing.T) {
+	// the second chunk fails at once, while the others hang until the test ends
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Query().Get("begin"), "2021-03-04T02:") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "--parallelism=3", "2021-03-04T00:00:00Z", "2021-03-04T05:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, _, err = fetchParallel(context.Background(), newClient(opts), opts, opts.parallelism)
+	if err == nil || !strings.Contains(err.Error(), "chunk 2021-03-04T02:00:00Z - 2021-03-04T03:59:59Z: unexpected status code: 400") {
+		t.Errorf("got %v, want the error of the failed chunk", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s, want the rest canceled", elapsed)
+	}
+}
+
+func TestChunkCheckReader(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2021, 3, 4, hour, 0, 0, 0, time.UTC) }
+	chunk := [2]time.Time{at(2), at(4).Add(-time.Second)}
+	tests := []struct {
+		name        string
+		from, until time.Time
+		input       string
+		err         string
+	}{
+		{name: "within", from: at(2), until: at(4), input: "2021-03-04T02:00:00Z 1\n2021-03-04T03:59:59Z 2\n"},
+		{name: "before", from: at(2), until: at(4), input: "2021-03-04T02:00:00Z 1\n2021-03-04T01:59:59Z 2\n", err: "returned a record out of its range: 2021-03-04T01:59:59Z"},
+		{name: "at the end", from: at(2), until: at(4), input: "2021-03-04T04:00:00Z 1\n", err: "returned a record out of its range: 2021-03-04T04:00:00Z"},
+		{name: "offset", from: at(2), until: at(4), input: "2021-03-04T12:30:00+09:00 1\n2021-03-04T14:30:00+09:00 2\n", err: "returned a record out of its range: 2021-03-04T14:30:00+09:00"},
+		{name: "unterminated", from: at(2), until: at(4), input: "2021-03-04T02:00:00Z 1\n2021-03-04T05:00:00Z 2", err: "returned a record out of its range: 2021-03-04T05:00:00Z"},
+		// left to the aggregation
+		{name: "malformed", from: at(2), until: at(4), input: "garbage\n2021-03-04T02:00:00Z 1\n"},
+		// the first and last chunks are open ended
+		{name: "unchecked", input: "2021-03-01T00:00:00Z 1\n2021-03-09T00:00:00Z 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a byte at a time as well, so the timestamp spans the reads
+			for _, r := range []io.Reader{strings.NewReader(tt.input), iotest.OneByteReader(strings.NewReader(tt.input))} {
+				_, err := io.ReadAll(&chunkCheckReader{r: r, chunk: chunk, from: tt.from, until: tt.until, sep: '\n'})
+				if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+					t.Errorf("got %v, want %q", err, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchParallelOutOfRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra map[string]string
+		err   string
+	}{
+		{
+			name:  "before the chunk",
+			extra: map[string]string{"2021-03-04T02:": "2021-03-04T01:50:00Z 9\n"},
+			err:   "chunk 2021-03-04T02:00:00Z - 2021-03-04T03:59:59Z returned a record out of its range: 2021-03-04T01:50:00Z. the time slot on the boundary would be double counted",
+		},
+		{
+			name:  "past the chunk",
+			extra: map[string]string{"2021-03-04T00:": "2021-03-04T02:00:00Z 9\n"},
+			err:   "chunk 2021-03-04T00:00:00Z - 2021-03-04T01:59:59Z returned a record out of its range: 2021-03-04T02:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				begin, _ := time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
+				end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+				w.Header().Set("Content-Type", "text/plain")
+				body := testRecords(begin, end)
+				for prefix, records := range tt.extra {
+					if strings.HasPrefix(r.URL.Query().Get("begin"), prefix) {
+						// the server returns more than requested
+						body += records
+					}
+				}
+				io.WriteString(w, body)
+			}))
+			defer srv.Close()
+
+			_, stderr, code := runMain(t, "--url="+srv.URL, "--parallelism=3", "2021-03-04T00:00:00Z", "2021-03-04T05:59:59Z")
+			if code != exitError || !strings.Contains(stderr, tt.err) {
+				t.Errorf("got %d, %q, want %q", code, stderr, tt.err)
+			}
+		})
+	}
+}
+
+func TestFetchParallelBoundedHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 40 MB")
+	}
+	// about 10 MB of the records per chunk, chunked as the length is not told in advance
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin, _ := time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		w.Header().Set("Content-Type", "text/plain")
+		for day := begin; !day.After(end); day = day.Add(24 * time.Hour) {
+			dayEnd := day.Add(24*time.Hour - time.Second)
+			if dayEnd.After(end) {
+				dayEnd = end
+			}
+			io.WriteString(w, testRecords(day, dayEnd))
+		}
+	}))
+	defer srv.Close()
+
+	opts, err := validateCommandArgs([]string{"--url=" + srv.URL, "--parallelism=4", "2021-03-04T00:00:00Z", "2048-07-20T23:59:59Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out countingWriter
+	grown := heapGrowth(func() {
+		stream, release, err := fetchParallel(context.Background(), newClient(opts), opts, opts.parallelism)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		if err = tally(context.Background(), stream, &out, opts); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := int(opts.Granularity.BucketCount(opts.St, opts.Ed)); out.lines != want {
+		t.Errorf("got %d hours, want %d", out.lines, want)
+	}
+	// well below the body, with room for the garbage of the stub collected lazily
+	if grown > 16<<20 {
+		t.Errorf("heap grew by %d bytes, want the chunks streamed", grown)
+	}
+}
+
+// BenchmarkFetchParallel compares a single fetch of 4 weeks with 4 concurrent ones, against the local server of some latency.
+func BenchmarkFetchParallel(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin, _ := time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		w.Header().Set("Content-Type", "text/plain")
+		// 20ms to produce each day of the records
+		for day := begin; !day.After(end); day = day.Add(24 * time.Hour) {
+			time.Sleep(20 * time.Millisecond)
+			dayEnd := day.Add(24*time.Hour - time.Second)
+			if dayEnd.After(end) {
+				dayEnd = end
+			}
+			io.WriteString(w, testRecords(day, dayEnd))
+		}
+	}))
+	defer srv.Close()
+
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("N=%d", n), func(b *testing.B) {
+			opts, err := validateCommandArgs([]string{"--url=" + srv.URL, fmt.Sprintf("--parallelism=%d", n), "2021-03-01T00:00:00Z", "2021-03-28T23:59:59Z"})
+			if err != nil {
+				b.Fatal(err)
+			}
+			client := newClient(opts)
+			for range b.N {
+				var (
+					stream  io.Reader
+					release func()
+				)
+				if n == 1 {
+					stream, release, err = fetchCached(context.Background(), client, opts, opts.St, opts.Ed)
+				} else {
+					stream, release, err = fetchParallel(context.Background(), client, opts, n)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = tally(context.Background(), stream, io.Discard, opts); err != nil {
+					b.Fatal(err)
+				}
+				release()
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// Rows buffered in memory before flushed as a row group
+const parquetRowGroupSize = 10_000
+
+// parquetRow is a time slot in the parquet output.
+type parquetRow struct {
+	Time  time.Time `parquet:"time,timestamp(millisecond)"`
+	Avg   float64   `parquet:"avg"`
+	Count int64     `parquet:"count"`
+}
+
+// parquetSlotWriter writes the time slots as parquet rows.
+// Memory is bounded as the rows are flushed by row groups.
+type parquetSlotWriter struct {
+	w        *parquet.GenericWriter[parquetRow]
+	buffered int
+	// the first error, as the slots are written from a callback
+	err error
+}
+
+func newParquetSlotWriter(w io.Writer) *parquetSlotWriter {
+	return &parquetSlotWriter{w: parquet.NewGenericWriter[parquetRow](w)}
+}
+
+// write writes the slot. Intended for aggregate.Options.OnSlot.
+func (p *parquetSlotWriter) write(s aggregate.Slot) {
+	if p.err != nil {
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339, s.Time)
+	if err != nil {
+		p.err = fmt.Errorf("invalid time slot: %w", err)
+		return
+	}
+	if _, err = p.w.Write([]parquetRow{{Time: t, Avg: s.Avg, Count: int64(s.Count)}}); err != nil {
+		p.err = fmt.Errorf("failed to write parquet row: %w", err)
+		return
+	}
+
+	if p.buffered++; p.buffered >= parquetRowGroupSize {
+		if err = p.w.Flush(); err != nil {
+			p.err = fmt.Errorf("failed to flush parquet row group: %w", err)
+		}
+		p.buffered = 0
+	}
+}
+
+// Close writes the footer. Returns the first error of the writes, if any.
+func (p *parquetSlotWriter) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if err := p.w.Close(); err != nil {
+		return fmt.Errorf("failed to close parquet writer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+func TestParquetOutput(t *testing.T) {
+	var (
+		path  = filepath.Join(t.TempDir(), "out.parquet")
+		begin = time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)
+		opts  = defaultOptions()
+	)
+	opts.Format = formatParquet
+	opts.outputPath = path
+
+	if err := tallyToOutput(context.Background(), strings.NewReader(testRecords(begin, begin.Add(time.Hour+50*time.Minute))), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := parquet.ReadFile[parquetRow](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []parquetRow{
+		{Time: begin, Avg: 3.25, Count: 6},
+		{Time: begin.Add(time.Hour), Avg: 4.25, Count: 6},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, row := range rows {
+		if !row.Time.Equal(want[i].Time) || math.Abs(row.Avg-want[i].Avg) > 1e-4 || row.Count != want[i].Count {
+			t.Errorf("row %d: got %+v, want %+v", i, row, want[i])
+		}
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		pw    = newParquetSlotWriter(&buf)
+		begin = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+		n     = parquetRowGroupSize*2 + 1
+	)
+	for i := range n {
+		pw.write(aggregate.Slot{Time: begin.Add(time.Duration(i) * time.Minute).Format(time.RFC3339), Avg: float64(i), Count: 1})
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.NumRows(); got != int64(n) {
+		t.Errorf("got %d rows, want %d", got, n)
+	}
+	// flushed every parquetRowGroupSize rows, the rest by Close
+	if got := len(f.RowGroups()); got != 3 {
+		t.Errorf("got %d row groups, want 3", got)
+	}
+}
+
+func TestParquetInvalidSlot(t *testing.T) {
+	pw := newParquetSlotWriter(&bytes.Buffer{})
+	pw.write(aggregate.Slot{Time: "broken"})
+	pw.write(aggregate.Slot{Time: "2021-03-04T03:00:00Z"})
+	if err := pw.Close(); err == nil || !strings.Contains(err.Error(), "invalid time slot") {
+		t.Errorf("got %v, want the error of the first write", err)
+	}
+}
+
+func TestParquetFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"--format=parquet"},
+		{"--format=parquet", "--output=out.parquet", "--trailing-checksum"},
+		{"--format=csv", "--output=out.csv"},
+	} {
+		if _, err := validateCommandArgs(append(args, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z")); err == nil {
+			t.Errorf("%q: want the error", args)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+const (
+	// Size of each chunk read from the stream in background
+	pipelineChunkSize = 32 * 1024
+	// Max number of chunks read ahead of tally
+	pipelineDepth = 16
+)
+
+type pipelineChunk struct {
+	data []byte
+	err  error
+}
+
+// pipelineReader reads the source in background into a bounded channel of chunks,
+// so that reading from the network overlaps with tally.
+// Memory is bounded as the chunk buffers are recycled.
+type pipelineReader struct {
+	chunks <-chan pipelineChunk
+	free   chan<- []byte
+	cur    pipelineChunk
+	off    int
+}
+
+func newPipelineReader(ctx context.Context, src io.Reader) io.Reader {
+	var (
+		chunks = make(chan pipelineChunk, pipelineDepth)
+		free   = make(chan []byte, pipelineDepth+1)
+	)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, pipelineChunkSize)
+	}
+
+	go func() {
+		defer close(chunks)
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-ctx.Done():
+				return
+			}
+
+			n, err := src.Read(buf)
+			select {
+			case chunks <- pipelineChunk{data: buf[:n], err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return &pipelineReader{chunks: chunks, free: free}
+}
+
+// Read fills p across chunk boundaries.
+func (r *pipelineReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if r.off == len(r.cur.data) {
+			if r.cur.err != nil {
+				if n > 0 {
+					// report the error on the next read
+					return n, nil
+				}
+				return 0, r.cur.err
+			}
+			if r.cur.data != nil {
+				// give back the consumed buffer
+				r.free <- r.cur.data[:cap(r.cur.data)]
+			}
+
+			chunk, ok := <-r.chunks
+			if !ok {
+				// only happens when the context is done
+				return n, io.ErrUnexpectedEOF
+			}
+			r.cur, r.off = chunk, 0
+			continue
+		}
+
+		copied := copy(p[n:], r.cur.data[r.off:])
+		r.off += copied
+		n += copied
+	}
+	return n, nil
+}
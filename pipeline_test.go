@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestPipelineReader(t *testing.T) {
+	begin := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	data := testRecords(begin, begin.Add(200*24*time.Hour))
+	src := &countingReader{r: strings.NewReader(data)}
+	if len(data) < (pipelineDepth+4)*pipelineChunkSize {
+		t.Fatalf("too small data of %d bytes to fill the pipeline", len(data))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := newPipelineReader(ctx, src)
+	head := make([]byte, 1)
+	if _, err := io.ReadFull(stream, head); err != nil {
+		t.Fatal(err)
+	}
+
+	// the source is read ahead in background, while the consumer is idle
+	deadline := time.Now().Add(time.Second)
+	for src.n.Load() < 4*pipelineChunkSize && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := src.n.Load(); n < 4*pipelineChunkSize {
+		t.Fatalf("got %d bytes read ahead, want the reads overlapping", n)
+	}
+	// up to the buffers in the channel, the one being sent and the one consumed
+	time.Sleep(20 * time.Millisecond)
+	if n, limit := src.n.Load(), int64(pipelineDepth+2)*pipelineChunkSize; n > limit {
+		t.Errorf("got %d bytes read ahead, want at most %d", n, limit)
+	}
+
+	rest, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(head) + string(rest); got != data {
+		t.Errorf("got %d bytes, want the %d bytes of the source as is", len(got), len(data))
+	}
+
+	var want, out bytes.Buffer
+	opts := defaultOptions()
+	if err = tally(ctx, strings.NewReader(data), &want, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err = tally(ctx, newPipelineReader(ctx, strings.NewReader(data)), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want.String() {
+		t.Errorf("got %q, want %q", out.String(), want.String())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Window of the sample fetched by the preflight, from the start of the range
+const preflightSampleWindow = 10 * time.Minute
+
+// volumeEstimate is the estimated size of the whole range.
+type volumeEstimate struct {
+	Bytes   int64
+	Records int64
+}
+
+// preflight fetches a small sample from the start of the range, then extrapolates it to the whole range,
+// as the API has no way to count without downloading.
+func preflight(ctx context.Context, client *fasthttp.Client, opts options) (est volumeEstimate, err error) {
+	st, ed := opts.St, opts.Ed
+	sampleEd := st.Add(preflightSampleWindow)
+	if sampleEd.After(ed) {
+		sampleEd = ed
+	}
+
+	// quiet, as the sample is not the data
+	opts.isDebug = false
+	stream, release, err := fetch(ctx, client, opts, st, sampleEd)
+	if err != nil {
+		return est, fmt.Errorf("preflight: %w", err)
+	}
+	defer release()
+
+	sample, err := io.ReadAll(stream)
+	if err != nil {
+		return est, fmt.Errorf("preflight: failed to read sample: %w", err)
+	}
+	return extrapolate(int64(len(sample)), int64(bytes.Count(sample, []byte{opts.RecordSeparator})), sampleEd.Sub(st), ed.Sub(st)), nil
+}
+
+// extrapolate scales the sample of the window to the total duration, assuming the density is even.
+func extrapolate(sampleBytes, sampleRecords int64, window, total time.Duration) volumeEstimate {
+	if window <= 0 || total <= window {
+		return volumeEstimate{Bytes: sampleBytes, Records: sampleRecords}
+	}
+	ratio := float64(total) / float64(window)
+	return volumeEstimate{Bytes: int64(float64(sampleBytes) * ratio), Records: int64(float64(sampleRecords) * ratio)}
+}
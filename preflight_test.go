@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtrapolate(t *testing.T) {
+	tests := []struct {
+		name          string
+		window, total time.Duration
+		want          volumeEstimate
+	}{
+		{name: "day", window: 10 * time.Minute, total: 24 * time.Hour, want: volumeEstimate{Bytes: 8640, Records: 288}},
+		{name: "within the window", window: 10 * time.Minute, total: 5 * time.Minute, want: volumeEstimate{Bytes: 60, Records: 2}},
+		{name: "empty window", window: 0, total: time.Hour, want: volumeEstimate{Bytes: 60, Records: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extrapolate(60, 2, tt.window, tt.total); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreflightConfirm(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		begin, _ := time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(testRecords(begin, end)))
+	}))
+	defer srv.Close()
+
+	// 2 records of 30 bytes in the sample of 10 minutes, so about 259 KB over 30 days
+	_, stderr, code := runMain(t, "--url="+srv.URL, "--preflight-confirm=100000", "2021-03-01T00:00:00Z", "2021-03-31T00:00:00Z")
+	if code != exitError || !strings.Contains(stderr, "estimated 259200 bytes exceeds --preflight-confirm=100000. aborted") {
+		t.Errorf("got %d, %q, want the estimate refused", code, stderr)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want only the sample", got)
+	}
+
+	// within the limit, the range is fetched after the sample
+	requests.Store(0)
+	stdout, stderr, code := runMain(t, "--url="+srv.URL, "--preflight-confirm=100000", "2021-03-04T03:00:00Z", "2021-03-04T03:59:59Z")
+	if code != exitOK || stdout != "2021-03-04T03:00:00Z   3.2500\n" || !strings.Contains(stderr, "preflight: estimated 0 KB, 11 records") {
+		t.Errorf("got %d, %q, %q", code, stdout, stderr)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want the sample and the range", got)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// runReport is the machine readable summary of a run, written by `--report-json`.
+type runReport struct {
+	aggregate.Stats
+	Begin time.Time `json:"begin"`
+	End   time.Time `json:"end"`
+	// Zero under `--deterministic`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+
+	startedAt     time.Time
+	deterministic bool
+}
+
+func newRunReport(opts options) *runReport {
+	return &runReport{Begin: opts.St, End: opts.Ed, startedAt: now(), deterministic: opts.Deterministic}
+}
+
+// write writes the report as a JSON object to the path. The error is the one the run failed with, if any.
+func (r *runReport) write(path string, runErr error) error {
+	if !r.deterministic {
+		r.Duration = now().Sub(r.startedAt).Seconds()
+	}
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err = os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
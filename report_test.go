@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNow replaces now with a clock advancing by step on each call, until the test ends.
+func fakeNow(t *testing.T, start time.Time, step time.Duration) {
+	t.Helper()
+	orig := now
+	t.Cleanup(func() { now = orig })
+	now = func() time.Time {
+		start = start.Add(step)
+		return start
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	fakeNow(t, time.Date(2021, 3, 5, 0, 0, 0, 0, time.UTC), 2*time.Second)
+	path := filepath.Join(t.TempDir(), "report.json")
+	opts, err := validateCommandArgs([]string{"--comment=#", "--report-json=" + path, "2021-03-04T03:00:00Z", "2021-03-04T04:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newRunReport(opts)
+	opts.Stats = &report.Stats
+	mustAggregate(t, opts, "# header\n2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n")
+	if err = report.write(opts.reportPath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"begin": "2021-03-04T03:00:00Z", "end": "2021-03-04T04:00:00Z", "duration_seconds": 2.0,
+		"records": 3.0, "skipped": 1.0, "slots": 2.0,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("got %s %v, want %v", key, got[key], value)
+		}
+	}
+	if _, ok := got["error"]; ok {
+		t.Errorf("got error %v of the successful run", got["error"])
+	}
+
+	// the failed run reports the error
+	if err = newRunReport(opts).write(path, errors.New("parse error")); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = os.ReadFile(path)
+	if err = json.Unmarshal(b, &got); err != nil || got["error"] != "parse error" {
+		t.Errorf("got %s, %v, want the error", b, err)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	fakeNow(t, time.Date(2021, 3, 5, 0, 0, 0, 0, time.UTC), 2*time.Second)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "records.txt")
+	if err := os.WriteFile(input, []byte("2021-03-04T03:00:00Z 1\n2021-03-04T03:10:00Z 2\n2021-03-04T04:00:00Z 4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// run runs on the same input, returning the output and the report
+	run := func(args ...string) string {
+		report := filepath.Join(dir, "report.json")
+		args = append([]string{"--input=" + input, "--report-json=" + report}, args...)
+		stdout, stderr, code := runMain(t, args...)
+		if code != exitOK {
+			t.Fatalf("exited with %d: %s", code, stdout)
+		}
+		b, err := os.ReadFile(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout + stderr + string(b)
+	}
+
+	first, second := run("--deterministic"), run("--deterministic")
+	if first != second {
+		t.Errorf("got the different runs:\n%s\n%s", first, second)
+	}
+	if !strings.Contains(first, `"duration_seconds": 0`) {
+		t.Errorf("got %s, want the timing fields zeroed", first)
+	}
+	if got := run(); !strings.Contains(got, `"duration_seconds": 2`) {
+		t.Errorf("got %s, want the duration without the flag", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// Expected output of tally over the data generated by selftestData.
+// The 03 hour has no data, so it must be skipped.
+const selftestExpected = `2021-03-04T00:00:00Z 102.5000
+2021-03-04T01:00:00Z 112.5000
+2021-03-04T02:00:00Z 122.5000
+2021-03-04T04:00:00Z 142.5000
+`
+
+// selftestData generates synthetic records in the same format as the API.
+// Each hour has 6 records, one per 10 minutes, whose values are
+// 100 + hour*10 + 0..5, so the hourly average is 100 + hour*10 + 2.5
+func selftestData() []byte {
+	var (
+		buf  bytes.Buffer
+		base = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	)
+	for _, hour := range []int{0, 1, 2, 4} {
+		for i := 0; i < 6; i++ {
+			ts := base.Add(time.Duration(hour)*time.Hour + time.Duration(i*10)*time.Minute)
+			fmt.Fprintf(&buf, "%s %8.4f\n", ts.Format(time.RFC3339), float64(100+hour*10+i))
+		}
+	}
+	return buf.Bytes()
+}
+
+// selftest runs synthetic data through the aggregation core
+// and verifies the output without network access.
+func selftest(ctx context.Context) error {
+	var (
+		out  bytes.Buffer
+		opts = defaultOptions()
+	)
+	if err := tally(ctx, bytes.NewReader(selftestData()), &out, opts); err != nil {
+		return fmt.Errorf("selftest failed: %w", err)
+	}
+
+	if got := out.String(); got != selftestExpected {
+		return fmt.Errorf("selftest failed: unexpected output.\nexpected:\n%s\ngot:\n%s", selftestExpected, got)
+	}
+
+	return nil
+}
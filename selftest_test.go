@@ -0,0 +1,12 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	if err := selftest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// Default listen address of server mode
+const defaultServeAddr = "localhost:8080"
+
+// upstreamURL is the endpoint of the API aggregated by server mode. Replaceable for testing.
+var upstreamURL = apiURL
+
+// serve runs server mode.
+func serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("GET /{$}", handleSimpleJSONTest)
+	mux.HandleFunc("POST /search", handleSimpleJSONSearch)
+	mux.HandleFunc("POST /query", handleSimpleJSONQuery)
+
+	fmt.Printf("Listening on %s\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// handleEvents streams each finalized time slot as a Server-Sent Event, as it's computed from the upstream.
+//
+//	GET /events?begin=<RFC3339>&end=<RFC3339>[&unit=<unit>]
+//
+//	event: slot
+//	data: {"time":"2021-03-04T03:00:00Z","avg":113.1652,"count":45,"unit":"celsius"}
+//
+// The stream ends with a `done` event, or an `error` event if the aggregation failed halfway.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		opts = defaultOptions()
+		err  error
+	)
+	if opts.St, err = time.Parse(time.RFC3339, r.URL.Query().Get("begin")); err != nil {
+		http.Error(w, fmt.Sprintf("invalid begin: %v", err), http.StatusBadRequest)
+		return
+	}
+	if opts.Ed, err = time.Parse(time.RFC3339, r.URL.Query().Get("end")); err != nil {
+		http.Error(w, fmt.Sprintf("invalid end: %v", err), http.StatusBadRequest)
+		return
+	}
+	opts.ValueUnit = r.URL.Query().Get("unit")
+	opts.apiURL = upstreamURL
+	if opts.St.After(opts.Ed) {
+		http.Error(w, "begin is after end", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), opts.processTimeout)
+	defer cancel()
+
+	stream, release, err := fetch(ctx, newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	// the fetch slot is held while the events are streamed
+	defer release()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	opts.OnSlot = func(s aggregate.Slot) {
+		data, _ := json.Marshal(s)
+		fmt.Fprintf(w, "event: slot\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	if err = tally(ctx, stream, io.Discard, opts); err != nil {
+		data, _ := json.Marshal(err.Error())
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+	} else {
+		fmt.Fprint(w, "event: done\ndata: {}\n\n")
+	}
+	flusher.Flush()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// stubUpstream replaces the upstream of server mode with the stub API, until the test ends.
+func stubUpstream(t *testing.T) {
+	t.Helper()
+	orig := upstreamURL
+	t.Cleanup(func() { upstreamURL = orig })
+	upstreamURL = newTestAPI(t)
+}
+
+// sseEvent is an event of the Server-Sent Events stream.
+type sseEvent struct {
+	name string
+	data string
+}
+
+func TestHandleEvents(t *testing.T) {
+	stubUpstream(t)
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events?begin=2021-03-04T00:00:00Z&end=2021-03-04T02:00:00Z&unit=celsius")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("got %d of %s", resp.StatusCode, ct)
+	}
+
+	var (
+		events  []sseEvent
+		current sseEvent
+		scanner = bufio.NewScanner(resp.Body)
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 4 || events[3].name != "done" {
+		t.Fatalf("got %v, want 3 slots and done", events)
+	}
+	for i, e := range events[:3] {
+		var s aggregate.Slot
+		if err = json.Unmarshal([]byte(e.data), &s); err != nil || e.name != "slot" {
+			t.Fatalf("got %v, %v", e, err)
+		}
+		// 6 records of hour.00 to hour.50, but the end hour of only the first
+		want := aggregate.Slot{Time: []string{"2021-03-04T00:00:00Z", "2021-03-04T01:00:00Z", "2021-03-04T02:00:00Z"}[i], Avg: float64(i) + 0.25, Count: 6, Unit: "celsius"}
+		if i == 2 {
+			want.Avg, want.Count = 2, 1
+		}
+		if s.Time != want.Time || s.Count != want.Count || s.Unit != want.Unit || !approxEqual(s.Avg, want.Avg) {
+			t.Errorf("got %+v, want %+v", s, want)
+		}
+	}
+}
+
+func TestHandleEventsInvalidRange(t *testing.T) {
+	for _, query := range []string{"begin=x&end=2021-03-04T02:00:00Z", "begin=2021-03-04T00:00:00Z", "begin=2021-03-04T02:00:00Z&end=2021-03-04T00:00:00Z"} {
+		rec := httptest.NewRecorder()
+		handleEvents(rec, httptest.NewRequest(http.MethodGet, "/events?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestOnSlot(t *testing.T) {
+	var slots []aggregate.Slot
+	opts := defaultOptions()
+	opts.OnSlot = func(s aggregate.Slot) { slots = append(slots, s) }
+	mustAggregate(t, opts, "2021-03-04T03:00:00Z 001.0000\n2021-03-04T03:10:00Z 002.0000\n2021-03-04T04:00:00Z 004.0000\n")
+
+	want := []aggregate.Slot{{Time: "2021-03-04T03:00:00Z", Avg: 1.5, Count: 2}, {Time: "2021-03-04T04:00:00Z", Avg: 4, Count: 1}}
+	if len(slots) != len(want) {
+		t.Fatalf("got %+v, want %+v", slots, want)
+	}
+	for i := range want {
+		if slots[i] != want[i] {
+			t.Errorf("got %+v, want %+v", slots[i], want[i])
+		}
+	}
+}
+
+// approxEqual reports whether a and b are equal within the precision of the output.
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+// Endpoints of the Grafana SimpleJSON datasource in server mode.
+// The targets are the aggregation functions, each a timeseries of the time slots.
+//
+//	GET  /        connection test
+//	POST /search  lists the targets
+//	POST /query   aggregates the range of each target
+
+// simpleJSONQuery is the body of `/query`. Only the fields in use are decoded.
+type simpleJSONQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	// The granularity is selected to yield about this many time slots. 0 means hour.
+	MaxDataPoints int `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+// simpleJSONSeries is a timeseries of the `/query` response.
+// Each datapoint is `[value, unix milliseconds]`.
+type simpleJSONSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// simpleJSONTargets are the aggregation functions of a single value per time slot, so no histogram,
+// of which the bins are neither a datapoint nor given the range by the query.
+var simpleJSONTargets = slices.DeleteFunc(slices.Clone(aggregate.AggFuncs), func(agg string) bool {
+	return agg == aggregate.AggHistogram
+})
+
+func handleSimpleJSONTest(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleSimpleJSONSearch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, simpleJSONTargets)
+}
+
+func handleSimpleJSONQuery(w http.ResponseWriter, r *http.Request) {
+	var query simpleJSONQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, fmt.Sprintf("invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+	if query.Range.From.After(query.Range.To) {
+		http.Error(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+	for _, t := range query.Targets {
+		if !slices.Contains(simpleJSONTargets, t.Target) {
+			http.Error(w, fmt.Sprintf("invalid target: %v", t.Target), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := defaultOptions()
+	opts.St, opts.Ed = query.Range.From, query.Range.To
+	opts.apiURL = upstreamURL
+	// JSON has no NaN
+	opts.DropNaN = true
+	if query.MaxDataPoints > 0 {
+		var err error
+		if opts.Granularity, err = aggregate.SelectGranularity(opts.St, opts.Ed, query.MaxDataPoints); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), opts.processTimeout)
+	defer cancel()
+
+	series := make([]simpleJSONSeries, 0, len(query.Targets))
+	for _, t := range query.Targets {
+		o := opts
+		o.Agg = t.Target
+		s, status, err := querySeries(ctx, o)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		series = append(series, s)
+	}
+	writeJSON(w, series)
+}
+
+// querySeries fetches the range and aggregates it into the timeseries of the target.
+// The status code is the one to respond with on error.
+func querySeries(ctx context.Context, opts options) (s simpleJSONSeries, status int, err error) {
+	s = simpleJSONSeries{Target: opts.Agg, Datapoints: [][2]float64{}}
+
+	stream, release, err := fetch(ctx, newClient(opts), opts, opts.St, opts.Ed)
+	if err != nil {
+		return s, http.StatusBadGateway, err
+	}
+	defer release()
+
+	opts.OnSlot = func(slot aggregate.Slot) {
+		// the label is from a parsed timestamp
+		t, _ := time.Parse(time.RFC3339, slot.Time)
+		s.Datapoints = append(s.Datapoints, [2]float64{slot.Avg, float64(t.UnixMilli())})
+	}
+	if err = tally(ctx, stream, io.Discard, opts); err != nil {
+		return s, http.StatusInternalServerError, err
+	}
+	return s, http.StatusOK, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
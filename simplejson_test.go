@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tak1827/mode-assignment-general-v2/aggregate"
+)
+
+func TestSimpleJSONSearch(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleSimpleJSONSearch(rec, httptest.NewRequest(http.MethodPost, "/search", nil))
+
+	var targets []string
+	if err := json.Unmarshal(rec.Body.Bytes(), &targets); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(targets, aggregate.AggAvg) || slices.Contains(targets, aggregate.AggHistogram) {
+		t.Errorf("got %v, want the aggregation functions except histogram", targets)
+	}
+}
+
+func TestSimpleJSONQueryInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "not json", body: `{"range":`, want: "invalid query"},
+		{name: "reversed range", body: `{"range":{"from":"2021-03-04T03:00:00Z","to":"2021-03-04T00:00:00Z"},"targets":[{"target":"avg"}]}`, want: "from is after to"},
+		{name: "unknown target", body: `{"range":{"from":"2021-03-04T00:00:00Z","to":"2021-03-04T03:00:00Z"},"targets":[{"target":"median"}]}`, want: "invalid target: median"},
+		// the bins are not a datapoint
+		{name: "histogram", body: `{"range":{"from":"2021-03-04T00:00:00Z","to":"2021-03-04T03:00:00Z"},"targets":[{"target":"histogram"}]}`, want: "invalid target: histogram"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleSimpleJSONQuery(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(tt.body)))
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got %d %q, want 400 of %q", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSimpleJSONQuery(t *testing.T) {
+	stubUpstream(t)
+	body := `{"range":{"from":"2021-03-04T00:00:00Z","to":"2021-03-04T01:59:59Z"},"targets":[{"target":"avg"},{"target":"count"}]}`
+	rec := httptest.NewRecorder()
+	handleSimpleJSONQuery(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(body)))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d of %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	// the timeseries shape of the datasource, `[value, unix milliseconds]` per time slot
+	var series []struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &series); err != nil {
+		t.Fatal(err)
+	}
+	want := []simpleJSONSeries{
+		{Target: "avg", Datapoints: [][2]float64{{0.25, 1614816000000}, {1.25, 1614819600000}}},
+		{Target: "count", Datapoints: [][2]float64{{6, 1614816000000}, {6, 1614819600000}}},
+	}
+	if len(series) != len(want) {
+		t.Fatalf("got %+v, want %+v", series, want)
+	}
+	for i, s := range series {
+		if s.Target != want[i].Target || len(s.Datapoints) != len(want[i].Datapoints) {
+			t.Fatalf("got %+v, want %+v", s, want[i])
+		}
+		for j, p := range s.Datapoints {
+			if !approxEqual(p[0], want[i].Datapoints[j][0]) || p[1] != want[i].Datapoints[j][1] {
+				t.Errorf("%s: got %v, want %v", s.Target, p, want[i].Datapoints[j])
+			}
+		}
+	}
+}
+
+func TestSimpleJSONQueryMaxDataPoints(t *testing.T) {
+	stubUpstream(t)
+	// about 4 time slots of the 4 hours, so by hour rather than minute
+	body := `{"range":{"from":"2021-03-04T00:00:00Z","to":"2021-03-04T03:59:59Z"},"maxDataPoints":4,"targets":[{"target":"max"}]}`
+	rec := httptest.NewRecorder()
+	handleSimpleJSONQuery(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(body)))
+
+	var series []simpleJSONSeries
+	if err := json.Unmarshal(rec.Body.Bytes(), &series); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if len(series) != 1 || len(series[0].Datapoints) != 4 || !approxEqual(series[0].Datapoints[3][0], 3.5) {
+		t.Errorf("got %+v, want 4 hours", series)
+	}
+}